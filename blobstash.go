@@ -19,7 +19,7 @@ var (
 func main() {
 	flag.BoolVar(&scan, "scan", false, "Trigger a BlobStore rescan.")
 	flag.BoolVar(&s3scan, "s3-scan", false, "Trigger a BlobStore rescan of the S3 backend.")
-	flag.BoolVar(&s3restore, "s3-restore", false, "Trigger a BlobStore restore of the S3 backend.")
+	flag.BoolVar(&s3restore, "s3-restore", false, "Restore the blobs missing locally from the S3 backend.")
 	flag.StringVar(&loglevel, "loglevel", "", "logging level (debug|info|warn|crit)")
 	flag.Parse()
 	conf := &config.Config{}
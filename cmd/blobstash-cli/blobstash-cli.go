@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
-	_ "encoding/json"
+	"encoding/json"
 	"flag"
 	"fmt"
-	_ "io/ioutil"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	_ "path/filepath"
 	"strings"
@@ -223,6 +225,171 @@ func (r *filetreePutCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interf
 	return subcommands.ExitSuccess
 }
 
+type statsCmd struct {
+	bs *blobstore.BlobStore
+}
+
+func (*statsCmd) Name() string     { return "stats" }
+func (*statsCmd) Synopsis() string { return "Display the storage stats" }
+func (*statsCmd) Usage() string {
+	return `stats :
+	Display the storage stats.
+`
+}
+
+func (*statsCmd) SetFlags(_ *flag.FlagSet) {}
+
+type Stats struct {
+	Ready       bool  `json:"ready"`
+	BlobsCount  int64 `json:"blobs_count"`
+	BlobsSize   int64 `json:"blobs_size"`
+	AvgBlobSize int64 `json:"avg_blob_size"`
+	Histogram   []*struct {
+		MaxSize int64 `json:"max_size"`
+		Count   int64 `json:"count"`
+	} `json:"size_histogram"`
+	MetaTypes  map[string]int64 `json:"meta_types"`
+	Categories map[string]*struct {
+		Count int64   `json:"count"`
+		Size  int64   `json:"size"`
+		Share float64 `json:"share"`
+	} `json:"categories"`
+}
+
+func (s *statsCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	stats := &Stats{}
+	if err := s.bs.Client().GetJSON("/api/blobstore/stats", nil, stats); err != nil {
+		return rerr("failed to fetch stats: %v", err)
+	}
+	if !stats.Ready {
+		fmt.Printf("(the stats index is still being built)\n")
+	}
+	fmt.Printf("blobs:\t%d\nsize:\t%s\navg:\t%s\n\n", stats.BlobsCount, humanize.Bytes(uint64(stats.BlobsSize)), humanize.Bytes(uint64(stats.AvgBlobSize)))
+	fmt.Printf("size histogram:\n")
+	for _, b := range stats.Histogram {
+		label := "larger"
+		if b.MaxSize > 0 {
+			label = "<= " + humanize.Bytes(uint64(b.MaxSize))
+		}
+		fmt.Printf("  %s\t%d\n", label, b.Count)
+	}
+	fmt.Printf("\ncategories:\n")
+	for _, name := range []string{"docstore", "kvstore", "filetree", "meta", "other"} {
+		if c, ok := stats.Categories[name]; ok {
+			fmt.Printf("  %s\t%d blobs\t%s\t%.1f%%\n", name, c.Count, humanize.Bytes(uint64(c.Size)), c.Share*100)
+		}
+	}
+	fmt.Printf("\nmeta types:\n")
+	for mt, cnt := range stats.MetaTypes {
+		fmt.Printf("  %s\t%d\n", mt, cnt)
+	}
+	return subcommands.ExitSuccess
+}
+
+type exportCmd struct {
+	bs     *blobstore.BlobStore
+	start  string
+	end    string
+	key    string
+	ref    string
+	output string
+}
+
+func (*exportCmd) Name() string     { return "export" }
+func (*exportCmd) Synopsis() string { return "Export blobs as a tar archive" }
+func (*exportCmd) Usage() string {
+	return `export [-start <hash>] [-end <hash>] [-key <key>] [-ref <ref>] [-o <file>] :
+	Export all the blobs, a hash range, or the blobs reachable from a key or a filetree ref as a tar archive.
+`
+}
+
+func (e *exportCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&e.start, "start", "", "Start of the hash range")
+	f.StringVar(&e.end, "end", "", "End of the hash range")
+	f.StringVar(&e.key, "key", "", "Export the blobs reachable from the key")
+	f.StringVar(&e.ref, "ref", "", "Export the blobs reachable from the filetree ref")
+	f.StringVar(&e.output, "o", "", "Output file (stdout by default)")
+}
+
+func (e *exportCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	q := url.Values{}
+	for k, v := range map[string]string{"start": e.start, "end": e.end, "key": e.key, "ref": e.ref} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	resp, err := e.bs.Client().DoReq("GET", "/api/archive/export?"+q.Encode(), nil, nil)
+	if err != nil {
+		return rerr("failed to export: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return rerr("failed to export: %s", body)
+	}
+	var out io.Writer = os.Stdout
+	if e.output != "" {
+		file, err := os.Create(e.output)
+		if err != nil {
+			return rerr("failed to create the output file: %v", err)
+		}
+		defer file.Close()
+		out = file
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return rerr("failed to export: %v", err)
+	}
+	return subcommands.ExitSuccess
+}
+
+type importCmd struct {
+	bs *blobstore.BlobStore
+}
+
+func (*importCmd) Name() string     { return "import" }
+func (*importCmd) Synopsis() string { return "Import blobs from a tar archive" }
+func (*importCmd) Usage() string {
+	return `import [<file>] :
+	Import the blobs of a tar archive created by export (read from stdin if no file is given).
+`
+}
+
+func (*importCmd) SetFlags(_ *flag.FlagSet) {}
+
+func (i *importCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	var in io.Reader = os.Stdin
+	if f.NArg() == 1 {
+		file, err := os.Open(f.Arg(0))
+		if err != nil {
+			return rerr("failed to open the archive: %v", err)
+		}
+		defer file.Close()
+		in = file
+	}
+	resp, err := i.bs.Client().DoReq("POST", "/api/archive/import", map[string]string{"Content-Type": "application/x-tar"}, in)
+	if err != nil {
+		return rerr("failed to import: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return rerr("failed to import: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return rerr("failed to import: %s", body)
+	}
+	stats := &struct {
+		BlobsCount int `json:"blobs_count"`
+		BlobsSize  int `json:"blobs_size"`
+		Existing   int `json:"existing_count"`
+		Deleted    int `json:"deleted_count"`
+	}{}
+	if err := json.Unmarshal(body, stats); err != nil {
+		return rerr("failed to unmarshal: %v", err)
+	}
+	return rsuccess("imported %d blobs (%s), %d already present, %d deleted\n", stats.BlobsCount, humanize.Bytes(uint64(stats.BlobsSize)), stats.Existing, stats.Deleted)
+}
+
 func main() {
 	// TODO(tsileo) config file with server address and collection name
 	opts := blobstore.DefaultOpts().SetHost(os.Getenv("BLOBSTASH_API_HOST"), os.Getenv("BLOBSTASH_API_KEY"))
@@ -242,6 +409,9 @@ func main() {
 	subcommands.Register(&filetreePutCmd{bs: bs, kvs: kvs}, "")
 	subcommands.Register(&filetreeDownloadCmd{bs: bs, kvs: kvs}, "")
 	subcommands.Register(&filetreeLsCmd{bs: bs, kvs: kvs}, "")
+	subcommands.Register(&statsCmd{bs: bs}, "")
+	subcommands.Register(&exportCmd{bs: bs}, "")
+	subcommands.Register(&importCmd{bs: bs}, "")
 
 	flag.Parse()
 	ctx := context.Background()
@@ -0,0 +1,326 @@
+/*
+
+Package archive implements the bulk export/import of blobs as a tar stream.
+
+Every blob is stored as a tar entry named after its hash, so an archive can be inspected with the standard tools. The
+exported blobs can be selected by:
+
+- a hash range (all the blobs by default)
+- a key: the meta blobs of every version of the key, and all the blobs reachable from them (see `gc.Walker`)
+- a filetree ref: the node and all its children
+
+Importing an archive saves the blobs like any other upload (meta blobs are applied, and the hub events are sent), so
+it can be used to seed a new replica, or for air-gapped transfers.
+
+The last entry is a manifest (`MANIFEST.json`) with the number of blobs and a checksum of their hashes, an export
+failing while streaming the response has no manifest, so the import of a truncated archive fails.
+
+*/
+package archive // import "a4.io/blobstash/pkg/archive"
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/gc"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// The maximum size of an imported blob (same as an upload)
+const maxBlobSize = 16 << 20
+
+// ManifestName is the name of the last entry of an archive
+const ManifestName = "MANIFEST.json"
+
+// Manifest holds the number of blobs in the archive, and the checksum (BLAKE2b-256) of their hashes (one per line, in
+// the archive order)
+type Manifest struct {
+	BlobsCount int    `json:"blobs_count"`
+	Checksum   string `json:"checksum"`
+}
+
+// manifestBuilder computes the manifest while the blobs are written/read
+type manifestBuilder struct {
+	h     hash.Hash
+	count int
+}
+
+func newManifestBuilder() *manifestBuilder {
+	return &manifestBuilder{h: hashutil.NewHash()}
+}
+
+func (m *manifestBuilder) add(hash string) {
+	m.h.Write([]byte(hash + "\n"))
+	m.count++
+}
+
+func (m *manifestBuilder) manifest() *Manifest {
+	return &Manifest{BlobsCount: m.count, Checksum: hex.EncodeToString(m.h.Sum(nil))}
+}
+
+// invalidArchiveError implements `httputil.PublicErrorer`, returned when the archive is malformed
+type invalidArchiveError struct {
+	err error
+}
+
+func (e *invalidArchiveError) Error() string { return fmt.Sprintf("invalid archive: %v", e.err) }
+func (e *invalidArchiveError) Status() int   { return http.StatusBadRequest }
+
+// Selection selects the blobs to export, a key or a ref takes precedence over the hash range
+type Selection struct {
+	Start string
+	End   string
+	Key   string
+	Ref   string
+}
+
+// Stats holds the result of an export or an import
+type Stats struct {
+	BlobsCount int    `json:"blobs_count"`
+	BlobsSize  int    `json:"blobs_size"`
+	Existing   int    `json:"existing_count"`
+	Deleted    int    `json:"deleted_count"`
+	Duration   string `json:"duration"`
+}
+
+// Archive exports/imports the blobs
+type Archive struct {
+	blobStore *blobstore.BlobStore
+	kvStore   *kvstore.KvStore
+	meta      *meta.Meta
+
+	log log.Logger
+}
+
+// New initializes the archive app
+func New(logger log.Logger, blobStore *blobstore.BlobStore, kvStore *kvstore.KvStore, m *meta.Meta) *Archive {
+	logger.Debug("init")
+	return &Archive{
+		blobStore: blobStore,
+		kvStore:   kvStore,
+		meta:      m,
+		log:       logger,
+	}
+}
+
+// Export writes the selected blobs to `w` as a tar archive
+func (a *Archive) Export(ctx context.Context, w io.Writer, sel *Selection) (*Stats, error) {
+	start := time.Now()
+	stats := &Stats{}
+	tw := tar.NewWriter(w)
+	mb := newManifestBuilder()
+	write := func(hash string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     hash,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		mb.add(hash)
+		stats.BlobsCount++
+		stats.BlobsSize += len(data)
+		return nil
+	}
+
+	if sel.Key != "" || sel.Ref != "" {
+		metaBlobs, hashes, err := a.reachable(ctx, sel)
+		if err != nil {
+			return nil, err
+		}
+		// The meta blobs first, so the key is available as soon as possible when importing
+		for _, mblob := range metaBlobs {
+			if err := write(mblob.Hash, mblob.Data); err != nil {
+				return nil, err
+			}
+		}
+		for _, hash := range hashes {
+			data, err := a.blobStore.Get(ctx, hash)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get blob %s: %v", hash, err)
+			}
+			if err := write(hash, data); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		end := sel.End
+		if end == "" {
+			end = "\xff"
+		}
+		if err := a.blobStore.Iter(ctx, sel.Start, end, 0, func(ref *blob.SizedBlobRef) error {
+			data, err := a.blobStore.Get(ctx, ref.Hash)
+			if err != nil {
+				return fmt.Errorf("failed to get blob %s: %v", ref.Hash, err)
+			}
+			return write(ref.Hash, data)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// The manifest is only written if all the blobs were exported
+	js, err := json.Marshal(mb.manifest())
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     ManifestName,
+		Mode:     0644,
+		Size:     int64(len(js)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(js); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	stats.Duration = time.Since(start).String()
+	a.log.Info("blobs exported", "blobs_count", stats.BlobsCount, "blobs_size", stats.BlobsSize, "duration", stats.Duration)
+	return stats, nil
+}
+
+// reachable returns the meta blobs of the selected key (the key-value entries are rebuilt, as the meta blob hash is
+// not stored in the index), and the sorted list of blobs reachable from the selection
+func (a *Archive) reachable(ctx context.Context, sel *Selection) ([]*blob.Blob, []string, error) {
+	marked := map[string]struct{}{}
+	walker := gc.NewWalker(a.log, a.blobStore, a.kvStore, func(hash string) bool {
+		if _, ok := marked[hash]; ok {
+			return false
+		}
+		marked[hash] = struct{}{}
+		return true
+	})
+
+	var metaBlobs []*blob.Blob
+	if sel.Key != "" {
+		versions, _, err := a.kvStore.Versions(ctx, sel.Key, -1, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, kv := range versions.Versions {
+			mblob, err := a.meta.Build(&vkv.KeyValue{Key: sel.Key, Version: kv.Version, Hash: kv.Hash, Data: kv.Data})
+			if err != nil {
+				return nil, nil, err
+			}
+			metaBlobs = append(metaBlobs, mblob)
+		}
+		if err := walker.Key(ctx, sel.Key); err != nil {
+			return nil, nil, err
+		}
+	}
+	if sel.Ref != "" {
+		if err := walker.Node(ctx, sel.Ref); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var hashes []string
+	for hash := range marked {
+		// Skip the dangling references
+		exists, err := a.blobStore.Stat(ctx, hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if exists {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return metaBlobs, hashes, nil
+}
+
+// Import saves all the blobs of the tar archive, the archive is invalid if the manifest is missing or doesn't match the
+// blobs (the blobs read before are saved anyway)
+func (a *Archive) Import(ctx context.Context, r io.Reader) (*Stats, error) {
+	start := time.Now()
+	stats := &Stats{}
+	tr := tar.NewReader(r)
+	mb := newManifestBuilder()
+	var manifest *Manifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &invalidArchiveError{err}
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if manifest != nil {
+			return nil, &invalidArchiveError{fmt.Errorf("unexpected entry %s after the manifest", hdr.Name)}
+		}
+		if hdr.Name == ManifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, &invalidArchiveError{fmt.Errorf("failed to decode the manifest: %v", err)}
+			}
+			if expected := mb.manifest(); *manifest != *expected {
+				return nil, &invalidArchiveError{fmt.Errorf("the manifest doesn't match the %d blobs read, the archive is incomplete", expected.BlobsCount)}
+			}
+			continue
+		}
+		if hdr.Size > maxBlobSize {
+			return nil, &invalidArchiveError{fmt.Errorf("blob %s is too large", hdr.Name)}
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, &invalidArchiveError{err}
+		}
+		b := &blob.Blob{Hash: hdr.Name, Data: data}
+		if err := b.Check(); err != nil {
+			return nil, &invalidArchiveError{err}
+		}
+		mb.add(b.Hash)
+		exists, err := a.blobStore.Stat(ctx, b.Hash)
+		if err != nil {
+			return nil, err
+		}
+		// Existing blobs are saved again too, as they may be imported in a namespace
+		if err := a.blobStore.Put(ctx, b); err != nil {
+			if err == blobstore.ErrBlobDeleted {
+				// Don't resurrect deleted blobs
+				stats.Deleted++
+				continue
+			}
+			return nil, err
+		}
+		if exists {
+			stats.Existing++
+			continue
+		}
+		stats.BlobsCount++
+		stats.BlobsSize += len(data)
+	}
+	if manifest == nil {
+		return nil, &invalidArchiveError{fmt.Errorf("missing manifest, the archive is truncated")}
+	}
+	stats.Duration = time.Since(start).String()
+	a.log.Info("blobs imported", "blobs_count", stats.BlobsCount, "existing", stats.Existing, "deleted", stats.Deleted, "duration", stats.Duration)
+	return stats, nil
+}
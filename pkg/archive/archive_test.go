@@ -0,0 +1,172 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore/blobstoretest"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/kvstore"
+)
+
+// newTestArchive initializes a blobstore and a kvstore in a temp dir
+func newTestArchive(t *testing.T) (*Archive, func()) {
+	env, cleanup := blobstoretest.New(t)
+	kvs, err := kvstore.New(env.Logger, env.Conf, env.BlobStore, env.Meta)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return New(env.Logger, env.BlobStore, kvs, env.Meta), func() {
+		kvs.Close()
+		cleanup()
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src, closeSrc := newTestArchive(t)
+	defer closeSrc()
+	ctx := context.Background()
+
+	// A file node, referenced by a key
+	chunk := blob.New([]byte("chunk data"))
+	blobstoretest.Check(t, src.blobStore.Put(ctx, chunk))
+	n := &rnode.RawNode{Name: "file", Type: "file"}
+	n.AddIndexedRef(len(chunk.Data), chunk.Hash)
+	nhash, ndata := n.Encode()
+	blobstoretest.Check(t, src.blobStore.Put(ctx, &blob.Blob{Hash: nhash, Data: ndata}))
+	_, err := src.kvStore.Put(ctx, "file", nhash, nil, 1)
+	blobstoretest.Check(t, err)
+	other := blob.New([]byte("unrelated blob"))
+	blobstoretest.Check(t, src.blobStore.Put(ctx, other))
+
+	// Export the blobs reachable from the key (the kv meta blob, the node and the chunk)
+	var buf bytes.Buffer
+	stats, err := src.Export(ctx, &buf, &Selection{Key: "file"})
+	blobstoretest.Check(t, err)
+	if stats.BlobsCount != 3 {
+		t.Errorf("expected 3 blobs exported, got %d", stats.BlobsCount)
+	}
+
+	dst, closeDst := newTestArchive(t)
+	defer closeDst()
+	stats, err = dst.Import(ctx, bytes.NewReader(buf.Bytes()))
+	blobstoretest.Check(t, err)
+	if stats.BlobsCount != 3 || stats.Existing != 0 {
+		t.Errorf("unexpected import stats %+v", stats)
+	}
+	// The meta blob has been applied
+	kv, err := dst.kvStore.Get(ctx, "file", -1)
+	blobstoretest.Check(t, err)
+	if kv.HexHash() != nhash {
+		t.Errorf("bad key hash, expected %s, got %s", nhash, kv.HexHash())
+	}
+	for _, hash := range []string{chunk.Hash, nhash} {
+		exists, err := dst.blobStore.Stat(ctx, hash)
+		blobstoretest.Check(t, err)
+		if !exists {
+			t.Errorf("blob %s should have been imported", hash)
+		}
+	}
+	exists, err := dst.blobStore.Stat(ctx, other.Hash)
+	blobstoretest.Check(t, err)
+	if exists {
+		t.Errorf("blob %s should not have been imported", other.Hash)
+	}
+
+	// Export everything, the blobs already imported are skipped
+	buf.Reset()
+	stats, err = src.Export(ctx, &buf, &Selection{})
+	blobstoretest.Check(t, err)
+	if stats.BlobsCount != 4 {
+		t.Errorf("expected 4 blobs exported, got %d", stats.BlobsCount)
+	}
+	stats, err = dst.Import(ctx, &buf)
+	blobstoretest.Check(t, err)
+	if stats.BlobsCount != 1 || stats.Existing != 3 {
+		t.Errorf("unexpected import stats %+v", stats)
+	}
+
+	// Corrupted archives are rejected
+	if _, err := dst.Import(ctx, bytes.NewReader([]byte("not a tar archive"))); err == nil {
+		t.Errorf("invalid archive should fail")
+	}
+}
+
+type entry struct {
+	name string
+	data []byte
+}
+
+func readEntries(t *testing.T, archive []byte) []*entry {
+	var entries []*entry
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		blobstoretest.Check(t, err)
+		data, err := ioutil.ReadAll(tr)
+		blobstoretest.Check(t, err)
+		entries = append(entries, &entry{hdr.Name, data})
+	}
+}
+
+func writeEntries(t *testing.T, entries []*entry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		blobstoretest.Check(t, tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(e.data)
+		blobstoretest.Check(t, err)
+	}
+	blobstoretest.Check(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestImportIncomplete(t *testing.T) {
+	src, closeSrc := newTestArchive(t)
+	defer closeSrc()
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		blobstoretest.Check(t, src.blobStore.Put(ctx, blob.New([]byte(fmt.Sprintf("blob %d", i)))))
+	}
+	var buf bytes.Buffer
+	_, err := src.Export(ctx, &buf, &Selection{})
+	blobstoretest.Check(t, err)
+
+	// The manifest is the last entry
+	entries := readEntries(t, buf.Bytes())
+	if len(entries) != 4 || entries[3].name != ManifestName {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	blobs, manifest := entries[:3], entries[3]
+
+	dst, closeDst := newTestArchive(t)
+	defer closeDst()
+	for name, archive := range map[string][]byte{
+		"truncated":           writeEntries(t, blobs),
+		"missing blob":        writeEntries(t, []*entry{blobs[0], blobs[2], manifest}),
+		"reordered blobs":     writeEntries(t, []*entry{blobs[1], blobs[0], blobs[2], manifest}),
+		"entry after the end": writeEntries(t, append(entries, blobs[0])),
+	} {
+		if _, err := dst.Import(ctx, bytes.NewReader(archive)); err == nil {
+			t.Errorf("the %s archive should fail", name)
+		} else if _, ok := err.(*invalidArchiveError); !ok {
+			t.Errorf("unexpected error for the %s archive: %v", name, err)
+		}
+	}
+
+	stats, err := dst.Import(ctx, &buf)
+	blobstoretest.Check(t, err)
+	if stats.BlobsCount+stats.Existing != 3 {
+		t.Errorf("unexpected import stats %+v", stats)
+	}
+}
@@ -0,0 +1,62 @@
+package archive // import "a4.io/blobstash/pkg/archive"
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+func (a *Archive) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/export", basicAuth(http.HandlerFunc(a.exportHandler())))
+	r.Handle("/import", basicAuth(http.HandlerFunc(a.importHandler())))
+}
+
+func (a *Archive) exportHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			q := r.URL.Query()
+			sel := &Selection{
+				Start: q.Get("start"),
+				End:   q.Get("end"),
+				Key:   q.Get("key"),
+				Ref:   q.Get("ref"),
+			}
+			w.Header().Set("Content-Type", "application/x-tar")
+			if _, err := a.Export(ctxutil.WithRequest(r.Context(), r), w, sel); err != nil {
+				// The headers are already sent, the archive has no manifest so its import will fail
+				a.log.Error("failed to export the blobs", "err", err)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (a *Archive) importHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			ctx := ctxutil.WithRequest(context.Background(), r)
+			if ns := r.Header.Get("BlobStash-Namespace"); ns != "" {
+				ctx = ctxutil.WithNamespace(ctx, ns)
+			}
+			stats, err := a.Import(ctx, r.Body)
+			if err != nil {
+				if perr, ok := err.(httputil.PublicErrorer); ok {
+					httputil.WriteJSONError(w, perr.Status(), perr.Error())
+					return
+				}
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, stats)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
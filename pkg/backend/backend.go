@@ -0,0 +1,44 @@
+/*
+
+Package backend defines the interface implemented by the BlobStore storage engines.
+
+*/
+package backend // import "a4.io/blobstash/pkg/backend"
+
+import (
+	"errors"
+
+	"a4.io/blobstash/pkg/blob"
+)
+
+// ErrDeleteNotSupported is returned when trying to remove a blob from a backend that does not implement `Deleter`
+var ErrDeleteNotSupported = errors.New("backend does not support deletion")
+
+// Backend is the interface a storage engine must implement to be used by the BlobStore.
+//
+// `Get` must return `clientutil.ErrBlobNotFound` if the blob does not exist, and `Enumerate` must close the
+// channel once all the blobs have been sent (in lexicographical order).
+type Backend interface {
+	Put(hash string, data []byte) error
+	Get(hash string) ([]byte, error)
+	Exists(hash string) (bool, error)
+	Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error
+	Close() error
+}
+
+// Deleter is implemented by the backends that can remove blobs
+type Deleter interface {
+	Delete(hash string) error
+}
+
+// SupportsDelete returns true if the blobs can be physically removed from the backend, the wrapping backends (that
+// always implement `Deleter`) must implement `SupportsDelete() bool` to forward the check to the wrapped backend
+func SupportsDelete(b Backend) bool {
+	if s, ok := b.(interface {
+		SupportsDelete() bool
+	}); ok {
+		return s.SupportsDelete()
+	}
+	_, ok := b.(Deleter)
+	return ok
+}
@@ -0,0 +1,191 @@
+/*
+
+Package blobsdir implements a simple BlobStore backend storing each blob in its own file.
+
+Blobs are sharded in sub-directories using the first 2 hex characters of their hash:
+
+	<dir>/<hash[0:2]>/<hash>
+
+It is meant for small instances and tests, it does not provide any of the BlobsFile features (compaction, error correcting code...).
+
+*/
+package blobsdir // import "a4.io/blobstash/pkg/backend/blobsdir"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+)
+
+// BlobsDirBackend implements the `backend.Backend` interface
+type BlobsDirBackend struct {
+	dir string
+}
+
+// New initializes a backend in the given directory (it will be created if needed)
+func New(dir string) (*BlobsDirBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &BlobsDirBackend{dir}, nil
+}
+
+func (b *BlobsDirBackend) String() string {
+	return fmt.Sprintf("blobsdir-backend-%s", b.dir)
+}
+
+func (b *BlobsDirBackend) path(hash string) (string, error) {
+	if len(hash) < 3 {
+		return "", fmt.Errorf("invalid hash \"%s\"", hash)
+	}
+	return filepath.Join(b.dir, hash[0:2], hash), nil
+}
+
+func (b *BlobsDirBackend) Put(hash string, data []byte) error {
+	path, err := b.path(hash)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Write in a temporary file first, so a crash won't leave a partial blob behind
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+hash)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (b *BlobsDirBackend) Get(hash string) ([]byte, error) {
+	path, err := b.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, clientutil.ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (b *BlobsDirBackend) Exists(hash string) (bool, error) {
+	path, err := b.path(hash)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete implements the `backend.Deleter` interface
+func (b *BlobsDirBackend) Delete(hash string) error {
+	path, err := b.path(hash)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *BlobsDirBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error {
+	defer close(blobs)
+	var cnt int
+	// The shards are named after the first byte of the hashes, so the root dir doesn't need to be listed (the
+	// BlobStore enumerates the blobs by page, it would be listed for every page)
+	for i := 0; i < 256; i++ {
+		shard := fmt.Sprintf("%02x", i)
+		// Skip the whole shard if it's outside the range
+		if shard < start[0:min(2, len(start))] || shard > end {
+			continue
+		}
+		names, err := readDirNames(filepath.Join(b.dir, shard))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		// Seek to `start`, and only stat the enumerated blobs
+		for _, hash := range names[sort.SearchStrings(names, start):] {
+			if hash > end {
+				return nil
+			}
+			if hash[0] == '.' {
+				continue
+			}
+			f, err := os.Stat(filepath.Join(b.dir, shard, hash))
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Deleted since the listing
+					continue
+				}
+				return err
+			}
+			if f.IsDir() {
+				continue
+			}
+			blobs <- &blob.SizedBlobRef{Hash: hash, Size: int(f.Size())}
+			cnt++
+			if limit > 0 && cnt == limit {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the sorted names of the dir entries (without calling lstat on each entry like `ioutil.ReadDir`)
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *BlobsDirBackend) Close() error {
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,118 @@
+package blobsdir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobsdir_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	back, err := New(dir)
+	check(err)
+	defer back.Close()
+
+	blobs := []*blob.Blob{}
+	for _, data := range []string{"foo", "bar", "baz"} {
+		b := blob.New([]byte(data))
+		check(back.Put(b.Hash, b.Data))
+		blobs = append(blobs, b)
+	}
+
+	for _, b := range blobs {
+		ok, err := back.Exists(b.Hash)
+		check(err)
+		if !ok {
+			t.Errorf("blob %s should exist", b.Hash)
+		}
+		data, err := back.Get(b.Hash)
+		check(err)
+		if !bytes.Equal(data, b.Data) {
+			t.Errorf("bad blob content for %s, expected %q, got %q", b.Hash, b.Data, data)
+		}
+	}
+
+	missing := blob.New([]byte("missing"))
+	ok, err := back.Exists(missing.Hash)
+	check(err)
+	if ok {
+		t.Errorf("blob %s should not exist", missing.Hash)
+	}
+	if _, err := back.Get(missing.Hash); err != clientutil.ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+
+	refs := make(chan *blob.SizedBlobRef)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- back.Enumerate(refs, "", "\xff", 0)
+	}()
+	var last string
+	var cnt int
+	for ref := range refs {
+		if ref.Hash <= last {
+			t.Errorf("blobs should be enumerated in lexicographical order (%s after %s)", ref.Hash, last)
+		}
+		if ref.Size != 3 {
+			t.Errorf("bad size for %s, expected 3, got %d", ref.Hash, ref.Size)
+		}
+		last = ref.Hash
+		cnt++
+	}
+	check(<-errc)
+	if cnt != len(blobs) {
+		t.Errorf("expected %d blobs, got %d", len(blobs), cnt)
+	}
+
+	refs = make(chan *blob.SizedBlobRef)
+	go func() {
+		errc <- back.Enumerate(refs, "", "\xff", 2)
+	}()
+	cnt = 0
+	for _ = range refs {
+		cnt++
+	}
+	check(<-errc)
+	if cnt != 2 {
+		t.Errorf("expected 2 blobs with limit, got %d", cnt)
+	}
+
+	// Enumerate a single blob
+	hashes := []string{blobs[0].Hash, blobs[1].Hash, blobs[2].Hash}
+	sort.Strings(hashes)
+	refs = make(chan *blob.SizedBlobRef)
+	go func() {
+		errc <- back.Enumerate(refs, hashes[1], hashes[1], 0)
+	}()
+	var enumerated []string
+	for ref := range refs {
+		enumerated = append(enumerated, ref.Hash)
+	}
+	check(<-errc)
+	if len(enumerated) != 1 || enumerated[0] != hashes[1] {
+		t.Errorf("expected only %s, got %v", hashes[1], enumerated)
+	}
+
+	check(back.Delete(blobs[0].Hash))
+	ok, err = back.Exists(blobs[0].Hash)
+	check(err)
+	if ok {
+		t.Errorf("blob %s should have been deleted", blobs[0].Hash)
+	}
+	// Deleting a missing blob is a no-op
+	check(back.Delete(missing.Hash))
+}
@@ -0,0 +1,67 @@
+/*
+
+Package blobsfile implements the default BlobStore backend on top of the BlobsFile storage engine.
+
+BlobsFile is append-only, the blobs can't be removed (it does not implement `backend.Deleter`), use the `blobsdir`
+backend if blobs must be deleted.
+
+*/
+package blobsfile // import "a4.io/blobstash/pkg/backend/blobsfile"
+
+import (
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+)
+
+// BlobsFileBackend implements the `backend.Backend` interface
+type BlobsFileBackend struct {
+	back *blobsfile.BlobsFiles
+}
+
+// New initializes a BlobsFile backend in the given directory
+func New(dir string) (*BlobsFileBackend, error) {
+	back, err := blobsfile.New(&blobsfile.Opts{Directory: dir})
+	if err != nil {
+		return nil, err
+	}
+	return &BlobsFileBackend{back}, nil
+}
+
+func (b *BlobsFileBackend) String() string {
+	return "blobsfile-backend"
+}
+
+func (b *BlobsFileBackend) Put(hash string, data []byte) error {
+	return b.back.Put(hash, data)
+}
+
+func (b *BlobsFileBackend) Get(hash string) ([]byte, error) {
+	data, err := b.back.Get(hash)
+	if err == blobsfile.ErrBlobNotFound {
+		return nil, clientutil.ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (b *BlobsFileBackend) Exists(hash string) (bool, error) {
+	return b.back.Exists(hash)
+}
+
+func (b *BlobsFileBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error {
+	defer close(blobs)
+	out := make(chan *blobsfile.Blob)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.back.Enumerate(out, start, end, limit)
+	}()
+	for cblob := range out {
+		blobs <- &blob.SizedBlobRef{Hash: cblob.Hash, Size: cblob.Size}
+	}
+	return <-errc
+}
+
+func (b *BlobsFileBackend) Close() error {
+	return b.back.Close()
+}
@@ -0,0 +1,143 @@
+/*
+
+Package compressed implements a `backend.Backend` wrapper that transparently compresses the blobs at rest.
+
+The blob hash is still computed over the uncompressed data, and the codec is recorded in a small header so blobs
+written without compression (or with another codec) can still be read.
+
+*/
+package compressed // import "a4.io/blobstash/pkg/backend/compressed"
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/snappy"
+
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/blob"
+)
+
+// Codecs, stored as a single byte right after the header
+const (
+	CodecNone byte = iota
+	CodecSnappy
+)
+
+// Codec names, as used in the config
+const (
+	None   = "none"
+	Snappy = "snappy"
+)
+
+var header = []byte("#blobstash/compressed\n")
+
+// CompressedBackend implements the `backend.Backend` interface
+type CompressedBackend struct {
+	back  backend.Backend
+	codec byte
+}
+
+// New wraps the given backend, the codec will be used for all the new blobs
+func New(back backend.Backend, codec string) (*CompressedBackend, error) {
+	b := &CompressedBackend{back: back}
+	switch codec {
+	case "", None:
+		b.codec = CodecNone
+	case Snappy:
+		b.codec = CodecSnappy
+	default:
+		return nil, fmt.Errorf("unknown compression codec \"%s\"", codec)
+	}
+	return b, nil
+}
+
+func (b *CompressedBackend) String() string {
+	return fmt.Sprintf("compressed-%v", b.back)
+}
+
+// Encode compresses the data using the given codec, the data is kept uncompressed if compressing it does not save
+// any space
+func Encode(codec byte, data []byte) ([]byte, error) {
+	var compressed []byte
+	switch codec {
+	case CodecNone:
+	case CodecSnappy:
+		compressed = snappy.Encode(nil, data)
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+	if compressed != nil && len(header)+1+len(compressed) < len(data) {
+		out := make([]byte, 0, len(header)+1+len(compressed))
+		out = append(out, header...)
+		out = append(out, codec)
+		return append(out, compressed...), nil
+	}
+	// Only add a header if the raw data could be mistaken for an encoded blob
+	if bytes.HasPrefix(data, header) {
+		out := make([]byte, 0, len(header)+1+len(data))
+		out = append(out, header...)
+		out = append(out, CodecNone)
+		return append(out, data...), nil
+	}
+	return data, nil
+}
+
+// Decode returns the uncompressed data, blobs without header are returned as is
+func Decode(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, header) || len(data) < len(header)+1 {
+		return data, nil
+	}
+	payload := data[len(header)+1:]
+	switch codec := data[len(header)]; codec {
+	case CodecNone:
+		return payload, nil
+	case CodecSnappy:
+		return snappy.Decode(nil, payload)
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+}
+
+func (b *CompressedBackend) Put(hash string, data []byte) error {
+	encoded, err := Encode(b.codec, data)
+	if err != nil {
+		return err
+	}
+	return b.back.Put(hash, encoded)
+}
+
+func (b *CompressedBackend) Get(hash string) ([]byte, error) {
+	data, err := b.back.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(data)
+}
+
+func (b *CompressedBackend) Exists(hash string) (bool, error) {
+	return b.back.Exists(hash)
+}
+
+// Enumerate returns the blobs of the underlying backend, the size is the size of the blob at rest (i.e. compressed)
+func (b *CompressedBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error {
+	return b.back.Enumerate(blobs, start, end, limit)
+}
+
+// SupportsDelete returns true if the underlying backend supports deletion
+func (b *CompressedBackend) SupportsDelete() bool {
+	return backend.SupportsDelete(b.back)
+}
+
+// Delete removes the blob if the underlying backend implements `backend.Deleter`
+func (b *CompressedBackend) Delete(hash string) error {
+	deleter, ok := b.back.(backend.Deleter)
+	if !ok {
+		return backend.ErrDeleteNotSupported
+	}
+	return deleter.Delete(hash)
+}
+
+func (b *CompressedBackend) Close() error {
+	return b.back.Close()
+}
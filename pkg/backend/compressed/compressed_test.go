@@ -0,0 +1,75 @@
+package compressed
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"a4.io/blobstash/pkg/backend/blobsdir"
+	"a4.io/blobstash/pkg/blob"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, data := range [][]byte{
+		[]byte("foo"),
+		bytes.Repeat([]byte("compress me "), 100),
+		append(append([]byte{}, header...), CodecSnappy, 'f', 'o', 'o'),
+	} {
+		for _, codec := range []byte{CodecNone, CodecSnappy} {
+			encoded, err := Encode(codec, data)
+			check(err)
+			decoded, err := Decode(encoded)
+			check(err)
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("codec %d: failed to decode %q, got %q", codec, data, decoded)
+			}
+		}
+	}
+
+	data := bytes.Repeat([]byte("compress me "), 100)
+	encoded, err := Encode(CodecSnappy, data)
+	check(err)
+	if len(encoded) >= len(data) {
+		t.Errorf("data should have been compressed")
+	}
+}
+
+func TestBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compressed_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	raw, err := blobsdir.New(dir)
+	check(err)
+	back, err := New(raw, Snappy)
+	check(err)
+	defer back.Close()
+
+	// A blob written before compression was enabled
+	old := blob.New([]byte("old blob"))
+	check(raw.Put(old.Hash, old.Data))
+
+	b := blob.New(bytes.Repeat([]byte("compress me "), 100))
+	check(back.Put(b.Hash, b.Data))
+
+	rawData, err := raw.Get(b.Hash)
+	check(err)
+	if len(rawData) >= len(b.Data) {
+		t.Errorf("blob should be compressed at rest")
+	}
+
+	for _, expected := range []*blob.Blob{old, b} {
+		data, err := back.Get(expected.Hash)
+		check(err)
+		if !bytes.Equal(data, expected.Data) {
+			t.Errorf("bad blob %s data", expected.Hash)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+/*
+
+Package encrypted implements the blob encryption format (NaCl secretbox) shared by the S3 replication and the local
+at-rest encryption, and a `backend.Backend` wrapper that encrypts the blobs transparently.
+
+An encrypted blob is made of a header, the key ID, the plain-text hash, the nonce and the secretbox:
+
+	#blobstash/secretbox2\n<4 bytes key ID><32 bytes plain-text hash><24 bytes nonce><secretbox>
+
+The key ID is derived from the key (the first bytes of its hash), so a `Keyring` holding several keys can open blobs
+sealed with any of them, allowing to rotate the keys.
+
+Blobs addressed with a non-default hash algorithm store their plain-text ref as a multihash (a 1 byte algorithm code,
+a 1 byte digest length and the digest):
+
+	#blobstash/secretbox3\n<4 bytes key ID><multihash><24 bytes nonce><secretbox>
+
+Blobs sealed before the key IDs were introduced don't contain any key ID:
+
+	#blobstash/secretbox\n<32 bytes plain-text hash><24 bytes nonce><secretbox>
+
+The blobs are still addressed by their plain-text hash.
+
+*/
+package encrypted // import "a4.io/blobstash/pkg/backend/encrypted"
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+// The length of the nonce used for the secretbox implementation.
+const nonceLength = 24
+
+// The length of the encryption key for the secretbox implementation.
+const KeyLength = 32
+
+// The length of the (decoded) plain-text hash stored in the header
+const hashLength = 32
+
+// The max length of the (decoded) multihash stored in the header (code + length + digest)
+const maxMultihashLength = 2 + hashLength
+
+// The length of the key ID stored in the header
+const keyIDLength = 4
+
+// Header is the prefix of all the encrypted blobs
+var Header = []byte("#blobstash/secretbox2\n")
+
+// MultihashHeader is the prefix of the encrypted blobs addressed with a non-default hash algorithm
+var MultihashHeader = []byte("#blobstash/secretbox3\n")
+
+// LegacyHeader is the prefix of the blobs encrypted before the key IDs were introduced
+var LegacyHeader = []byte("#blobstash/secretbox\n")
+
+// HeaderLength is the number of bytes needed to read the key ID and the plain-text hash of any blob
+var HeaderLength = len(MultihashHeader) + keyIDLength + maxMultihashLength
+
+// ErrDecryptionFailed is returned when the secretbox can't be opened
+var ErrDecryptionFailed = errors.New("failed to decrypt file (bad password?)")
+
+// ErrUnknownKey is returned when the blob is sealed with a key missing from the keyring
+var ErrUnknownKey = errors.New("blob sealed with an unknown key")
+
+// headerSize returns the offset of the plain-text hash, the size of the header (up to the nonce) and whether it's a
+// legacy header, or -1 if the header is missing
+func headerSize(data []byte) (int, int, bool) {
+	switch {
+	case bytes.HasPrefix(data, Header):
+		return len(Header) + keyIDLength, len(Header) + keyIDLength + hashLength, false
+	case bytes.HasPrefix(data, MultihashHeader):
+		start := len(MultihashHeader) + keyIDLength
+		if len(data) < start+2 {
+			return -1, -1, false
+		}
+		return start, start + 2 + int(data[start+1]), false
+	case bytes.HasPrefix(data, LegacyHeader):
+		return len(LegacyHeader), len(LegacyHeader) + hashLength, true
+	default:
+		return -1, -1, false
+	}
+}
+
+// IsEncrypted returns true if the data looks like an encrypted blob
+func IsEncrypted(data []byte) bool {
+	_, size, _ := headerSize(data)
+	return size != -1 && len(data) >= size+nonceLength
+}
+
+// KeyID returns the ID of the key as stored in the header of the sealed blobs
+func KeyID(nkey *[KeyLength]byte) string {
+	h := hashutil.ComputeRaw(nkey[:])
+	return hex.EncodeToString(h[:keyIDLength])
+}
+
+// Seal the data with nacl/secretbox, the key ID and the plain-text hash are stored in the header
+func Seal(nkey *[KeyLength]byte, hash string, data []byte) ([]byte, error) {
+	nonce := new([nonceLength]byte)
+	if _, err := rand.Reader.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+	header := Header
+	if len(bhash) != hashLength {
+		// The hash is a multihash (the ref is prefixed by the algorithm code and the digest length)
+		if len(bhash) < 2 || len(bhash) > maxMultihashLength || int(bhash[1]) != len(bhash)-2 {
+			return nil, fmt.Errorf("invalid hash \"%s\"", hash)
+		}
+		header = MultihashHeader
+	}
+	bkeyID, err := hex.DecodeString(KeyID(nkey))
+	if err != nil {
+		return nil, err
+	}
+	// Box will contains our meta data (header + key ID + plain-text hash + nonce)
+	box := make([]byte, len(header)+keyIDLength+len(bhash)+nonceLength)
+	copy(box[:], header)
+	copy(box[len(header):], bkeyID)
+	copy(box[len(header)+keyIDLength:], bhash)
+	// And the nonce
+	copy(box[len(header)+keyIDLength+len(bhash):], nonce[:])
+	return secretbox.Seal(box, data, nonce, nkey), nil
+}
+
+// Open a previously sealed secretbox
+func Open(nkey *[KeyLength]byte, data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, fmt.Errorf("missing header")
+	}
+	start, size, legacy := headerSize(data)
+	if !legacy && hex.EncodeToString(data[start-keyIDLength:start]) != KeyID(nkey) {
+		// Sealed with another key
+		return nil, ErrDecryptionFailed
+	}
+	// Extract the nonce
+	nonce := new([nonceLength]byte)
+	copy(nonce[:], data[size:size+nonceLength])
+	box := data[size+nonceLength:]
+	// Actually decrypt the cipher text
+	decrypted, success := secretbox.Open(nil, box, nonce, nkey)
+
+	// Ensure the decryption succeed
+	if !success {
+		return nil, ErrDecryptionFailed
+	}
+
+	return decrypted, nil
+}
+
+// PlainTextHash returns the plain-text hash stored in the header (only the first `HeaderLength` bytes are needed)
+func PlainTextHash(data []byte) (string, error) {
+	start, size, _ := headerSize(data)
+	if size == -1 || len(data) < size {
+		return "", fmt.Errorf("missing header")
+	}
+	return hex.EncodeToString(data[start:size]), nil
+}
+
+// SealedKeyID returns the ID of the key used to seal the blob, an empty string is returned for legacy blobs (only
+// the first `HeaderLength` bytes are needed)
+func SealedKeyID(data []byte) (string, error) {
+	start, size, legacy := headerSize(data)
+	if size == -1 || len(data) < size {
+		return "", fmt.Errorf("missing header")
+	}
+	if legacy {
+		return "", nil
+	}
+	return hex.EncodeToString(data[start-keyIDLength : start]), nil
+}
+
+// Keyring holds the current key, used to seal the blobs, and the older keys still needed to open the blobs sealed
+// before a key rotation
+type Keyring struct {
+	current *[KeyLength]byte
+	keys    map[string]*[KeyLength]byte
+	ids     []string
+}
+
+// NewKeyring returns a keyring that seals the blobs with the current key
+func NewKeyring(current *[KeyLength]byte, old ...*[KeyLength]byte) *Keyring {
+	k := &Keyring{current: current, keys: map[string]*[KeyLength]byte{}}
+	for _, key := range append([]*[KeyLength]byte{current}, old...) {
+		id := KeyID(key)
+		if _, ok := k.keys[id]; ok {
+			continue
+		}
+		k.keys[id] = key
+		k.ids = append(k.ids, id)
+	}
+	return k
+}
+
+// CurrentKeyID returns the ID of the key used to seal the new blobs
+func (k *Keyring) CurrentKeyID() string {
+	return k.ids[0]
+}
+
+// Seal the data with the current key
+func (k *Keyring) Seal(hash string, data []byte) ([]byte, error) {
+	return Seal(k.current, hash, data)
+}
+
+// Open the blob with the key it has been sealed with, every key is tried for legacy blobs
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	keyID, err := SealedKeyID(data)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != "" {
+		key, ok := k.keys[keyID]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		return Open(key, data)
+	}
+	for _, id := range k.ids {
+		decrypted, err := Open(k.keys[id], data)
+		switch err {
+		case nil:
+			return decrypted, nil
+		case ErrDecryptionFailed:
+		default:
+			return nil, err
+		}
+	}
+	return nil, ErrDecryptionFailed
+}
+
+// EncryptedBackend implements the `backend.Backend` interface
+type EncryptedBackend struct {
+	back backend.Backend
+	key  *[KeyLength]byte
+}
+
+// New wraps the given backend, all the new blobs will be encrypted with the given key
+func New(back backend.Backend, key *[KeyLength]byte) *EncryptedBackend {
+	return &EncryptedBackend{back: back, key: key}
+}
+
+func (b *EncryptedBackend) String() string {
+	return fmt.Sprintf("encrypted-%v", b.back)
+}
+
+func (b *EncryptedBackend) Put(hash string, data []byte) error {
+	sealed, err := Seal(b.key, hash, data)
+	if err != nil {
+		return err
+	}
+	return b.back.Put(hash, sealed)
+}
+
+// Get returns the decrypted blob, blobs saved before the encryption was enabled are returned as is
+func (b *EncryptedBackend) Get(hash string) ([]byte, error) {
+	data, err := b.back.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	phash, err := PlainTextHash(data)
+	if err != nil {
+		return nil, err
+	}
+	if phash != hash {
+		return nil, fmt.Errorf("blob %s header contains hash %s", hash, phash)
+	}
+	return Open(b.key, data)
+}
+
+func (b *EncryptedBackend) Exists(hash string) (bool, error) {
+	return b.back.Exists(hash)
+}
+
+// Enumerate returns the blobs of the underlying backend, the size is the size of the blob at rest (i.e. encrypted)
+func (b *EncryptedBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error {
+	return b.back.Enumerate(blobs, start, end, limit)
+}
+
+// SupportsDelete returns true if the underlying backend supports deletion
+func (b *EncryptedBackend) SupportsDelete() bool {
+	return backend.SupportsDelete(b.back)
+}
+
+// Delete removes the blob if the underlying backend implements `backend.Deleter`
+func (b *EncryptedBackend) Delete(hash string) error {
+	deleter, ok := b.back.(backend.Deleter)
+	if !ok {
+		return backend.ErrDeleteNotSupported
+	}
+	return deleter.Delete(hash)
+}
+
+func (b *EncryptedBackend) Close() error {
+	return b.back.Close()
+}
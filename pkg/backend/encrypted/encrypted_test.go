@@ -0,0 +1,151 @@
+package encrypted
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"a4.io/blobstash/pkg/backend/blobsdir"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypted_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	key := &[KeyLength]byte{}
+	copy(key[:], []byte("0123456789abcdef0123456789abcdef"))
+
+	raw, err := blobsdir.New(dir)
+	check(err)
+	back := New(raw, key)
+	defer back.Close()
+
+	// A blob written before encryption was enabled
+	old := blob.New([]byte("old blob"))
+	check(raw.Put(old.Hash, old.Data))
+
+	b := blob.New([]byte("secret blob"))
+	check(back.Put(b.Hash, b.Data))
+	// A blob addressed by its SHA-256 hash
+	sb, err := blob.NewWithAlgorithm(hashutil.SHA256, []byte("secret sha256 blob"))
+	check(err)
+	check(back.Put(sb.Hash, sb.Data))
+
+	sealed, err := raw.Get(b.Hash)
+	check(err)
+	if !IsEncrypted(sealed) || bytes.Contains(sealed, b.Data) {
+		t.Errorf("blob should be encrypted at rest")
+	}
+	phash, err := PlainTextHash(sealed)
+	check(err)
+	if phash != b.Hash {
+		t.Errorf("bad plain-text hash, expected %s, got %s", b.Hash, phash)
+	}
+
+	ssealed, err := raw.Get(sb.Hash)
+	check(err)
+	if !bytes.HasPrefix(ssealed, MultihashHeader) {
+		t.Errorf("SHA-256 blob should use the multihash header")
+	}
+	phash, err = PlainTextHash(ssealed[:HeaderLength])
+	check(err)
+	if phash != sb.Hash {
+		t.Errorf("bad plain-text hash, expected %s, got %s", sb.Hash, phash)
+	}
+
+	for _, expected := range []*blob.Blob{old, b, sb} {
+		data, err := back.Get(expected.Hash)
+		check(err)
+		if !bytes.Equal(data, expected.Data) {
+			t.Errorf("bad blob %s data", expected.Hash)
+		}
+	}
+
+	// The wrong key must not be able to decrypt the blob
+	badKey := &[KeyLength]byte{}
+	if _, err := Open(badKey, sealed); err != ErrDecryptionFailed {
+		t.Errorf("expected ErrDecryptionFailed, got %v", err)
+	}
+}
+
+// sealLegacy seals the data using the format without key ID
+func sealLegacy(nkey *[KeyLength]byte, hash string, data []byte) []byte {
+	nonce := new([nonceLength]byte)
+	bhash, err := hex.DecodeString(hash)
+	check(err)
+	box := make([]byte, len(LegacyHeader)+len(bhash)+nonceLength)
+	copy(box[:], LegacyHeader)
+	copy(box[len(LegacyHeader):], bhash)
+	copy(box[len(LegacyHeader)+len(bhash):], nonce[:])
+	return secretbox.Seal(box, data, nonce, nkey)
+}
+
+func TestKeyring(t *testing.T) {
+	oldKey := &[KeyLength]byte{}
+	copy(oldKey[:], []byte("0123456789abcdef0123456789abcdef"))
+	newKey := &[KeyLength]byte{}
+	copy(newKey[:], []byte("fedcba9876543210fedcba9876543210"))
+
+	b := blob.New([]byte("secret blob"))
+	legacy := sealLegacy(oldKey, b.Hash, b.Data)
+	sealed, err := Seal(oldKey, b.Hash, b.Data)
+	check(err)
+
+	keyID, err := SealedKeyID(sealed)
+	check(err)
+	if keyID != KeyID(oldKey) {
+		t.Errorf("bad key ID, expected %s, got %s", KeyID(oldKey), keyID)
+	}
+	keyID, err = SealedKeyID(legacy)
+	check(err)
+	if keyID != "" {
+		t.Errorf("legacy blobs should not have a key ID, got %s", keyID)
+	}
+	for _, data := range [][]byte{legacy, sealed} {
+		phash, err := PlainTextHash(data[:HeaderLength])
+		check(err)
+		if phash != b.Hash {
+			t.Errorf("bad plain-text hash, expected %s, got %s", b.Hash, phash)
+		}
+	}
+
+	// After the rotation, the old key is still needed to open the blobs
+	keyring := NewKeyring(newKey, oldKey)
+	if keyring.CurrentKeyID() != KeyID(newKey) {
+		t.Errorf("bad current key ID %s", keyring.CurrentKeyID())
+	}
+	rotated, err := keyring.Seal(b.Hash, b.Data)
+	check(err)
+	for _, data := range [][]byte{legacy, sealed, rotated} {
+		decrypted, err := keyring.Open(data)
+		check(err)
+		if !bytes.Equal(decrypted, b.Data) {
+			t.Errorf("bad decrypted data %q", decrypted)
+		}
+	}
+
+	// Once the old key is removed, only the rotated blob can be opened
+	keyring = NewKeyring(newKey)
+	if _, err := keyring.Open(sealed); err != ErrUnknownKey {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+	if _, err := keyring.Open(legacy); err != ErrDecryptionFailed {
+		t.Errorf("expected ErrDecryptionFailed, got %v", err)
+	}
+	if _, err := keyring.Open(rotated); err != nil {
+		t.Errorf("failed to open the rotated blob: %v", err)
+	}
+}
@@ -0,0 +1,466 @@
+/*
+
+Package multidisk implements a `backend.Backend` that spreads the blobs across several disks, with replication.
+
+Every blob is stored on `replicas` disks, selected using rendezvous hashing (each disk is ranked by a hash of its path
+and the blob hash), so adding a disk only moves the blobs that now rank it first.
+
+Reads try the copies in the same order, and a copy is only returned if its hash can be verified, so a failed or
+corrupted disk is transparently skipped. `Rebalance` checks every copy and restores the missing/corrupted ones (e.g.
+after replacing a disk, or adding a new one), and removes the copies from the disks that don't hold the blob anymore
+(if the backend supports deletion).
+
+*/
+package multidisk // import "a4.io/blobstash/pkg/backend/multidisk"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+)
+
+var ErrAlreadyRunning = errors.New("rebalance already running")
+
+// DefaultReplicas is the number of copies of each blob if not configured
+const DefaultReplicas = 2
+
+// The number of refs processed at once while rebalancing
+const rebalanceBatchSize = 1000
+
+// Disk is a storage backend located on a single disk
+type Disk struct {
+	Path string
+	backend.Backend
+}
+
+// Report holds the result of a rebalance
+type Report struct {
+	Started    time.Time `json:"started"`
+	Duration   string    `json:"duration"`
+	BlobsCount int       `json:"blobs_count"`
+	Copied     int       `json:"copied_count"`
+	Removed    int       `json:"removed_count"`
+	Failed     []string  `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// MultiDisk implements the `backend.Backend` interface
+type MultiDisk struct {
+	disks    []*Disk
+	replicas int
+
+	layoutPath    string
+	layoutChanged bool
+
+	lastReport *Report
+	running    bool
+	mu         sync.Mutex
+}
+
+// New initializes the backend, the list of disks of the last complete rebalance is stored at `layoutPath`
+func New(disks []*Disk, replicas int, layoutPath string) (*MultiDisk, error) {
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("at least one disk is needed")
+	}
+	seen := map[string]bool{}
+	for _, d := range disks {
+		if seen[d.Path] {
+			return nil, fmt.Errorf("duplicate disk \"%s\"", d.Path)
+		}
+		seen[d.Path] = true
+	}
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	if replicas > len(disks) {
+		replicas = len(disks)
+	}
+	m := &MultiDisk{
+		disks:      disks,
+		replicas:   replicas,
+		layoutPath: layoutPath,
+	}
+
+	data, err := ioutil.ReadFile(layoutPath)
+	switch {
+	case err == nil:
+		var layout []string
+		if err := json.Unmarshal(data, &layout); err != nil {
+			return nil, fmt.Errorf("failed to load the disks layout: %v", err)
+		}
+		m.layoutChanged = !reflect.DeepEqual(layout, m.layout())
+	case os.IsNotExist(err):
+		// Nothing to rebalance if there's only one disk
+		m.layoutChanged = len(disks) > 1
+	default:
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *MultiDisk) String() string {
+	return fmt.Sprintf("multidisk-%d-replicas-%v", m.replicas, m.layout())
+}
+
+// layout returns the sorted disk paths
+func (m *MultiDisk) layout() []string {
+	var paths []string
+	for _, d := range m.disks {
+		paths = append(paths, d.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// LayoutChanged returns true if the disks changed since the last complete rebalance
+func (m *MultiDisk) LayoutChanged() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.layoutChanged
+}
+
+// placement returns all the disks, ordered by preference for the given blob (the first `replicas` disks should hold
+// a copy)
+func (m *MultiDisk) placement(hash string) []*Disk {
+	scores := make(map[*Disk]uint64, len(m.disks))
+	for _, d := range m.disks {
+		h := fnv.New64a()
+		h.Write([]byte(d.Path))
+		h.Write([]byte(hash))
+		scores[d] = h.Sum64()
+	}
+	disks := make([]*Disk, len(m.disks))
+	copy(disks, m.disks)
+	sort.Slice(disks, func(i, j int) bool { return scores[disks[i]] > scores[disks[j]] })
+	return disks
+}
+
+// Put saves the blob on the preferred disks, failed disks are skipped, so the blob may end up on fewer disks
+// (the missing copies will be added by the next rebalance)
+func (m *MultiDisk) Put(hash string, data []byte) error {
+	var saved int
+	var lastErr error
+	for _, d := range m.placement(hash) {
+		if err := d.Put(hash, data); err != nil {
+			lastErr = fmt.Errorf("failed to save blob %s on disk %s: %v", hash, d.Path, err)
+			continue
+		}
+		saved++
+		if saved == m.replicas {
+			break
+		}
+	}
+	if saved == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// Get returns the first healthy copy of the blob
+func (m *MultiDisk) Get(hash string) ([]byte, error) {
+	var lastErr error
+	for _, d := range m.placement(hash) {
+		data, err := d.Get(hash)
+		switch {
+		case err == clientutil.ErrBlobNotFound:
+			continue
+		case err != nil:
+			lastErr = fmt.Errorf("failed to get blob %s from disk %s: %v", hash, d.Path, err)
+			continue
+		}
+		if err := (&blob.Blob{Hash: hash, Data: data}).Check(); err != nil {
+			lastErr = fmt.Errorf("corrupted blob %s on disk %s: %v", hash, d.Path, err)
+			continue
+		}
+		return data, nil
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, clientutil.ErrBlobNotFound
+}
+
+// Exists returns true if at least one disk holds the blob
+func (m *MultiDisk) Exists(hash string) (bool, error) {
+	var lastErr error
+	for _, d := range m.placement(hash) {
+		exists, err := d.Exists(hash)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, lastErr
+}
+
+// Enumerate merges the blobs of all the disks
+func (m *MultiDisk) Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error {
+	defer close(blobs)
+	refs, err := m.enumerate(start, end, limit)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		blobs <- ref
+	}
+	return nil
+}
+
+// enumerate returns the (deduplicated) refs of all the disks, in lexicographical order
+func (m *MultiDisk) enumerate(start, end string, limit int) ([]*blob.SizedBlobRef, error) {
+	// Each disk won't contribute more than `limit` refs
+	pages := make([][]*blob.SizedBlobRef, len(m.disks))
+	for i, d := range m.disks {
+		page, err := enumerateDisk(d, start, end, limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enumerate disk %s: %v", d.Path, err)
+		}
+		pages[i] = page
+	}
+
+	var refs []*blob.SizedBlobRef
+	for limit <= 0 || len(refs) < limit {
+		// Pick the smallest ref in all the pages
+		var next *blob.SizedBlobRef
+		for _, page := range pages {
+			if len(page) > 0 && (next == nil || page[0].Hash < next.Hash) {
+				next = page[0]
+			}
+		}
+		if next == nil {
+			break
+		}
+		for i, page := range pages {
+			if len(page) > 0 && page[0].Hash == next.Hash {
+				pages[i] = page[1:]
+			}
+		}
+		refs = append(refs, next)
+	}
+	return refs, nil
+}
+
+func enumerateDisk(d *Disk, start, end string, limit int) ([]*blob.SizedBlobRef, error) {
+	out := make(chan *blob.SizedBlobRef)
+	refs := []*blob.SizedBlobRef{}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.Enumerate(out, start, end, limit)
+	}()
+	for ref := range out {
+		refs = append(refs, ref)
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// SupportsDelete returns true if every disk supports deletion (otherwise a copy could be left behind)
+func (m *MultiDisk) SupportsDelete() bool {
+	for _, d := range m.disks {
+		if !backend.SupportsDelete(d.Backend) {
+			return false
+		}
+	}
+	return true
+}
+
+// Delete removes the blob from every disk, returns `backend.ErrDeleteNotSupported` if no disk supports deletion
+func (m *MultiDisk) Delete(hash string) error {
+	var deleted bool
+	for _, d := range m.disks {
+		if err := deleteBlob(d, hash); err != nil {
+			if err == backend.ErrDeleteNotSupported {
+				continue
+			}
+			return fmt.Errorf("failed to delete blob %s from disk %s: %v", hash, d.Path, err)
+		}
+		deleted = true
+	}
+	if !deleted {
+		return backend.ErrDeleteNotSupported
+	}
+	return nil
+}
+
+func deleteBlob(d *Disk, hash string) error {
+	deleter, ok := d.Backend.(backend.Deleter)
+	if !ok {
+		return backend.ErrDeleteNotSupported
+	}
+	return deleter.Delete(hash)
+}
+
+// checkCopy returns true if the disk holds a valid copy of the blob
+func checkCopy(d *Disk, hash string) (bool, error) {
+	data, err := d.Get(hash)
+	switch {
+	case err == clientutil.ErrBlobNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return (&blob.Blob{Hash: hash, Data: data}).Check() == nil, nil
+}
+
+func (m *MultiDisk) Close() error {
+	var lastErr error
+	for _, d := range m.disks {
+		if err := d.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// LastReport returns the report of the last rebalance (nil if it never ran), and true if it's currently running
+func (m *MultiDisk) LastReport() (*Report, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastReport, m.running
+}
+
+// Rebalance ensures every blob is stored on its preferred disks, and removes the extra copies
+func (m *MultiDisk) Rebalance(ctx context.Context) (*Report, error) {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return nil, ErrAlreadyRunning
+	}
+	m.running = true
+	m.mu.Unlock()
+
+	start := time.Now()
+	report := &Report{Started: start.UTC(), Failed: []string{}}
+	err := m.rebalance(ctx, report)
+	if err != nil {
+		// Keep the partial report
+		report.Error = err.Error()
+	}
+	report.Duration = time.Since(start).String()
+
+	// Only record the layout once all the blobs have been moved
+	if err == nil && len(report.Failed) == 0 {
+		js, err := json.Marshal(m.layout())
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(m.layoutPath, js, 0644); err != nil {
+			return nil, fmt.Errorf("failed to save the disks layout: %v", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.running = false
+	m.lastReport = report
+	if report.Error == "" && len(report.Failed) == 0 {
+		m.layoutChanged = false
+	}
+	m.mu.Unlock()
+
+	if report.Error != "" {
+		return report, errors.New(report.Error)
+	}
+	return report, nil
+}
+
+func (m *MultiDisk) rebalance(ctx context.Context, report *Report) error {
+	start := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		page, err := m.enumerate(start, "\xff", rebalanceBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, ref := range page {
+			report.BlobsCount++
+			copied, removed, err := m.rebalanceBlob(ref.Hash)
+			if err != nil {
+				report.Failed = append(report.Failed, ref.Hash)
+			}
+			report.Copied += copied
+			report.Removed += removed
+		}
+		if len(page) < rebalanceBatchSize {
+			return nil
+		}
+		start = page[len(page)-1].Hash + "\x00"
+	}
+}
+
+// rebalanceBlob copies the blob to the preferred disks missing it (or holding a corrupted copy), and removes it from
+// the other disks, it fails if a copy is still corrupted (e.g. a disk that can't delete the corrupted copy, as saving an
+// existing blob is a no-op)
+func (m *MultiDisk) rebalanceBlob(hash string) (int, int, error) {
+	var copied, removed int
+	var data []byte
+	disks := m.placement(hash)
+	for _, d := range disks[:m.replicas] {
+		healthy, err := checkCopy(d, hash)
+		if err != nil {
+			return copied, removed, err
+		}
+		if healthy {
+			continue
+		}
+		if data == nil {
+			data, err = m.Get(hash)
+			if err != nil {
+				return copied, removed, err
+			}
+		}
+		// Remove the corrupted copy first if the backend supports it
+		if err := deleteBlob(d, hash); err != nil && err != backend.ErrDeleteNotSupported {
+			return copied, removed, err
+		}
+		if err := d.Put(hash, data); err != nil {
+			return copied, removed, err
+		}
+		healthy, err = checkCopy(d, hash)
+		if err != nil {
+			return copied, removed, err
+		}
+		if !healthy {
+			return copied, removed, fmt.Errorf("the copy on %s is still corrupted", d.Path)
+		}
+		copied++
+	}
+
+	// Every preferred disk holds a copy, the other copies can be removed
+	for _, d := range disks[m.replicas:] {
+		exists, err := d.Exists(hash)
+		if err != nil {
+			return copied, removed, err
+		}
+		if !exists {
+			continue
+		}
+		if err := deleteBlob(d, hash); err != nil {
+			if err == backend.ErrDeleteNotSupported {
+				continue
+			}
+			return copied, removed, err
+		}
+		removed++
+	}
+	return copied, removed, nil
+}
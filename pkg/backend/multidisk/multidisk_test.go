@@ -0,0 +1,203 @@
+package multidisk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/backend/blobsdir"
+	"a4.io/blobstash/pkg/blob"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// copies returns the number of disks holding the blob
+func copies(disks []*Disk, hash string) int {
+	var cnt int
+	for _, d := range disks {
+		exists, err := d.Exists(hash)
+		check(err)
+		if exists {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// appendOnly emulates the BlobsFile backend: it can't delete, and saving an existing blob is a no-op
+type appendOnly struct {
+	back backend.Backend
+}
+
+func (b *appendOnly) Put(hash string, data []byte) error {
+	exists, err := b.back.Exists(hash)
+	if err != nil || exists {
+		return err
+	}
+	return b.back.Put(hash, data)
+}
+
+func (b *appendOnly) Get(hash string) ([]byte, error)  { return b.back.Get(hash) }
+func (b *appendOnly) Exists(hash string) (bool, error) { return b.back.Exists(hash) }
+func (b *appendOnly) Close() error                     { return b.back.Close() }
+func (b *appendOnly) Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error {
+	return b.back.Enumerate(blobs, start, end, limit)
+}
+
+func TestBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multidisk_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	newDisk := func(name string) *Disk {
+		path := filepath.Join(dir, name)
+		back, err := blobsdir.New(path)
+		check(err)
+		return &Disk{Path: path, Backend: back}
+	}
+	layoutPath := filepath.Join(dir, "layout.json")
+	disks := []*Disk{newDisk("disk1"), newDisk("disk2"), newDisk("disk3")}
+	m, err := New(disks, 2, layoutPath)
+	check(err)
+	if !m.LayoutChanged() {
+		t.Errorf("the layout of a new multidisk should be marked as changed")
+	}
+
+	blobs := []*blob.Blob{}
+	for i := 0; i < 20; i++ {
+		b := blob.New([]byte(fmt.Sprintf("blob %d", i)))
+		check(m.Put(b.Hash, b.Data))
+		blobs = append(blobs, b)
+	}
+	for _, b := range blobs {
+		if n := copies(disks, b.Hash); n != 2 {
+			t.Errorf("blob %s should be stored on 2 disks, got %d", b.Hash, n)
+		}
+	}
+	refs, err := m.enumerate("", "\xff", 0)
+	check(err)
+	if len(refs) != len(blobs) {
+		t.Errorf("expected %d refs, got %d", len(blobs), len(refs))
+	}
+	for i := 1; i < len(refs); i++ {
+		if refs[i-1].Hash >= refs[i].Hash {
+			t.Errorf("refs are not sorted")
+		}
+	}
+
+	// Lose a disk, every blob is still readable
+	check(os.RemoveAll(disks[0].Path))
+	disks[0] = newDisk("disk1")
+	m, err = New(disks, 2, layoutPath)
+	check(err)
+	for _, b := range blobs {
+		data, err := m.Get(b.Hash)
+		check(err)
+		if !bytes.Equal(data, b.Data) {
+			t.Errorf("bad blob content for %s", b.Hash)
+		}
+	}
+
+	// A corrupted copy is skipped (the placement depends on the disks path, pick a blob with a copy left on each of
+	// its preferred disks)
+	var target *blob.Blob
+	for _, b := range blobs {
+		if copies(disks, b.Hash) == 2 {
+			target = b
+			break
+		}
+	}
+	if target == nil {
+		t.Fatalf("no blob left with 2 copies")
+	}
+	corrupted := m.placement(target.Hash)[0]
+	check(corrupted.Put(target.Hash, []byte("corrupted")))
+	data, err := m.Get(target.Hash)
+	check(err)
+	if !bytes.Equal(data, target.Data) {
+		t.Errorf("the corrupted copy should have been skipped")
+	}
+
+	// Add a disk, and restore the missing copies
+	disks = append(disks, newDisk("disk4"))
+	m, err = New(disks, 2, layoutPath)
+	check(err)
+	if !m.LayoutChanged() {
+		t.Errorf("the layout should be marked as changed")
+	}
+	report, err := m.Rebalance(context.Background())
+	check(err)
+	if report.BlobsCount != len(blobs) || report.Copied == 0 || report.Removed == 0 || len(report.Failed) != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	for _, b := range blobs {
+		if n := copies(disks, b.Hash); n != 2 {
+			t.Errorf("blob %s should be stored on 2 disks, got %d", b.Hash, n)
+		}
+		for _, d := range m.placement(b.Hash)[:2] {
+			exists, err := d.Exists(b.Hash)
+			check(err)
+			if !exists {
+				t.Errorf("blob %s should be stored on disk %s", b.Hash, d.Path)
+			}
+		}
+	}
+	// The corrupted copy has been repaired
+	healthy, err := checkCopy(corrupted, target.Hash)
+	check(err)
+	if !healthy {
+		t.Errorf("the corrupted copy should have been repaired")
+	}
+	m, err = New(disks, 2, layoutPath)
+	check(err)
+	if m.LayoutChanged() {
+		t.Errorf("the layout should have been saved")
+	}
+}
+
+func TestRebalanceAppendOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multidisk_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	var backs []*blobsdir.BlobsDirBackend
+	var disks []*Disk
+	for _, name := range []string{"disk1", "disk2"} {
+		path := filepath.Join(dir, name)
+		back, err := blobsdir.New(path)
+		check(err)
+		backs = append(backs, back)
+		disks = append(disks, &Disk{Path: path, Backend: &appendOnly{back}})
+	}
+	m, err := New(disks, 2, filepath.Join(dir, "layout.json"))
+	check(err)
+
+	corrupted := blob.New([]byte("corrupted"))
+	check(m.Put(corrupted.Hash, corrupted.Data))
+	check(backs[0].Put(corrupted.Hash, []byte("bit-rot")))
+	missing := blob.New([]byte("missing"))
+	check(m.Put(missing.Hash, missing.Data))
+	check(backs[1].Delete(missing.Hash))
+
+	// The missing copy is restored, but the corrupted copy can't be replaced
+	report, err := m.Rebalance(context.Background())
+	check(err)
+	if report.Copied != 1 || len(report.Failed) != 1 || report.Failed[0] != corrupted.Hash {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if healthy, err := checkCopy(disks[1], missing.Hash); err != nil || !healthy {
+		t.Errorf("the missing copy should have been restored (err=%v)", err)
+	}
+	if !m.LayoutChanged() {
+		t.Errorf("the layout should not be saved after a failure")
+	}
+}
@@ -0,0 +1,127 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/httputil"
+)
+
+func (b *S3Backend) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/status", basicAuth(http.HandlerFunc(b.statusHandler())))
+	r.Handle("/_pause", basicAuth(http.HandlerFunc(b.pauseHandler())))
+	r.Handle("/_resume", basicAuth(http.HandlerFunc(b.resumeHandler())))
+	r.Handle("/_flush", basicAuth(http.HandlerFunc(b.flushHandler())))
+	r.Handle("/_rotate", basicAuth(http.HandlerFunc(b.rotateHandler())))
+	r.Handle("/_restore", basicAuth(http.HandlerFunc(b.restoreHandler())))
+}
+
+func (b *S3Backend) statusHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			status, err := b.Status()
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, status)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (b *S3Backend) pauseHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			b.Pause()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (b *S3Backend) resumeHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			b.Resume()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (b *S3Backend) flushHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if err := b.Flush(); err != nil {
+				httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+				return
+			}
+			// The queues are processed in the background, the progress is available in the status
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (b *S3Backend) rotateHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if !b.encrypted {
+				httputil.WriteJSONError(w, http.StatusBadRequest, ErrNotEncrypted.Error())
+				return
+			}
+			if st := b.RotationStatus(); st != nil && st.Running {
+				httputil.WriteJSONError(w, http.StatusConflict, ErrRotationRunning.Error())
+				return
+			}
+			// Every object has to be re-uploaded, the progress is available in the status
+			go func() {
+				if err := b.Rotate(context.Background()); err != nil {
+					b.log.Error("key rotation failed", "err", err)
+				}
+			}()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (b *S3Backend) restoreHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			q := httputil.NewQuery(r.URL.Query())
+			workers, err := q.GetInt("workers", defaultRestoreWorkers, 64)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			if st := b.RestoreStatus(); st != nil && st.Running {
+				httputil.WriteJSONError(w, http.StatusConflict, ErrRestoreRunning.Error())
+				return
+			}
+			// The whole bucket is listed, the progress is available in the status
+			go func() {
+				if err := b.Restore(context.Background(), workers); err != nil {
+					b.log.Error("restore failed", "err", err)
+				}
+			}()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package index // import "a4.io/blobstash/pkg/backend/s3/index"
 
 import (
 	"encoding/hex"
+	"io"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/cznic/kv"
@@ -53,6 +55,157 @@ func (i *Index) Index(hash string) error {
 	return i.db.Set(bhash, []byte{1})
 }
 
+// Entry is an indexed object
+type Entry struct {
+	Hash  string // Plain-text hash
+	Key   string // S3 object key
+	KeyID string // ID of the encryption key
+}
+
+// IndexKey indexes the plain-text hash along with the S3 object key
+func (i *Index) IndexKey(hash, key string) error {
+	return i.IndexObject(hash, key, "")
+}
+
+// IndexObject indexes the plain-text hash along with the S3 object key and the ID of the key used to encrypt it
+func (i *Index) IndexObject(hash, key, keyID string) error {
+	i.Lock()
+	defer i.Unlock()
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	v := key
+	if keyID != "" {
+		v = key + "/" + keyID
+	}
+	return i.db.Set(bhash, []byte(v))
+}
+
+// Key returns the S3 object key for the given plain-text hash, returns an empty string if the key is not known
+func (i *Index) Key(hash string) (string, error) {
+	key, _, err := i.Object(hash)
+	return key, err
+}
+
+// Object returns the S3 object key and the encryption key ID for the given plain-text hash, empty strings are
+// returned if they are not known
+func (i *Index) Object(hash string) (string, string, error) {
+	i.Lock()
+	defer i.Unlock()
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", "", err
+	}
+	v, err := i.db.Get(nil, bhash)
+	if err != nil {
+		return "", "", err
+	}
+	e := decodeEntry(v)
+	return e.Key, e.KeyID, nil
+}
+
+func decodeEntry(v []byte) *Entry {
+	// Hashes indexed with `Index` don't have a key
+	if len(v) <= 1 {
+		return &Entry{}
+	}
+	parts := strings.SplitN(string(v), "/", 2)
+	e := &Entry{Key: parts[0]}
+	if len(parts) == 2 {
+		e.KeyID = parts[1]
+	}
+	return e
+}
+
+// List returns at most `limit` entries starting at the `start` hash, and the hash to start the next batch from (an
+// empty string when there's no more entries)
+func (i *Index) List(start string, limit int) ([]*Entry, string, error) {
+	i.Lock()
+	defer i.Unlock()
+	bstart, err := hex.DecodeString(start)
+	if err != nil {
+		return nil, "", err
+	}
+	enum, _, err := i.db.Seek(bstart)
+	if err != nil {
+		return nil, "", err
+	}
+	var out []*Entry
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF {
+			return out, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if len(out) == limit {
+			return out, hex.EncodeToString(k), nil
+		}
+		e := decodeEntry(v)
+		e.Hash = hex.EncodeToString(k)
+		out = append(out, e)
+	}
+}
+
+// Legacy returns true if some hashes have been indexed without the S3 object key (using `Index`)
+func (i *Index) Legacy() (bool, error) {
+	hashes, err := i.legacy(1)
+	return len(hashes) > 0, err
+}
+
+// DeleteLegacy removes the hashes indexed without the S3 object key, returns the number of removed hashes
+func (i *Index) DeleteLegacy() (int, error) {
+	hashes, err := i.legacy(-1)
+	if err != nil {
+		return 0, err
+	}
+	i.Lock()
+	defer i.Unlock()
+	for _, bhash := range hashes {
+		if err := i.db.Delete(bhash); err != nil {
+			return 0, err
+		}
+	}
+	return len(hashes), nil
+}
+
+// legacy returns at most `limit` hashes (all of them if < 0) indexed without the S3 object key
+func (i *Index) legacy(limit int) ([][]byte, error) {
+	i.Lock()
+	defer i.Unlock()
+	enum, _, err := i.db.Seek([]byte{})
+	if err != nil {
+		return nil, err
+	}
+	var out [][]byte
+	for limit < 0 || len(out) < limit {
+		k, v, err := enum.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if decodeEntry(v).Key == "" {
+			out = append(out, append([]byte{}, k...))
+		}
+	}
+	return out, nil
+}
+
+// Delete removes the hash from the index
+func (i *Index) Delete(hash string) error {
+	i.Lock()
+	defer i.Unlock()
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	return i.db.Delete(bhash)
+}
+
 func (i *Index) Exists(hash string) (bool, error) {
 	i.Lock()
 	defer i.Unlock()
@@ -33,4 +33,57 @@ func TestIndex(t *testing.T) {
 	if ok2 {
 		t.Errorf("h \"%s\" should not exists", h2)
 	}
+	check(i.IndexKey(h2, "key2"))
+	key, err := i.Key(h2)
+	check(err)
+	if key != "key2" {
+		t.Errorf("h2 key should be \"key2\", got \"%s\"", key)
+	}
+	key, err = i.Key(h)
+	check(err)
+	if key != "" {
+		t.Errorf("h key should be empty, got \"%s\"", key)
+	}
+	check(i.IndexObject(h2, "key3", "abcd"))
+	key, keyID, err := i.Object(h2)
+	check(err)
+	if key != "key3" || keyID != "abcd" {
+		t.Errorf("h2 object should be (\"key3\", \"abcd\"), got (\"%s\", \"%s\")", key, keyID)
+	}
+	entries, next, err := i.List("", 1)
+	check(err)
+	if len(entries) != 1 || entries[0].Hash != h || next != h2 {
+		t.Errorf("unexpected first batch %+v (next=%s)", entries, next)
+	}
+	entries, next, err = i.List(next, 1)
+	check(err)
+	if len(entries) != 1 || entries[0].Hash != h2 || entries[0].Key != "key3" || entries[0].KeyID != "abcd" || next != "" {
+		t.Errorf("unexpected second batch %+v (next=%s)", entries, next)
+	}
+	legacy, err := i.Legacy()
+	check(err)
+	if !legacy {
+		t.Errorf("h \"%s\" was indexed without a key", h)
+	}
+	n, err := i.DeleteLegacy()
+	check(err)
+	if n != 1 {
+		t.Errorf("expected 1 legacy entry to be removed, got %d", n)
+	}
+	ok, err = i.Exists(h)
+	check(err)
+	if ok {
+		t.Errorf("h \"%s\" should not exists after the legacy entries removal", h)
+	}
+	legacy, err = i.Legacy()
+	check(err)
+	if legacy {
+		t.Errorf("no legacy entries should be left")
+	}
+	check(i.Delete(h2))
+	ok2, err = i.Exists(h2)
+	check(err)
+	if ok2 {
+		t.Errorf("h \"%s\" should not exists after delete", h2)
+	}
 }
@@ -0,0 +1,336 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/backend/s3/index"
+	"a4.io/blobstash/pkg/blob"
+)
+
+// ErrRestoreRunning is returned when a restore is already running
+var ErrRestoreRunning = errors.New("restore already running")
+
+// Number of objects downloaded in parallel by default
+const defaultRestoreWorkers = 8
+
+// RestoreStatus holds the progress of the restore
+type RestoreStatus struct {
+	Running       bool      `json:"running"`
+	Resumed       bool      `json:"resumed"`
+	Workers       int       `json:"workers"`
+	Started       time.Time `json:"started"`
+	Duration      string    `json:"duration,omitempty"`
+	Marker        string    `json:"marker"`
+	Objects       int       `json:"objects_count"`
+	Restored      int       `json:"restored_count"`
+	RestoredBytes int64     `json:"restored_bytes"`
+	Skipped       int       `json:"skipped_count"`
+	Failed        int       `json:"failed_count"`
+	Errors        []string  `json:"errors"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// restoreState is persisted after each batch so an interrupted restore can be resumed, the keys of the objects that
+// failed are kept until they are restored (the marker moves past them)
+type restoreState struct {
+	Marker string   `json:"marker"`
+	Failed []string `json:"failed,omitempty"`
+}
+
+// restore tracks the current/last restore
+type restore struct {
+	status *RestoreStatus
+	cancel func()
+	mu     sync.Mutex
+}
+
+// RestoreStatus returns the status of the current (or last) restore, or nil if no restore has been started
+func (b *S3Backend) RestoreStatus() *RestoreStatus {
+	b.restore.mu.Lock()
+	defer b.restore.mu.Unlock()
+	if b.restore.status == nil {
+		return nil
+	}
+	st := *b.restore.status
+	st.Errors = append([]string{}, st.Errors...)
+	return &st
+}
+
+// Restore downloads the blobs missing locally from the bucket, using `workers` parallel downloads.
+//
+// The bucket is listed in batches, and the position in the listing is saved after each batch, an interrupted restore
+// will start again from the last batch. The objects that failed are retried first by the next restore. The blobs
+// deleted locally (that have a tombstone) are skipped, even if they are still in the bucket.
+func (b *S3Backend) Restore(ctx context.Context, workers int) error {
+	if workers <= 0 {
+		workers = defaultRestoreWorkers
+	}
+	b.restore.mu.Lock()
+	if b.restore.status != nil && b.restore.status.Running {
+		b.restore.mu.Unlock()
+		return ErrRestoreRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	st := &RestoreStatus{Running: true, Workers: workers, Started: start.UTC(), Errors: []string{}}
+	b.restore.status = st
+	b.restore.cancel = cancel
+	b.restore.mu.Unlock()
+
+	err := b.doRestore(ctx, workers)
+
+	b.restore.mu.Lock()
+	defer b.restore.mu.Unlock()
+	st.Running = false
+	st.Duration = time.Since(start).String()
+	b.restore.cancel = nil
+	if err != nil {
+		st.Error = err.Error()
+	}
+	b.log.Info("restore done", "objects", st.Objects, "restored", st.Restored, "skipped", st.Skipped, "failed", st.Failed, "duration", st.Duration, "err", err)
+	return err
+}
+
+func (b *S3Backend) doRestore(ctx context.Context, workers int) error {
+	// Resume the previous restore if needed
+	state := &restoreState{}
+	data, err := ioutil.ReadFile(b.restorePath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, state); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+	default:
+		return err
+	}
+	b.restore.mu.Lock()
+	b.restore.status.Marker = state.Marker
+	b.restore.status.Resumed = state.Marker != "" || len(state.Failed) > 0
+	b.restore.mu.Unlock()
+	b.log.Info("starting restore", "marker", state.Marker, "failed", len(state.Failed), "workers", workers)
+
+	// The object keys of encrypted blobs are the hash of the ciphertext, use the index to avoid reading the header of
+	// the objects already known
+	known := map[string]*index.Entry{}
+	var start string
+	for {
+		entries, next, err := b.index.List(start, 1000)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Key != "" {
+				known[e.Key] = e
+			}
+		}
+		if next == "" {
+			break
+		}
+		start = next
+	}
+
+	sem := make(chan struct{}, workers)
+
+	// Retry the objects that failed during the previous restore
+	if len(state.Failed) > 0 {
+		var objects []*Object
+		for _, key := range state.Failed {
+			objects = append(objects, &Object{s3: b.s3, Bucket: b.bucket, Key: key})
+		}
+		state.Failed = b.restoreBatch(ctx, sem, objects, known, true)
+		if err := b.saveRestoreState(state); err != nil {
+			return err
+		}
+	}
+
+	bucket := NewBucket(b.s3, b.bucket)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		objects, err := bucket.List(state.Marker, 100)
+		if err != nil {
+			return err
+		}
+		if len(objects) == 0 {
+			break
+		}
+
+		failed := b.restoreBatch(ctx, sem, objects, known, false)
+
+		// Save the progress
+		state.Marker = nextKey(objects[len(objects)-1].Key)
+		state.Failed = append(state.Failed, failed...)
+		if err := b.saveRestoreState(state); err != nil {
+			return err
+		}
+		b.restore.mu.Lock()
+		b.restore.status.Marker = state.Marker
+		b.log.Info("restore in progress", "objects", b.restore.status.Objects, "restored", b.restore.status.Restored)
+		b.restore.mu.Unlock()
+	}
+
+	// The objects that failed will be retried by the next restore
+	if len(state.Failed) > 0 {
+		state.Marker = ""
+		return b.saveRestoreState(state)
+	}
+
+	// The restore is complete, the next one will start from the beginning
+	if err := os.Remove(b.restorePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// restoreBatch restores the objects in parallel (`sem` limits the number of workers), and returns the keys of the
+// objects that failed
+func (b *S3Backend) restoreBatch(ctx context.Context, sem chan struct{}, objects []*Object, known map[string]*index.Entry, retry bool) []string {
+	var failed []string
+	var wg sync.WaitGroup
+	for _, object := range objects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(object *Object) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			hash, size, err := b.restoreObject(ctx, object, known[object.Key], retry)
+			b.restore.mu.Lock()
+			defer b.restore.mu.Unlock()
+			st := b.restore.status
+			st.Objects++
+			switch {
+			case err != nil && retry && isNotFound(err):
+				// The object has been removed from the bucket since
+				st.Skipped++
+			case err != nil:
+				b.log.Error("failed to restore blob", "key", object.Key, "err", err)
+				st.Failed++
+				st.Errors = appendError(st.Errors, object.Key, err)
+				failed = append(failed, object.Key)
+			case size == -1:
+				st.Skipped++
+			default:
+				b.log.Debug("blob restored", "hash", hash)
+				st.Restored++
+				st.RestoredBytes += int64(size)
+			}
+		}(object)
+	}
+	wg.Wait()
+	sort.Strings(failed)
+	return failed
+}
+
+// saveRestoreState persists the restore progress
+func (b *S3Backend) saveRestoreState(state *restoreState) error {
+	js, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.restorePath, js, 0644)
+}
+
+// restoreObject downloads the blob if it's missing locally, returns the plain-text hash and the size of the blob, or
+// -1 if the blob was skipped (already present, or deleted). When retrying a failed object, the blob may have been
+// saved before the failure, the hub event is triggered again in this case.
+func (b *S3Backend) restoreObject(ctx context.Context, object *Object, e *index.Entry, retry bool) (string, int, error) {
+	b.wg.Add(1)
+	defer b.wg.Done()
+
+	hash := object.Key
+	eblob := NewEncryptedBlob(object, b.keyring)
+	var keyID string
+	if b.encrypted {
+		if e != nil {
+			hash = e.Hash
+		} else {
+			var err error
+			hash, keyID, err = eblob.Header()
+			if err != nil {
+				return "", 0, err
+			}
+		}
+	}
+
+	// Never bring back a deleted blob (its removal from the bucket may still be queued, or may have failed)
+	deleted, err := b.deleted(hash)
+	if err != nil {
+		return "", 0, err
+	}
+	if deleted {
+		b.log.Debug("skipping deleted blob", "hash", hash)
+		return hash, -1, nil
+	}
+
+	if e == nil {
+		if err := b.index.IndexObject(hash, object.Key, keyID); err != nil {
+			return "", 0, err
+		}
+	}
+
+	exists, err := b.backend.Exists(hash)
+	if err != nil {
+		return "", 0, err
+	}
+	if exists && !retry {
+		return hash, -1, nil
+	}
+
+	var data []byte
+	switch {
+	case exists:
+		data, err = b.backend.Get(hash)
+	case b.encrypted:
+		data, err = eblob.PlainText()
+	default:
+		r, rerr := object.Reader()
+		if rerr != nil {
+			return "", 0, rerr
+		}
+		defer r.Close()
+		data, err = ioutil.ReadAll(r)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	blb := &blob.Blob{Hash: hash, Data: data}
+	if err := blb.Check(); err != nil {
+		return "", 0, err
+	}
+
+	// Here we interact with the storage backend directly, which is quite dangerous
+	// (the hub event is crucial here to behave like the BlobStore)
+	if !exists {
+		if err := b.backend.Put(hash, data); err != nil {
+			return "", 0, err
+		}
+	}
+
+	// Wait for subscribed event completion
+	if err := b.hub.NewBlobEvent(ctx, blb, nil); err != nil {
+		return "", 0, err
+	}
+
+	return hash, len(data), nil
+}
+
+// deleted returns true if the blob has a tombstone
+func (b *S3Backend) deleted(hash string) (bool, error) {
+	if b.tombstones == nil {
+		return false, nil
+	}
+	_, deleted, err := b.tombstones.Deleted(hash)
+	return deleted, err
+}
@@ -0,0 +1,211 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"a4.io/blobstash/pkg/backend/encrypted"
+	"a4.io/blobstash/pkg/backend/s3/index"
+	"a4.io/blobstash/pkg/blob"
+)
+
+var (
+	// ErrNotEncrypted is returned when trying to rotate the key of a non-encrypted replication
+	ErrNotEncrypted = errors.New("s3 replication is not encrypted")
+
+	// ErrRotationRunning is returned when a key rotation is already running
+	ErrRotationRunning = errors.New("key rotation already running")
+)
+
+// Max number of errors kept in the rotation/restore status
+const maxJobErrors = 20
+
+// RotationStatus holds the progress of the key rotation (the re-encryption of the objects sealed with an old key)
+type RotationStatus struct {
+	Running  bool      `json:"running"`
+	KeyID    string    `json:"key_id"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration,omitempty"`
+	Checked  int       `json:"checked_count"`
+	Rotated  int       `json:"rotated_count"`
+	Failed   int       `json:"failed_count"`
+	Errors   []string  `json:"errors"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// rotation tracks the current/last key rotation
+type rotation struct {
+	status *RotationStatus
+	cancel func()
+	mu     sync.Mutex
+}
+
+// RotationStatus returns the status of the current (or last) key rotation, or nil if the keys were never rotated
+func (b *S3Backend) RotationStatus() *RotationStatus {
+	b.rotation.mu.Lock()
+	defer b.rotation.mu.Unlock()
+	if b.rotation.status == nil {
+		return nil
+	}
+	st := *b.rotation.status
+	st.Errors = append([]string{}, st.Errors...)
+	return &st
+}
+
+// Rotate re-encrypts all the objects sealed with an old key (or before the key IDs were introduced) using the current
+// key, and updates the index.
+//
+// The new object is uploaded before the old one is removed, and the index keeps track of the key used for each
+// object, so the rotation can be resumed if it is interrupted. The bucket is re-indexed first if the index contains
+// legacy entries (without the object key).
+func (b *S3Backend) Rotate(ctx context.Context) error {
+	if !b.encrypted {
+		return ErrNotEncrypted
+	}
+	b.rotation.mu.Lock()
+	if b.rotation.status != nil && b.rotation.status.Running {
+		b.rotation.mu.Unlock()
+		return ErrRotationRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	b.rotation.status = &RotationStatus{Running: true, KeyID: b.keyring.CurrentKeyID(), Started: start.UTC(), Errors: []string{}}
+	b.rotation.cancel = cancel
+	b.rotation.mu.Unlock()
+
+	b.log.Info("starting key rotation", "key_id", b.keyring.CurrentKeyID())
+	err := b.rotate(ctx)
+
+	b.rotation.mu.Lock()
+	defer b.rotation.mu.Unlock()
+	st := b.rotation.status
+	st.Running = false
+	st.Duration = time.Since(start).String()
+	b.rotation.cancel = nil
+	if err != nil {
+		st.Error = err.Error()
+	}
+	b.log.Info("key rotation done", "checked", st.Checked, "rotated", st.Rotated, "failed", st.Failed, "duration", st.Duration, "err", err)
+	return err
+}
+
+func (b *S3Backend) rotate(ctx context.Context) error {
+	// The rotation is driven by the index, make sure every entry has its object key
+	if err := b.migrateIndex(); err != nil {
+		return err
+	}
+
+	currentKeyID := b.keyring.CurrentKeyID()
+	var start string
+	for {
+		entries, next, err := b.index.List(start, 100)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if e.KeyID != currentKeyID {
+				if err := b.rotateObject(e); err != nil {
+					b.log.Error("failed to rotate the key", "hash", e.Hash, "err", err)
+					b.rotationFailed(e.Hash, err)
+				} else {
+					b.rotation.mu.Lock()
+					b.rotation.status.Rotated++
+					b.rotation.mu.Unlock()
+				}
+			}
+			b.rotation.mu.Lock()
+			b.rotation.status.Checked++
+			b.rotation.mu.Unlock()
+		}
+		if next == "" {
+			return nil
+		}
+		start = next
+	}
+}
+
+func (b *S3Backend) rotationFailed(hash string, err error) {
+	b.rotation.mu.Lock()
+	defer b.rotation.mu.Unlock()
+	st := b.rotation.status
+	st.Failed++
+	st.Errors = appendError(st.Errors, hash, err)
+}
+
+// rotateObject uploads the blob sealed with the current key, and removes the old object
+func (b *S3Backend) rotateObject(e *index.Entry) error {
+	b.wg.Add(1)
+	defer b.wg.Done()
+
+	key := e.Key
+	if key == "" {
+		return fmt.Errorf("object key not indexed")
+	}
+
+	r, err := (&Object{s3: b.s3, Bucket: b.bucket, Key: key}).Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	keyID, err := encrypted.SealedKeyID(sealed)
+	if err != nil {
+		return err
+	}
+	if keyID == b.keyring.CurrentKeyID() {
+		// The object was already rotated, only the index is outdated
+		return b.index.IndexObject(e.Hash, key, keyID)
+	}
+
+	data, err := b.keyring.Open(sealed)
+	if err != nil {
+		return err
+	}
+	if err := (&blob.Blob{Hash: e.Hash, Data: data}).Check(); err != nil {
+		return err
+	}
+
+	// Upload the re-encrypted blob (this will update the index)
+	if err := b.put(e.Hash, data); err != nil {
+		return err
+	}
+
+	// The object key is the hash of the encrypted blob, the new nonce always gives a new key
+	newKey, err := b.index.Key(e.Hash)
+	if err != nil {
+		return err
+	}
+	if newKey != key {
+		if _, err := b.s3.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendError adds the error to the list, only the last `maxJobErrors` errors are kept
+func appendError(errs []string, hash string, err error) []string {
+	errs = append(errs, fmt.Sprintf("%s: %v", hash, err))
+	if len(errs) > maxJobErrors {
+		errs = errs[len(errs)-maxJobErrors:]
+	}
+	return errs
+}
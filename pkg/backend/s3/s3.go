@@ -9,12 +9,13 @@ package s3 // import "a4.io/blobstash/pkg/backend/s3"
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
@@ -22,39 +23,23 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	log "github.com/inconshreveable/log15"
 
-	"golang.org/x/crypto/nacl/secretbox"
-
-	"a4.io/blobsfile"
-
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/backend/encrypted"
 	"a4.io/blobstash/pkg/backend/s3/index"
 	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore/tombstone"
+	"a4.io/blobstash/pkg/client/clientutil"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/queue"
 )
 
-var ErrWriteOnly = errors.New("backend is in read-only mode")
-
-// The length of the nonce used for the secretbox implementation.
-const nonceLength = 24
-
-// The length of the encryption key for the secretbox implementation.
-const keyLength = 32
-
-// Set a flag to identify the encryption algorithm in case we support/switch encryption scheme later
-const (
-	naclSecretBox byte = 1 << iota
-)
-
-var (
-	blobHeader = []byte("#blobstash/secretbox\n")
-)
-
 type Bucket struct {
 	s3   *s3.S3
 	Name string
@@ -171,30 +156,26 @@ func (o *Object) reader(size int64) (io.ReadCloser, error) {
 }
 
 type EncryptedBlob struct {
-	o   *Object
-	key *[32]byte
+	o       *Object
+	keyring *encrypted.Keyring
 }
 
-func NewEncryptedBlob(o *Object, key *[32]byte) *EncryptedBlob {
-	return &EncryptedBlob{o: o, key: key}
+func NewEncryptedBlob(o *Object, keyring *encrypted.Keyring) *EncryptedBlob {
+	return &EncryptedBlob{o: o, keyring: keyring}
 }
 
 func (b *EncryptedBlob) PlainText() ([]byte, error) {
 	r, err := b.o.Reader()
-	defer r.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer r.Close()
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
-	if !bytes.Equal(blobHeader, data[0:21]) {
-		return nil, fmt.Errorf("missing header (\"%s\")", data[0:21])
-	}
-
-	decoded, err := open(b.key, data)
+	decoded, err := b.keyring.Open(data)
 	if err != nil {
 		return nil, err
 	}
@@ -203,102 +184,97 @@ func (b *EncryptedBlob) PlainText() ([]byte, error) {
 }
 
 func (b *EncryptedBlob) PlainTextHash() (string, error) {
-	r, err := b.o.Peeker(53)
-	defer r.Close()
+	hash, _, err := b.Header()
+	return hash, err
+}
+
+// Header returns the plain-text hash and the ID of the key used to seal the blob (empty for legacy blobs)
+func (b *EncryptedBlob) Header() (string, string, error) {
+	r, err := b.o.Peeker(int64(encrypted.HeaderLength))
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
+	defer r.Close()
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		return "", err
-	}
-
-	if !bytes.Equal(blobHeader, data[0:21]) {
-		return "", fmt.Errorf("missing header (\"%s\")", data[0:21])
+		return "", "", err
 	}
 
-	return hex.EncodeToString(data[21:53]), nil
-}
-
-// Seal the data with the key derived from `password` (using scrypt) and seal the data with nacl/secretbox
-func seal(nkey *[32]byte, hash string, data []byte) ([]byte, error) {
-	nonce := new([nonceLength]byte)
-	if _, err := rand.Reader.Read(nonce[:]); err != nil {
-		return nil, err
-	}
-	bhash, err := hex.DecodeString(hash)
+	hash, err := encrypted.PlainTextHash(data)
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
-	// Box will contains our meta data (alg byte + salt + nonce)
-	box := make([]byte, nonceLength+len(blobHeader)+len(bhash))
-	copy(box[:], blobHeader)
-	copy(box[len(blobHeader):], bhash)
-	// And the nonce
-	copy(box[len(blobHeader)+len(bhash):], nonce[:])
-	return secretbox.Seal(box, data, nonce, nkey), nil
-}
-
-// Open a previously sealed secretbox with the key derived from `password` (using scrypt)
-func open(nkey *[32]byte, data []byte) ([]byte, error) {
-	// Extract the nonce
-	nonce := new([nonceLength]byte)
-	copy(nonce[:], data[len(blobHeader)+32:(len(blobHeader)+32+nonceLength)])
-	box := data[(nonceLength + 32 + len(blobHeader)):]
-	// Actually decrypt the cipher text
-	decrypted, success := secretbox.Open(nil, box, nonce, nkey)
-
-	// Ensure the decryption succeed
-	if !success {
-		return nil, errors.New("failed to decrypt file (bad password?)")
+	keyID, err := encrypted.SealedKeyID(data)
+	if err != nil {
+		return "", "", err
 	}
-
-	return decrypted, nil
+	return hash, keyID, nil
 }
 
 type S3Backend struct {
 	log log.Logger
 
-	queue *queue.Queue
-	index *index.Index
+	queue       *queue.Queue
+	deleteQueue *queue.Queue
+	index       *index.Index
 
 	encrypted bool
-	key       *[32]byte
+	keyring   *encrypted.Keyring
 
-	backend *blobsfile.BlobsFiles
-	hub     *hub.Hub
+	backend    backend.Backend
+	hub        *hub.Hub
+	tombstones *tombstone.Tombstones
 
 	wg sync.WaitGroup
 
-	s3   *s3.S3
-	stop chan struct{}
+	s3    *s3.S3
+	stop  chan struct{}
+	flush chan struct{}
+
+	status   status
+	rotation rotation
+
+	restore     restore
+	restorePath string
 
 	bucket string
 }
 
-func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config.Config) (*S3Backend, error) {
+// New initializes the S3 replication, the tombstones are used to skip the deleted blobs when restoring
+func New(logger log.Logger, back backend.Backend, h *hub.Hub, tombstones *tombstone.Tombstones, conf *config.Config) (*S3Backend, error) {
 	// Parse config
 	bucket := conf.S3Repl.Bucket
-	region := conf.S3Repl.Region
 	scanMode := conf.S3ScanMode
 	restoreMode := conf.S3RestoreMode
 	key, err := conf.S3Repl.Key()
 	if err != nil {
 		return nil, err
 	}
+	oldKeys, err := conf.S3Repl.OldKeys()
+	if err != nil {
+		return nil, err
+	}
 
 	// Create a S3 Session
-	sess := session.New(&aws.Config{Region: aws.String(region)})
+	awsConf, err := awsConfig(conf.S3Repl)
+	if err != nil {
+		return nil, err
+	}
+	sess := session.New(awsConf)
 
 	// Init the disk-backed queue
 	q, err := queue.New(filepath.Join(conf.VarDir(), "s3-repl.queue"))
 	if err != nil {
 		return nil, err
 	}
+	dq, err := queue.New(filepath.Join(conf.VarDir(), "s3-repl-delete.queue"))
+	if err != nil {
+		return nil, err
+	}
 
 	// Init the disk-backed index
 	indexPath := filepath.Join(conf.VarDir(), "s3-backend.index")
-	if scanMode || restoreMode {
+	if scanMode {
 		logger.Debug("trying to remove old index file")
 		os.Remove(indexPath)
 	}
@@ -308,23 +284,27 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 	}
 
 	s3backend := &S3Backend{
-		log:     logger,
-		backend: back,
-		hub:     h,
-		s3:      s3.New(sess),
-		stop:    make(chan struct{}),
-		bucket:  bucket,
-		key:     key,
-		queue:   q,
-		index:   i,
+		log:         logger,
+		backend:     back,
+		hub:         h,
+		tombstones:  tombstones,
+		s3:          s3.New(sess),
+		stop:        make(chan struct{}),
+		flush:       make(chan struct{}, 1),
+		bucket:      bucket,
+		restorePath: filepath.Join(conf.VarDir(), "s3-restore.json"),
+		queue:       q,
+		deleteQueue: dq,
+		index:       i,
 	}
 
 	// FIXME(tsileo): should encypption be optional?
 	if key != nil {
 		s3backend.encrypted = true
+		s3backend.keyring = encrypted.NewKeyring(key, oldKeys...)
 	}
 
-	logger.Info("Initializing S3 replication", "bucket", bucket, "encrypted", s3backend.encrypted, "scan_mode", scanMode, "restore_mode", restoreMode)
+	logger.Info("Initializing S3 replication", "bucket", bucket, "endpoint", conf.S3Repl.Endpoint, "encrypted", s3backend.encrypted, "scan_mode", scanMode, "restore_mode", restoreMode)
 
 	// Ensure the bucket exist
 	obucket := NewBucket(s3backend.s3, bucket)
@@ -341,9 +321,18 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 		}
 	}
 
-	// Trigger a re-indexing/full restore if requested
-	if scanMode || restoreMode {
-		if err := s3backend.reindex(obucket, restoreMode); err != nil {
+	// Trigger a re-indexing if requested (or if the index was written by a previous version)
+	if scanMode {
+		if err := s3backend.reindex(obucket); err != nil {
+			return nil, err
+		}
+	} else if err := s3backend.migrateIndex(); err != nil {
+		return nil, err
+	}
+
+	// Download the blobs missing locally if requested
+	if restoreMode {
+		if err := s3backend.Restore(context.Background(), defaultRestoreWorkers); err != nil {
 			return nil, err
 		}
 	}
@@ -354,6 +343,46 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 	return s3backend, nil
 }
 
+// awsConfig builds the AWS config, custom endpoints allow to use S3-compatible services (like MinIO)
+func awsConfig(conf *config.S3Repl) (*aws.Config, error) {
+	awsConf := &aws.Config{Region: aws.String(conf.Region)}
+	if conf.Endpoint != "" {
+		awsConf.Endpoint = aws.String(conf.Endpoint)
+	}
+	if conf.PathStyle {
+		awsConf.S3ForcePathStyle = aws.Bool(true)
+	}
+	if conf.DisableSSL {
+		awsConf.DisableSSL = aws.Bool(true)
+	}
+	if conf.AccessKeyID != "" {
+		awsConf.Credentials = credentials.NewStaticCredentials(conf.AccessKeyID, conf.SecretAccessKey, "")
+	}
+
+	if conf.CACertFile != "" || conf.InsecureSkipVerify {
+		tlsConf := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+		if conf.CACertFile != "" {
+			pem, err := ioutil.ReadFile(conf.CACertFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the CA cert file: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no valid certificate found in %s", conf.CACertFile)
+			}
+			tlsConf.RootCAs = pool
+		}
+		awsConf.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConf,
+			},
+		}
+	}
+
+	return awsConf, nil
+}
+
 func (b *S3Backend) String() string {
 	suf := ""
 	if b.encrypted {
@@ -366,6 +395,11 @@ func (b *S3Backend) Put(hash string) error {
 	return b.queue.Enqueue(&blob.Blob{Hash: hash})
 }
 
+// Delete enqueues the removal of the remote object
+func (b *S3Backend) Delete(hash string) error {
+	return b.deleteQueue.Enqueue(&blob.Blob{Hash: hash})
+}
+
 // nextKey returns the next key for lexigraphical (key = NextKey(lastkey))
 func nextKey(key string) string {
 	bkey := []byte(key)
@@ -380,7 +414,7 @@ func nextKey(key string) string {
 	return string(bkey)
 }
 
-func (b *S3Backend) reindex(bucket *Bucket, restore bool) error {
+func (b *S3Backend) reindex(bucket *Bucket) error {
 	b.log.Info("Starting S3 re-indexing")
 	start := time.Now()
 	max := 100
@@ -388,49 +422,17 @@ func (b *S3Backend) reindex(bucket *Bucket, restore bool) error {
 
 	if err := bucket.Iter(max, func(object *Object) error {
 		b.log.Debug("fetching an objects batch from S3")
-		eblob := NewEncryptedBlob(object, b.key)
-		hash, err := eblob.PlainTextHash()
+		eblob := NewEncryptedBlob(object, b.keyring)
+		hash, keyID, err := eblob.Header()
 		if err != nil {
 			return err
 		}
 		b.log.Debug("indexing plain-text hash", "hash", hash)
 
-		if err := b.index.Index(hash); err != nil {
+		if err := b.index.IndexObject(hash, object.Key, keyID); err != nil {
 			return err
 		}
-
-		if restore {
-			// Here we interact with the BlobsFile directly, which is quite dangerous
-			// (the hub event is crucial here to behave like the BlobStore)
-
-			exists, err := b.backend.Exists(hash)
-			if err != nil {
-				return err
-			}
-
-			if exists {
-				b.log.Debug("blob already saved", "hash", hash)
-				return nil
-			}
-
-			data, err := eblob.PlainText()
-			if err != nil {
-				return err
-			}
-
-			if err := b.backend.Put(hash, data); err != nil {
-				return err
-			}
-
-			// Wait for subscribed event completion
-			if err := b.hub.NewBlobEvent(context.TODO(), &blob.Blob{
-				Hash: hash,
-				Data: data,
-			}, nil); err != nil {
-				return err
-			}
-
-		}
+		cnt++
 
 		return nil
 	}); err != nil {
@@ -442,6 +444,35 @@ func (b *S3Backend) reindex(bucket *Bucket, restore bool) error {
 	return nil
 }
 
+// migrateIndex re-indexes the bucket if the index contains entries without the object key (written before the keys
+// were indexed, they were either keyed by the plain-text hash, or by the hash of the ciphertext), this requires a
+// single bucket listing and a header read per object
+func (b *S3Backend) migrateIndex() error {
+	if !b.encrypted {
+		// The object key is the hash
+		return nil
+	}
+	legacy, err := b.index.Legacy()
+	if err != nil {
+		return err
+	}
+	if !legacy {
+		return nil
+	}
+	b.log.Info("legacy index entries found")
+	if err := b.reindex(NewBucket(b.s3, b.bucket)); err != nil {
+		return err
+	}
+
+	// The entries still missing the key don't match any object
+	n, err := b.index.DeleteLegacy()
+	if err != nil {
+		return err
+	}
+	b.log.Info("legacy index entries removed", "count", n)
+	return nil
+}
+
 func (b *S3Backend) worker() {
 	b.log.Debug("starting worker")
 	t := time.NewTicker(30 * time.Second)
@@ -453,73 +484,187 @@ L:
 			break L
 		case <-t.C:
 			b.log.Debug("repl tick")
-			blb := &blob.Blob{}
-			for {
-				b.log.Debug("try to dequeue")
-				ok, deqFunc, err := b.queue.Dequeue(blb)
+			b.process()
+		case <-b.flush:
+			b.log.Debug("repl flush")
+			b.process()
+		}
+	}
+}
+
+// process empties the queues (unless the replication is paused)
+func (b *S3Backend) process() {
+	if b.status.isPaused() {
+		b.log.Debug("replication paused")
+		return
+	}
+	b.status.setRunning(true)
+	defer b.status.setRunning(false)
+	b.processPuts()
+	b.processDeletes()
+}
+
+// processPuts uploads all the blobs in the queue
+func (b *S3Backend) processPuts() {
+	blb := &blob.Blob{}
+	for !b.status.isPaused() {
+		b.log.Debug("try to dequeue")
+		ok, deqFunc, err := b.queue.Dequeue(blb)
+		if err != nil {
+			panic(err)
+		}
+		if ok {
+			if err := func(blob *blob.Blob) error {
+				t := time.Now()
+				b.wg.Add(1)
+				defer b.wg.Done()
+				data, err := b.backend.Get(blob.Hash)
 				if err != nil {
-					panic(err)
-				}
-				if ok {
-					if err := func(blob *blob.Blob) error {
-						t := time.Now()
-						b.wg.Add(1)
-						defer b.wg.Done()
-						data, err := b.backend.Get(blob.Hash)
-						if err != nil {
-							deqFunc(false)
-							return err
-						}
-						// Double check the blob does not exists
-						exists, err := b.index.Exists(blob.Hash)
-						if err != nil {
-							deqFunc(false)
-							return err
-						}
-						if exists {
-							b.log.Debug("blob already exist", "hash", blob.Hash)
-							deqFunc(true)
-							return nil
-						}
-
-						if err := b.put(blob.Hash, data); err != nil {
-							deqFunc(false)
-							return err
-						}
+					if err == clientutil.ErrBlobNotFound {
+						// The blob has been deleted since
+						b.log.Debug("blob not found", "hash", blob.Hash)
 						deqFunc(true)
-						b.log.Info("blob uploaded to s3", "hash", blob.Hash, "duration", time.Since(t))
-
 						return nil
-					}(blb); err != nil {
-						b.log.Error("failed to upload blob", "hash", blb.Hash, "err", err)
-						time.Sleep(1 * time.Second)
 					}
-					continue
+					deqFunc(false)
+					return err
+				}
+				// Double check the blob does not exists
+				exists, err := b.index.Exists(blob.Hash)
+				if err != nil {
+					deqFunc(false)
+					return err
+				}
+				if exists {
+					b.log.Debug("blob already exist", "hash", blob.Hash)
+					deqFunc(true)
+					return nil
+				}
+
+				if err := b.put(blob.Hash, data); err != nil {
+					deqFunc(false)
+					return err
 				}
-				break
+				deqFunc(true)
+				b.status.uploaded(blob.Hash, len(data))
+				b.log.Info("blob uploaded to s3", "hash", blob.Hash, "duration", time.Since(t))
+
+				return nil
+			}(blb); err != nil {
+				b.log.Error("failed to upload blob", "hash", blb.Hash, "err", err)
+				b.status.failed(blb.Hash, "upload", err)
+				time.Sleep(1 * time.Second)
+			}
+			continue
+		}
+		break
+	}
+}
+
+// processDeletes removes the objects from the bucket for all the blobs in the delete queue
+func (b *S3Backend) processDeletes() {
+	blb := &blob.Blob{}
+	for !b.status.isPaused() {
+		ok, deqFunc, err := b.deleteQueue.Dequeue(blb)
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			return
+		}
+		if err := func(blob *blob.Blob) error {
+			b.wg.Add(1)
+			defer b.wg.Done()
+			if err := b.delete(blob.Hash); err != nil {
+				deqFunc(false)
+				return err
 			}
+			deqFunc(true)
+			b.status.deleted()
+			b.log.Info("blob deleted from s3", "hash", blob.Hash)
+			return nil
+		}(blb); err != nil {
+			b.log.Error("failed to delete blob", "hash", blb.Hash, "err", err)
+			b.status.failed(blb.Hash, "delete", err)
+			time.Sleep(1 * time.Second)
 		}
 	}
 }
 
+func (b *S3Backend) delete(hash string) error {
+	key, err := b.index.Key(hash)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		key, err = b.findKey(hash)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			b.log.Debug("blob not found in the bucket", "hash", hash)
+			return b.index.Delete(hash)
+		}
+	}
+
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	}
+	if _, err := b.s3.DeleteObject(params); err != nil {
+		return err
+	}
+
+	return b.index.Delete(hash)
+}
+
+// findKey returns the object key for the plain-text hash if the key is not indexed, this requires a full bucket scan
+// if the blobs are encrypted, so it must only be called from the background jobs (never from the request path)
+func (b *S3Backend) findKey(hash string) (string, error) {
+	if !b.encrypted {
+		// The object key is the hash
+		return hash, nil
+	}
+
+	var key string
+	errFound := errors.New("found")
+	if err := NewBucket(b.s3, b.bucket).Iter(100, func(object *Object) error {
+		phash, err := NewEncryptedBlob(object, b.keyring).PlainTextHash()
+		if err != nil {
+			return err
+		}
+		if phash == hash {
+			key = object.Key
+			return errFound
+		}
+		return nil
+	}); err != nil && err != errFound {
+		return "", err
+	}
+	return key, nil
+}
+
 func (b *S3Backend) put(hash string, data []byte) error {
 	// At this point, we're sure the blob does not exist remotely
+	key := hash
+	var keyID string
 
 	// Encrypt if requested
 	if b.encrypted {
 		var err error
-		data, err = seal(b.key, hash, data)
+		data, err = b.keyring.Seal(hash, data)
 		if err != nil {
 			return err
 		}
 		// Re-compute the hash
-		hash = hashutil.Compute(data)
+		key = hashutil.Compute(data)
+		keyID = b.keyring.CurrentKeyID()
 	}
 
 	// Prepare the upload request
 	params := &s3.PutObjectInput{
 		Bucket:   aws.String(b.bucket),
-		Key:      aws.String(hash),
+		Key:      aws.String(key),
 		Body:     bytes.NewReader(data),
 		Metadata: map[string]*string{},
 	}
@@ -529,25 +674,96 @@ func (b *S3Backend) put(hash string, data []byte) error {
 		return err
 	}
 
-	// Save the hash in the local index
-	if err := b.index.Index(hash); err != nil {
-		return nil
+	// Save the plain-text hash (along with the object key) in the local index
+	if err := b.index.IndexObject(hash, key, keyID); err != nil {
+		return err
 	}
 
 	return nil
 }
 
+// Fetch downloads the blob from the bucket (and decrypts it if needed), returns `clientutil.ErrBlobNotFound` if the
+// blob isn't in the local index (the bucket is never scanned on the request path)
+func (b *S3Backend) Fetch(hash string) ([]byte, error) {
+	key, err := b.index.Key(hash)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		exists, err := b.index.Exists(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, clientutil.ErrBlobNotFound
+		}
+		if b.encrypted {
+			// Legacy index entry without the object key, should not happen as the index is migrated at startup
+			b.log.Warn("object key not indexed", "hash", hash)
+			return nil, clientutil.ErrBlobNotFound
+		}
+		// The object key is the hash
+		key = hash
+	}
+
+	object := &Object{s3: b.s3, Bucket: b.bucket, Key: key}
+	var data []byte
+	if b.encrypted {
+		data, err = NewEncryptedBlob(object, b.keyring).PlainText()
+	} else {
+		var r io.ReadCloser
+		r, err = object.Reader()
+		if err == nil {
+			defer r.Close()
+			data, err = ioutil.ReadAll(r)
+		}
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return nil, clientutil.ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// isNotFound returns true if the error is a 404 returned by S3
+func isNotFound(err error) bool {
+	errf, ok := err.(awserr.RequestFailure)
+	return ok && errf.StatusCode() == 404
+}
+
+// Exists returns true if the blob is in the bucket (using the local index)
 func (b *S3Backend) Exists(hash string) (bool, error) {
-	return false, ErrWriteOnly
+	return b.index.Exists(hash)
 }
 
-func (b *S3Backend) Get(hash string) (data []byte, err error) {
-	return nil, ErrWriteOnly
+// Get fetches the blob from the bucket and ensures its hash match its content
+func (b *S3Backend) Get(hash string) ([]byte, error) {
+	data, err := b.Fetch(hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := (&blob.Blob{Hash: hash, Data: data}).Check(); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func (b *S3Backend) Close() {
 	b.stop <- struct{}{}
+	b.rotation.mu.Lock()
+	if b.rotation.cancel != nil {
+		b.rotation.cancel()
+	}
+	b.rotation.mu.Unlock()
+	b.restore.mu.Lock()
+	if b.restore.cancel != nil {
+		b.restore.cancel()
+	}
+	b.restore.mu.Unlock()
 	b.wg.Wait()
 	b.queue.Close()
+	b.deleteQueue.Close()
 	b.index.Close()
 }
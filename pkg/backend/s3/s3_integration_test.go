@@ -0,0 +1,461 @@
+// +build integration
+
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/backend/blobsdir"
+	"a4.io/blobstash/pkg/backend/encrypted"
+	"a4.io/blobstash/pkg/backend/s3/s3test"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore/tombstone"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+)
+
+// The integration tests run against the in-process S3 stand-in from s3test, see its doc to run them against a real
+// S3-compatible service:
+//
+//     $ go test -tags integration ./pkg/backend/s3/
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// testConfig returns a config with a random encryption key and a fresh bucket, the returned func stops the S3 stand-in
+func testConfig(t *testing.T, dir string) (*config.Config, func()) {
+	s3conf, _, closeFunc := s3test.New(t, dir)
+	return &config.Config{DataDir: filepath.Join(dir, "data"), S3Repl: s3conf}, closeFunc
+}
+
+// setup returns a temp dir, a config using it (see testConfig) and the tombstones of the deleted blobs, the returned
+// func removes them
+func setup(t *testing.T) (string, *config.Config, *tombstone.Tombstones, func()) {
+	dir, err := ioutil.TempDir("", "blobstash_s3_test")
+	check(err)
+	conf, closeFunc := testConfig(t, dir)
+	ts, err := tombstone.New(filepath.Join(dir, "tombstones"))
+	check(err)
+	return dir, conf, ts, func() {
+		ts.Close()
+		closeFunc()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestBackend(conf *config.Config, ts *tombstone.Tombstones) (*S3Backend, *blobsdir.BlobsDirBackend) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	check(os.MkdirAll(conf.VarDir(), 0700))
+	back, err := blobsdir.New(filepath.Join(conf.VarDir(), "blobs"))
+	check(err)
+	s3back, err := New(logger, back, hub.New(logger), ts, conf)
+	check(err)
+	return s3back, back
+}
+
+// replicate saves n blobs locally and uploads them to the bucket
+func replicate(t *testing.T, s3back *S3Backend, back *blobsdir.BlobsDirBackend, n int) []*blob.Blob {
+	t.Helper()
+	var blobs []*blob.Blob
+	for i := 0; i < n; i++ {
+		b := blob.New([]byte(fmt.Sprintf("blob %d", i)))
+		check(back.Put(b.Hash, b.Data))
+		check(s3back.Put(b.Hash))
+		blobs = append(blobs, b)
+	}
+	s3back.process()
+	status, err := s3back.Status()
+	check(err)
+	if status.QueueSize != 0 || status.UploadedCount != n {
+		t.Fatalf("unexpected status after the upload %+v", status)
+	}
+	return blobs
+}
+
+func TestS3Endpoint(t *testing.T) {
+	dir, conf, ts, cleanup := setup(t)
+	defer cleanup()
+
+	// A self-signed S3-compatible service
+	srv := httptest.NewTLSServer(s3test.NewServer())
+	defer srv.Close()
+	conf.S3Repl.Endpoint = srv.URL
+	conf.S3Repl.DisableSSL = false
+
+	// The certificate is rejected unless trusted
+	bucketExists := func() error {
+		awsConf, err := awsConfig(conf.S3Repl)
+		if err != nil {
+			return err
+		}
+		_, err = NewBucket(s3.New(session.New(awsConf)), conf.S3Repl.Bucket).Exists()
+		return err
+	}
+	if err := bucketExists(); err == nil {
+		t.Errorf("the self-signed certificate should not be trusted")
+	}
+	conf.S3Repl.CACertFile = filepath.Join(dir, "missing.pem")
+	if err := bucketExists(); err == nil {
+		t.Errorf("a missing CA cert file should fail")
+	}
+	conf.S3Repl.CACertFile = filepath.Join(dir, "ca.pem")
+	check(ioutil.WriteFile(conf.S3Repl.CACertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	s3back, back := newTestBackend(conf, ts)
+	defer s3back.Close()
+	blobs := replicate(t, s3back, back, 3)
+	for _, b := range blobs {
+		data, err := s3back.Fetch(b.Hash)
+		check(err)
+		if string(data) != string(b.Data) {
+			t.Errorf("bad blob %s, got %q", b.Hash, data)
+		}
+	}
+}
+
+func TestS3PauseFlush(t *testing.T) {
+	_, conf, ts, cleanup := setup(t)
+	defer cleanup()
+
+	s3back, back := newTestBackend(conf, ts)
+	defer s3back.Close()
+	var blobs []*blob.Blob
+	for i := 0; i < 10; i++ {
+		b := blob.New([]byte(fmt.Sprintf("blob %d", i)))
+		check(back.Put(b.Hash, b.Data))
+		check(s3back.Put(b.Hash))
+		blobs = append(blobs, b)
+	}
+	status, err := s3back.Status()
+	check(err)
+	if status.QueueSize != len(blobs) {
+		t.Errorf("queue size should be %d, got %d", len(blobs), status.QueueSize)
+	}
+
+	// Nothing should be uploaded while the replication is paused
+	s3back.Pause()
+	if err := s3back.Flush(); err != ErrPaused {
+		t.Errorf("flush should fail with ErrPaused, got %v", err)
+	}
+	s3back.process()
+	status, err = s3back.Status()
+	check(err)
+	if !status.Paused || status.QueueSize != len(blobs) || status.UploadedCount != 0 {
+		t.Errorf("unexpected status while paused %+v", status)
+	}
+
+	// The flush wakes up the worker
+	s3back.Resume()
+	check(s3back.Flush())
+	for i := 0; i < 100; i++ {
+		status, err = s3back.Status()
+		check(err)
+		if status.QueueSize == 0 && status.UploadedCount == len(blobs) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if status.Paused || status.QueueSize != 0 || status.UploadedCount != len(blobs) || status.UploadedBytes == 0 ||
+		status.LastUpload == nil || status.FailuresCount != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// The objects must be encrypted
+	cnt := 0
+	check(NewBucket(s3back.s3, conf.S3Repl.Bucket).Iter(100, func(o *Object) error {
+		r, err := o.Reader()
+		check(err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		check(err)
+		if !encrypted.IsEncrypted(data) {
+			t.Errorf("object %s is not encrypted", o.Key)
+		}
+		cnt++
+		return nil
+	}))
+	if cnt != len(blobs) {
+		t.Errorf("expected %d objects, got %d", len(blobs), cnt)
+	}
+
+	for _, b := range blobs {
+		exists, err := s3back.Exists(b.Hash)
+		check(err)
+		if !exists {
+			t.Errorf("blob %s should exist", b.Hash)
+		}
+		data, err := s3back.Get(b.Hash)
+		check(err)
+		if string(data) != string(b.Data) {
+			t.Errorf("bad blob %s, got %q", b.Hash, data)
+		}
+	}
+
+	// Delete the first blob
+	check(s3back.Delete(blobs[0].Hash))
+	s3back.process()
+	if _, err := s3back.Fetch(blobs[0].Hash); err != clientutil.ErrBlobNotFound {
+		t.Errorf("blob %s should have been deleted, got %v", blobs[0].Hash, err)
+	}
+}
+
+func TestS3Rotation(t *testing.T) {
+	dir, conf, ts, cleanup := setup(t)
+	defer cleanup()
+
+	s3back, back := newTestBackend(conf, ts)
+	blobs := replicate(t, s3back, back, 5)
+	s3back.Close()
+
+	// Rotate the key
+	newKeyPath := filepath.Join(dir, "key2")
+	var newKey [32]byte
+	_, err := rand.Read(newKey[:])
+	check(err)
+	check(ioutil.WriteFile(newKeyPath, newKey[:], 0600))
+	conf.S3Repl.OldKeyFiles = []string{conf.S3Repl.KeyFile}
+	conf.S3Repl.KeyFile = newKeyPath
+	s3back, _ = newTestBackend(conf, ts)
+	check(s3back.Rotate(context.Background()))
+	rotation := s3back.RotationStatus()
+	if rotation.Checked != len(blobs) || rotation.Rotated != len(blobs) || rotation.Failed != 0 {
+		t.Errorf("unexpected rotation status %+v", rotation)
+	}
+	cnt := 0
+	check(NewBucket(s3back.s3, conf.S3Repl.Bucket).Iter(100, func(o *Object) error {
+		_, keyID, err := NewEncryptedBlob(o, s3back.keyring).Header()
+		check(err)
+		if keyID != encrypted.KeyID(&newKey) {
+			t.Errorf("object %s is not sealed with the new key", o.Key)
+		}
+		cnt++
+		return nil
+	}))
+	if cnt != len(blobs) {
+		t.Errorf("expected %d objects after the rotation, got %d", len(blobs), cnt)
+	}
+
+	// Running it again is a no-op
+	check(s3back.Rotate(context.Background()))
+	if rotation := s3back.RotationStatus(); rotation.Checked != len(blobs) || rotation.Rotated != 0 || rotation.Failed != 0 {
+		t.Errorf("unexpected rotation status %+v", rotation)
+	}
+	s3back.Close()
+
+	// The old key is not needed anymore
+	conf.S3Repl.OldKeyFiles = nil
+	s3back, _ = newTestBackend(conf, ts)
+	for _, b := range blobs {
+		data, err := s3back.Get(b.Hash)
+		check(err)
+		if string(data) != string(b.Data) {
+			t.Errorf("bad blob %s after the rotation, got %q", b.Hash, data)
+		}
+	}
+	s3back.Close()
+
+	// Scan mode: rebuild the index from the bucket
+	conf.S3ScanMode = true
+	s3back, _ = newTestBackend(conf, ts)
+	defer s3back.Close()
+	for _, b := range blobs {
+		exists, err := s3back.Exists(b.Hash)
+		check(err)
+		if !exists {
+			t.Errorf("blob %s should have been re-indexed", b.Hash)
+		}
+	}
+}
+
+// legacyIndex rewrites the index entries like before the object keys were indexed: the hash of the ciphertext (the
+// object key) was indexed by the uploads, and the plain-text hash by the scans
+func legacyIndex(s3back *S3Backend, blobs []*blob.Blob) {
+	for i, b := range blobs {
+		key, err := s3back.index.Key(b.Hash)
+		check(err)
+		check(s3back.index.Delete(b.Hash))
+		check(s3back.index.Index(key))
+		if i == 0 {
+			check(s3back.index.Index(b.Hash))
+		}
+	}
+}
+
+func TestS3RotationLegacyIndex(t *testing.T) {
+	dir, conf, ts, cleanup := setup(t)
+	defer cleanup()
+
+	s3back, back := newTestBackend(conf, ts)
+	blobs := replicate(t, s3back, back, 5)
+	s3back.Close()
+
+	newKeyPath := filepath.Join(dir, "key2")
+	var newKey [32]byte
+	_, err := rand.Read(newKey[:])
+	check(err)
+	check(ioutil.WriteFile(newKeyPath, newKey[:], 0600))
+	conf.S3Repl.OldKeyFiles = []string{conf.S3Repl.KeyFile}
+	conf.S3Repl.KeyFile = newKeyPath
+	s3back, _ = newTestBackend(conf, ts)
+	defer s3back.Close()
+	legacyIndex(s3back, blobs)
+
+	// The index is rebuilt from the bucket before rotating
+	check(s3back.Rotate(context.Background()))
+	rotation := s3back.RotationStatus()
+	if rotation.Checked != len(blobs) || rotation.Rotated != len(blobs) || rotation.Failed != 0 {
+		t.Errorf("unexpected rotation status %+v", rotation)
+	}
+	legacy, err := s3back.index.Legacy()
+	check(err)
+	if legacy {
+		t.Errorf("the legacy index entries should have been removed")
+	}
+	for _, b := range blobs {
+		_, keyID, err := s3back.index.Object(b.Hash)
+		check(err)
+		if keyID != encrypted.KeyID(&newKey) {
+			t.Errorf("blob %s is not indexed with the new key, got %q", b.Hash, keyID)
+		}
+		data, err := s3back.Get(b.Hash)
+		check(err)
+		if string(data) != string(b.Data) {
+			t.Errorf("bad blob %s after the rotation, got %q", b.Hash, data)
+		}
+	}
+}
+
+func TestS3LegacyIndex(t *testing.T) {
+	_, conf, ts, cleanup := setup(t)
+	defer cleanup()
+
+	s3back, back := newTestBackend(conf, ts)
+	blobs := replicate(t, s3back, back, 5)
+	legacyIndex(s3back, blobs)
+	for _, b := range blobs {
+		if _, err := s3back.Fetch(b.Hash); err != clientutil.ErrBlobNotFound {
+			t.Errorf("blob %s should not be found with a legacy index, got %v", b.Hash, err)
+		}
+	}
+	s3back.Close()
+
+	// The index is migrated at startup
+	s3back, _ = newTestBackend(conf, ts)
+	defer s3back.Close()
+	legacy, err := s3back.index.Legacy()
+	check(err)
+	if legacy {
+		t.Errorf("the legacy index entries should have been removed")
+	}
+	for _, b := range blobs {
+		data, err := s3back.Fetch(b.Hash)
+		check(err)
+		if string(data) != string(b.Data) {
+			t.Errorf("bad blob %s, got %q", b.Hash, data)
+		}
+	}
+}
+
+func TestS3Restore(t *testing.T) {
+	dir, conf, ts, cleanup := setup(t)
+	defer cleanup()
+
+	s3back, back := newTestBackend(conf, ts)
+	blobs := replicate(t, s3back, back, 5)
+	s3back.Close()
+
+	// Restore mode: start from an empty data dir
+	conf.S3RestoreMode = true
+	conf.DataDir = filepath.Join(dir, "restored")
+	s3back, back = newTestBackend(conf, ts)
+	defer s3back.Close()
+	for _, b := range blobs {
+		data, err := back.Get(b.Hash)
+		check(err)
+		if string(data) != string(b.Data) {
+			t.Errorf("bad restored blob %s, got %q", b.Hash, data)
+		}
+	}
+	if st := s3back.RestoreStatus(); st.Restored != len(blobs) || st.Failed != 0 {
+		t.Errorf("unexpected restore status %+v", st)
+	}
+	if _, err := os.Stat(s3back.restorePath); !os.IsNotExist(err) {
+		t.Errorf("the restore state should have been removed")
+	}
+
+	// Incremental restore: only the missing blobs are downloaded
+	check(back.Delete(blobs[0].Hash))
+	check(back.Delete(blobs[1].Hash))
+	check(s3back.Restore(context.Background(), 2))
+	if st := s3back.RestoreStatus(); st.Restored != 2 || st.Skipped != len(blobs)-2 || st.Failed != 0 {
+		t.Errorf("unexpected restore status %+v", st)
+	}
+	for _, b := range blobs[:2] {
+		data, err := back.Get(b.Hash)
+		check(err)
+		if string(data) != string(b.Data) {
+			t.Errorf("bad restored blob %s, got %q", b.Hash, data)
+		}
+	}
+
+	// A deleted blob is never restored, even if it's still in the bucket
+	check(back.Delete(blobs[2].Hash))
+	check(ts.Add(blobs[2].Hash, time.Now().UTC()))
+	check(s3back.Restore(context.Background(), 2))
+	if st := s3back.RestoreStatus(); st.Restored != 0 || st.Skipped != len(blobs) || st.Failed != 0 {
+		t.Errorf("unexpected restore status %+v", st)
+	}
+	if exists, err := back.Exists(blobs[2].Hash); err != nil || exists {
+		t.Errorf("the deleted blob %s should not have been restored (%v)", blobs[2].Hash, err)
+	}
+
+	// The objects that failed are retried by the next restore
+	check(back.Delete(blobs[3].Hash))
+	var events int
+	s3back.hub.Subscribe(hub.NewBlob, "restore_test", func(_ context.Context, b *blob.Blob, _ interface{}) error {
+		events++
+		if events == 1 {
+			return fmt.Errorf("failed to index %s", b.Hash)
+		}
+		return nil
+	})
+	check(s3back.Restore(context.Background(), 2))
+	if st := s3back.RestoreStatus(); st.Restored != 0 || st.Failed != 1 {
+		t.Errorf("unexpected restore status %+v", st)
+	}
+	data, err := ioutil.ReadFile(s3back.restorePath)
+	check(err)
+	key, err := s3back.index.Key(blobs[3].Hash)
+	check(err)
+	if expected := fmt.Sprintf(`{"marker":"","failed":["%s"]}`, key); string(data) != expected {
+		t.Errorf("unexpected restore state %s, expected %s", data, expected)
+	}
+	check(s3back.Restore(context.Background(), 2))
+	if st := s3back.RestoreStatus(); !st.Resumed || st.Restored != 1 || st.Failed != 0 {
+		t.Errorf("unexpected restore status %+v", st)
+	}
+	if events != 2 {
+		t.Errorf("the event should have been triggered again, got %d events", events)
+	}
+	if _, err := os.Stat(s3back.restorePath); !os.IsNotExist(err) {
+		t.Errorf("the restore state should have been removed")
+	}
+}
@@ -0,0 +1,70 @@
+package s3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestAWSConfig(t *testing.T) {
+	// The default AWS endpoint and credentials chain
+	awsConf, err := awsConfig(&config.S3Repl{Region: "eu-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(awsConf.Region) != "eu-west-1" || awsConf.Endpoint != nil || awsConf.Credentials != nil ||
+		awsConf.S3ForcePathStyle != nil || awsConf.DisableSSL != nil || awsConf.HTTPClient != nil {
+		t.Errorf("unexpected default config %+v", awsConf)
+	}
+
+	// A S3-compatible service with static credentials
+	awsConf, err = awsConfig(&config.S3Repl{
+		Endpoint:        "localhost:9000",
+		PathStyle:       true,
+		DisableSSL:      true,
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(awsConf.Endpoint) != "localhost:9000" || !aws.BoolValue(awsConf.S3ForcePathStyle) ||
+		!aws.BoolValue(awsConf.DisableSSL) {
+		t.Errorf("unexpected config %+v", awsConf)
+	}
+	creds, err := awsConf.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "id" || creds.SecretAccessKey != "secret" {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+
+	// TLS options
+	dir, err := ioutil.TempDir("", "blobstash_s3_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalid, []byte("not a cert"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{invalid, filepath.Join(dir, "missing.pem")} {
+		if _, err := awsConfig(&config.S3Repl{CACertFile: path}); err == nil {
+			t.Errorf("the CA cert file %s should be rejected", path)
+		}
+	}
+	awsConf, err = awsConfig(&config.S3Repl{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if awsConf.HTTPClient == nil {
+		t.Errorf("a custom HTTP client should be used")
+	}
+}
@@ -0,0 +1,207 @@
+/*
+
+Package s3test provides an in-process S3 stand-in (path-style addressing only) for the tests.
+
+Set `BLOBSTASH_S3_TEST_ENDPOINT` (and `BLOBSTASH_S3_TEST_ACCESS_KEY_ID`/`BLOBSTASH_S3_TEST_SECRET_ACCESS_KEY`) to
+run the tests against a real S3-compatible service like MinIO instead.
+
+*/
+package s3test // import "a4.io/blobstash/pkg/backend/s3/s3test"
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// Server implements the subset of the S3 API used by the S3 backend
+type Server struct {
+	buckets map[string]map[string][]byte
+	lists   int
+	mu      sync.Mutex
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name        `xml:"ListBucketResult"`
+	Name        string          `xml:"Name"`
+	Marker      string          `xml:"Marker"`
+	MaxKeys     int             `xml:"MaxKeys"`
+	IsTruncated bool            `xml:"IsTruncated"`
+	Contents    []*listContents `xml:"Contents"`
+}
+
+type listContents struct {
+	Key          string `xml:"Key"`
+	Size         int    `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// NewServer returns an empty S3 stand-in, to be served with `httptest`
+func NewServer() *Server {
+	return &Server{buckets: map[string]map[string][]byte{}}
+}
+
+// Lists returns the number of bucket listings served so far
+func (s *Server) Lists() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lists
+}
+
+func (s *Server) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	objects, ok := s.buckets[bucket]
+
+	if key == "" {
+		switch r.Method {
+		case "HEAD":
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "PUT":
+			if !ok {
+				s.buckets[bucket] = map[string][]byte{}
+			}
+		case "GET":
+			if !ok {
+				s.error(w, http.StatusNotFound, "NoSuchBucket")
+				return
+			}
+			s.lists++
+			q := r.URL.Query()
+			marker := q.Get("marker")
+			max := 1000
+			if v := q.Get("max-keys"); v != "" {
+				max, _ = strconv.Atoi(v)
+			}
+			var keys []string
+			for k := range objects {
+				if k > marker {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			res := &listBucketResult{Name: bucket, Marker: marker, MaxKeys: max}
+			if len(keys) > max {
+				keys = keys[:max]
+				res.IsTruncated = true
+			}
+			for _, k := range keys {
+				res.Contents = append(res.Contents, &listContents{
+					Key:          k,
+					Size:         len(objects[k]),
+					LastModified: time.Now().UTC().Format(time.RFC3339),
+					ETag:         `"etag"`,
+					StorageClass: "STANDARD",
+				})
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			xml.NewEncoder(w).Encode(res)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if !ok {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		objects[key] = data
+	case "GET":
+		data, ok := objects[key]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+				s.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			return
+		}
+		w.Write(data)
+	case "DELETE":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// New returns a S3 replication config with a random encryption key (saved in dir) and a fresh bucket, along with the
+// S3 stand-in (nil if `BLOBSTASH_S3_TEST_ENDPOINT` is set), the returned func stops the stand-in
+func New(t testing.TB, dir string) (*config.S3Repl, *Server, func()) {
+	t.Helper()
+	keyPath := filepath.Join(dir, "key")
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, key[:], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.S3Repl{
+		Bucket:          fmt.Sprintf("blobstash-test-%d", time.Now().UnixNano()),
+		Region:          "us-east-1",
+		KeyFile:         keyPath,
+		Endpoint:        os.Getenv("BLOBSTASH_S3_TEST_ENDPOINT"),
+		PathStyle:       true,
+		AccessKeyID:     os.Getenv("BLOBSTASH_S3_TEST_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("BLOBSTASH_S3_TEST_SECRET_ACCESS_KEY"),
+	}
+	if conf.Endpoint != "" {
+		return conf, nil, func() {}
+	}
+	s := NewServer()
+	srv := httptest.NewServer(s)
+	conf.Endpoint = srv.URL
+	conf.DisableSSL = true
+	conf.AccessKeyID = "test"
+	conf.SecretAccessKey = "test"
+	return conf, s, srv.Close
+}
@@ -0,0 +1,178 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPaused is returned when trying to flush the queues while the replication is paused
+var ErrPaused = errors.New("s3 replication is paused")
+
+// Max number of failures kept in the status
+const maxFailures = 20
+
+// Failure is a failed upload/deletion
+type Failure struct {
+	Hash  string    `json:"hash"`
+	Op    string    `json:"op"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// Status holds the state of the replication, counters are reset when the server restarts
+type Status struct {
+	Bucket          string     `json:"bucket"`
+	Encrypted       bool       `json:"encrypted"`
+	KeyID           string     `json:"key_id,omitempty"`
+	Paused          bool       `json:"paused"`
+	Running         bool       `json:"running"`
+	QueueSize       int        `json:"queue_size"`
+	DeleteQueueSize int        `json:"delete_queue_size"`
+	LastRun         *time.Time `json:"last_run"`
+	LastUpload      *time.Time `json:"last_upload"`
+	LastUploadHash  string     `json:"last_upload_hash,omitempty"`
+	UploadedCount   int        `json:"uploaded_count"`
+	UploadedBytes   int64      `json:"uploaded_bytes"`
+	DeletedCount    int        `json:"deleted_count"`
+	FailuresCount   int        `json:"failures_count"`
+	Failures        []*Failure `json:"recent_failures"`
+
+	Rotation *RotationStatus `json:"key_rotation"`
+	Restore  *RestoreStatus  `json:"restore"`
+}
+
+// status is the in-memory state updated by the worker
+type status struct {
+	paused         bool
+	running        bool
+	lastRun        time.Time
+	lastUpload     time.Time
+	lastUploadHash string
+	uploadedCount  int
+	uploadedBytes  int64
+	deletedCount   int
+	failuresCount  int
+	failures       []*Failure
+	mu             sync.Mutex
+}
+
+func (s *status) uploaded(hash string, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUpload = time.Now().UTC()
+	s.lastUploadHash = hash
+	s.uploadedCount++
+	s.uploadedBytes += int64(size)
+}
+
+func (s *status) deleted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deletedCount++
+}
+
+func (s *status) failed(hash, op string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failuresCount++
+	s.failures = append(s.failures, &Failure{Hash: hash, Op: op, Error: err.Error(), Time: time.Now().UTC()})
+	if len(s.failures) > maxFailures {
+		s.failures = s.failures[len(s.failures)-maxFailures:]
+	}
+}
+
+func (s *status) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+func (s *status) setRunning(running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+	if !running {
+		s.lastRun = time.Now().UTC()
+	}
+}
+
+// Status returns the current state of the replication
+func (b *S3Backend) Status() (*Status, error) {
+	queueSize, err := b.queue.Size()
+	if err != nil {
+		return nil, err
+	}
+	deleteQueueSize, err := b.deleteQueue.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	rotation := b.RotationStatus()
+	restore := b.RestoreStatus()
+
+	b.status.mu.Lock()
+	defer b.status.mu.Unlock()
+	st := &Status{
+		Bucket:          b.bucket,
+		Encrypted:       b.encrypted,
+		Paused:          b.status.paused,
+		Running:         b.status.running,
+		QueueSize:       queueSize,
+		DeleteQueueSize: deleteQueueSize,
+		LastUploadHash:  b.status.lastUploadHash,
+		UploadedCount:   b.status.uploadedCount,
+		UploadedBytes:   b.status.uploadedBytes,
+		DeletedCount:    b.status.deletedCount,
+		FailuresCount:   b.status.failuresCount,
+		Failures:        []*Failure{},
+		Rotation:        rotation,
+		Restore:         restore,
+	}
+	if b.encrypted {
+		st.KeyID = b.keyring.CurrentKeyID()
+	}
+	if !b.status.lastRun.IsZero() {
+		t := b.status.lastRun
+		st.LastRun = &t
+	}
+	if !b.status.lastUpload.IsZero() {
+		t := b.status.lastUpload
+		st.LastUpload = &t
+	}
+	// Most recent failures first
+	for i := len(b.status.failures) - 1; i >= 0; i-- {
+		st.Failures = append(st.Failures, b.status.failures[i])
+	}
+	return st, nil
+}
+
+// Pause stops the processing of the queues (the blobs are still enqueued), it will stop after the current blob if
+// the worker is running
+func (b *S3Backend) Pause() {
+	b.status.mu.Lock()
+	defer b.status.mu.Unlock()
+	b.status.paused = true
+	b.log.Info("s3 replication paused")
+}
+
+// Resume restarts the processing of the queues
+func (b *S3Backend) Resume() {
+	b.status.mu.Lock()
+	defer b.status.mu.Unlock()
+	b.status.paused = false
+	b.log.Info("s3 replication resumed")
+}
+
+// Flush triggers the processing of the queues without waiting for the next tick
+func (b *S3Backend) Flush() error {
+	if b.status.isPaused() {
+		return ErrPaused
+	}
+	select {
+	case b.flush <- struct{}{}:
+	default:
+		// A flush is already pending
+	}
+	return nil
+}
@@ -35,8 +35,26 @@ func New(data []byte) *Blob {
 	}
 }
 
+// NewWithAlgorithm returns a new blob addressed using the given hash algorithm
+func NewWithAlgorithm(algo string, data []byte) (*Blob, error) {
+	hash, err := hashutil.ComputeWith(algo, data)
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{
+		Data: data,
+		Hash: hash,
+	}, nil
+}
+
+// Check ensures the hash matches the blob content (using the algorithm of the hash)
 func (b *Blob) Check() error {
-	chash := hashutil.Compute(b.Data)
+	h, err := hashutil.NewHasherFor(b.Hash)
+	if err != nil {
+		return fmt.Errorf("invalid hash %s: %v", b.Hash, err)
+	}
+	h.Write(b.Data)
+	chash := h.Ref()
 	if b.Hash != chash {
 		return fmt.Errorf("Hash mismatch: given=%s, computed=%v", b.Hash, chash)
 	}
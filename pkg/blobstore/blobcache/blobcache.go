@@ -0,0 +1,164 @@
+/*
+
+Package blobcache implements an in-memory cache for the hot blobs, sitting in front of the storage backend.
+
+The blobs data are kept in a LRU bounded by the total size of the cached blobs, and the `Stat` misses are kept in a
+negative cache (bounded by the number of entries) for a short time, so looking up missing blobs repeatedly (e.g. while
+syncing) does not hit the disk either.
+
+*/
+package blobcache // import "a4.io/blobstash/pkg/blobstore/blobcache"
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+// The number of misses kept in the negative cache
+const negativeCacheSize = 10000
+
+// The duration a miss is kept, the blobs may be written directly to the backend (e.g. by a S3 restore)
+const negativeTTL = 1 * time.Minute
+
+// Stats holds the cache metrics
+type Stats struct {
+	MaxSize       int   `json:"max_size"`
+	Size          int   `json:"size"`
+	BlobsCount    int   `json:"blobs_count"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	NegativeCount int   `json:"negative_count"`
+	NegativeHits  int64 `json:"negative_hits"`
+}
+
+type entry struct {
+	hash string
+	data []byte
+}
+
+// Cache holds the hot blobs
+type Cache struct {
+	evict       *list.List
+	items       map[string]*list.Element
+	maxSize     int
+	currentSize int
+
+	negative *lru.Cache
+
+	hits, misses, evictions, negativeHits int64
+
+	mu sync.Mutex
+}
+
+// New initializes a cache that can hold up to `maxSize` bytes of blobs
+func New(maxSize int) *Cache {
+	negative, err := lru.New(negativeCacheSize)
+	if err != nil {
+		// Only returned for a negative size
+		panic(err)
+	}
+	return &Cache{
+		evict:    list.New(),
+		items:    map[string]*list.Element{},
+		maxSize:  maxSize,
+		negative: negative,
+	}
+}
+
+// Get returns the cached blob data (the data must not be modified), and false if the blob is not cached
+func (c *Cache) Get(hash string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elm, ok := c.items[hash]; ok {
+		c.evict.MoveToFront(elm)
+		c.hits++
+		return elm.Value.(*entry).data, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Add caches the blob data, blobs bigger than the cache are ignored
+func (c *Cache) Add(hash string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.negative.Remove(hash)
+	if len(data) > c.maxSize {
+		return
+	}
+	if elm, ok := c.items[hash]; ok {
+		c.evict.MoveToFront(elm)
+		return
+	}
+	c.items[hash] = c.evict.PushFront(&entry{hash, data})
+	c.currentSize += len(data)
+	for c.currentSize > c.maxSize {
+		c.removeElement(c.evict.Back())
+		c.evictions++
+	}
+}
+
+// Remove evicts the blob from the cache (and from the negative cache)
+func (c *Cache) Remove(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.negative.Remove(hash)
+	if elm, ok := c.items[hash]; ok {
+		c.removeElement(elm)
+	}
+}
+
+func (c *Cache) removeElement(elm *list.Element) {
+	e := c.evict.Remove(elm).(*entry)
+	delete(c.items, e.hash)
+	c.currentSize -= len(e.data)
+}
+
+// Contains returns true if the blob is cached, without updating the metrics
+func (c *Cache) Contains(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[hash]
+	return ok
+}
+
+// AddMissing records a `Stat` miss
+func (c *Cache) AddMissing(hash string) {
+	c.negative.Add(hash, time.Now().Add(negativeTTL))
+}
+
+// Missing returns true if the blob is known to be missing
+func (c *Cache) Missing(hash string) bool {
+	expire, ok := c.negative.Get(hash)
+	if !ok {
+		return false
+	}
+	if time.Now().After(expire.(time.Time)) {
+		c.negative.Remove(hash)
+		return false
+	}
+	c.mu.Lock()
+	c.negativeHits++
+	c.mu.Unlock()
+	return true
+}
+
+// Stats returns the cache metrics
+func (c *Cache) Stats() *Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &Stats{
+		MaxSize:       c.maxSize,
+		Size:          c.currentSize,
+		BlobsCount:    len(c.items),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		NegativeCount: c.negative.Len(),
+		NegativeHits:  c.negativeHits,
+	}
+}
@@ -0,0 +1,45 @@
+package blobcache
+
+import (
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	c := New(10)
+	c.Add("a", []byte("aaaa"))
+	c.Add("b", []byte("bbbb"))
+	if data, ok := c.Get("a"); !ok || string(data) != "aaaa" {
+		t.Errorf("a should be cached, got %q", data)
+	}
+	// "b" is the least recently used blob
+	c.Add("c", []byte("cccc"))
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("b should have been evicted")
+	}
+	// Blobs bigger than the cache are ignored
+	c.Add("d", []byte("ddddddddddd"))
+	if c.Contains("d") {
+		t.Errorf("d should not be cached")
+	}
+	c.Remove("a")
+	if c.Contains("a") {
+		t.Errorf("a should have been removed")
+	}
+	stats := c.Stats()
+	if stats.Size != 4 || stats.BlobsCount != 1 || stats.Hits != 1 || stats.Misses != 1 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	c.AddMissing("e")
+	if !c.Missing("e") {
+		t.Errorf("e should be missing")
+	}
+	// Saving the blob removes it from the negative cache
+	c.Add("e", []byte("e"))
+	if c.Missing("e") {
+		t.Errorf("e should not be missing")
+	}
+	if stats := c.Stats(); stats.NegativeHits != 1 || stats.NegativeCount != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
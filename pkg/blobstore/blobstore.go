@@ -4,14 +4,21 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
-	"a4.io/blobsfile"
-
-	// "a4.io/blobstash/pkg/backend/blobsfile"
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/backend/blobsdir"
+	"a4.io/blobstash/pkg/backend/blobsfile"
+	"a4.io/blobstash/pkg/backend/compressed"
+	"a4.io/blobstash/pkg/backend/encrypted"
+	"a4.io/blobstash/pkg/backend/multidisk"
 	"a4.io/blobstash/pkg/backend/s3"
 	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore/blobcache"
+	"a4.io/blobstash/pkg/blobstore/tombstone"
+	"a4.io/blobstash/pkg/client/clientutil"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hub"
@@ -19,11 +26,29 @@ import (
 
 var ErrBlobExists = fmt.Errorf("blob exist")
 
+// The number of refs fetched from the backend at once when iterating over the blobs
+var iterBatchSize = 1000
+
+// ErrBlobDeleted is returned when trying to save a blob that has been deleted
+var ErrBlobDeleted = fmt.Errorf("blob deleted")
+
+// ErrMultiDiskDisabled is returned when trying to rebalance the blobs while a single disk is used
+var ErrMultiDiskDisabled = fmt.Errorf("multidisk disabled")
+
+// Available storage backends
+const (
+	BackendBlobsFile = "blobsfile"
+	BackendBlobsDir  = "blobsdir"
+)
+
 type BlobStore struct {
-	back   *blobsfile.BlobsFiles
-	s3back *s3.S3Backend
-	hub    *hub.Hub
-	conf   *config.Config
+	back       backend.Backend
+	multidisk  *multidisk.MultiDisk // nil if a single disk is used
+	s3back     *s3.S3Backend
+	tombstones *tombstone.Tombstones
+	cache      *blobcache.Cache // nil if disabled
+	hub        *hub.Hub
+	conf       *config.Config
 
 	log log.Logger
 }
@@ -31,27 +56,125 @@ type BlobStore struct {
 func New(logger log.Logger, conf2 *config.Config, hub *hub.Hub) (*BlobStore, error) {
 	logger.Debug("init")
 
-	back, err := blobsfile.New(&blobsfile.Opts{Directory: filepath.Join(conf2.VarDir(), "blobs")})
+	back, mdisk, err := newBackend(logger, conf2)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init BlobsFile: %v", err)
+		return nil, err
+	}
+	tombstones, err := tombstone.New(filepath.Join(conf2.VarDir(), "tombstones"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to init tombstones: %v", err)
 	}
 	var s3back *s3.S3Backend
 	if s3repl := conf2.S3Repl; s3repl != nil && s3repl.Bucket != "" {
 		logger.Debug("init s3 replication")
 		var err error
-		s3back, err = s3.New(logger.New("app", "s3_replication"), back, hub, conf2)
+		s3back, err = s3.New(logger.New("app", "s3_replication"), back, hub, tombstones, conf2)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return &BlobStore{
-		back:   back,
-		s3back: s3back,
-		hub:    hub,
-		conf:   conf2,
-		log:    logger,
-	}, nil
+	var cache *blobcache.Cache
+	if conf2.BlobStore != nil && conf2.BlobStore.CacheSize > 0 {
+		logger.Debug("init cache", "size", conf2.BlobStore.CacheSize)
+		cache = blobcache.New(conf2.BlobStore.CacheSize << 20)
+	}
+
+	bs := &BlobStore{
+		back:       back,
+		multidisk:  mdisk,
+		s3back:     s3back,
+		tombstones: tombstones,
+		cache:      cache,
+		hub:        hub,
+		conf:       conf2,
+		log:        logger,
+	}
+
+	// Move the blobs in the background if a disk has been added (or removed)
+	if mdisk != nil && mdisk.LayoutChanged() {
+		go func() {
+			logger.Info("disks layout changed, starting rebalance")
+			if _, err := bs.Rebalance(context.Background()); err != nil {
+				logger.Error("rebalance failed", "err", err)
+			}
+		}()
+	}
+
+	return bs, nil
+}
+
+// newBackend initializes the storage backend selected in the config (BlobsFile by default), spread across multiple
+// disks if configured
+func newBackend(logger log.Logger, conf *config.Config) (backend.Backend, *multidisk.MultiDisk, error) {
+	if conf.BlobStore == nil || len(conf.BlobStore.Disks) == 0 {
+		back, err := newDiskBackend(logger, conf, filepath.Join(conf.VarDir(), "blobs"))
+		return back, nil, err
+	}
+
+	var disks []*multidisk.Disk
+	for _, dir := range conf.BlobStore.Disks {
+		back, err := newDiskBackend(logger, conf, dir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to init disk %s: %v", dir, err)
+		}
+		disks = append(disks, &multidisk.Disk{Path: dir, Backend: back})
+	}
+	logger.Debug("init multidisk", "disks", len(disks), "replicas", conf.BlobStore.Replicas)
+	mdisk, err := multidisk.New(disks, conf.BlobStore.Replicas, filepath.Join(conf.VarDir(), "multidisk-layout.json"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to init multidisk: %v", err)
+	}
+	return mdisk, mdisk, nil
+}
+
+// newDiskBackend initializes the storage backend in the given directory
+func newDiskBackend(logger log.Logger, conf *config.Config, dir string) (backend.Backend, error) {
+	name := BackendBlobsFile
+	if conf.BlobStore != nil && conf.BlobStore.Backend != "" {
+		name = conf.BlobStore.Backend
+	}
+	logger.Debug("init backend", "backend", name, "dir", dir)
+	var back backend.Backend
+	var err error
+	switch name {
+	case BackendBlobsFile:
+		back, err = blobsfile.New(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init BlobsFile: %v", err)
+		}
+	case BackendBlobsDir:
+		back, err = blobsdir.New(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init BlobsDir: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend \"%s\"", name)
+	}
+
+	// Encrypt the blobs at rest if a key is configured
+	if conf.BlobStore != nil {
+		key, err := conf.BlobStore.Key()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the encryption key: %v", err)
+		}
+		if key != nil {
+			logger.Debug("init encryption")
+			back = encrypted.New(back, key)
+		}
+	}
+
+	// Always wrap the backend, so compressed blobs can still be read if the compression gets disabled
+	var codec string
+	if conf.BlobStore != nil {
+		codec = conf.BlobStore.Compression
+	}
+	logger.Debug("init compression", "codec", codec)
+	cback, err := compressed.New(back, codec)
+	if err != nil {
+		return nil, err
+	}
+	return cback, nil
 }
 
 func (bs *BlobStore) Close() error {
@@ -60,6 +183,10 @@ func (bs *BlobStore) Close() error {
 		bs.s3back.Close()
 	}
 
+	if err := bs.tombstones.Close(); err != nil {
+		return err
+	}
+
 	if err := bs.back.Close(); err != nil {
 		return err
 	}
@@ -75,6 +202,15 @@ func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) error {
 		return err
 	}
 
+	// Prevent deleted blobs to be saved again
+	deleted, err := bs.Deleted(blob.Hash)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return ErrBlobDeleted
+	}
+
 	exists, err := bs.back.Exists(blob.Hash)
 	if err != nil {
 		return err
@@ -82,13 +218,20 @@ func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) error {
 
 	if exists {
 		bs.log.Debug("blob already saved", "hash", blob.Hash)
-		return nil
+		if bs.cache != nil {
+			bs.cache.Remove(blob.Hash)
+		}
+		// The blob may be uploaded again with a different context (e.g. in another namespace)
+		return bs.hub.ExistingBlobEvent(ctx, blob, nil)
 	}
 
 	// Save the blob
 	if err := bs.back.Put(blob.Hash, blob.Data); err != nil {
 		return err
 	}
+	if bs.cache != nil {
+		bs.cache.Add(blob.Hash, blob.Data)
+	}
 
 	// Wait for adding the blob to the S3 replication queue if enabled
 	if bs.s3back != nil {
@@ -109,45 +252,341 @@ func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) error {
 func (bs *BlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
 	_, fromHttp := ctxutil.Request(ctx)
 	bs.log.Info("OP Get", "from_http", fromHttp, "hash", hash)
+	return bs.get(hash, bs.cache != nil)
+}
+
+// GetNoCache reads the blob from the backend, bypassing the hot blobs cache (e.g. for the jobs reading every blob, that
+// would evict all the hot blobs)
+func (bs *BlobStore) GetNoCache(ctx context.Context, hash string) ([]byte, error) {
+	_, fromHttp := ctxutil.Request(ctx)
+	bs.log.Info("OP GetNoCache", "from_http", fromHttp, "hash", hash)
+	return bs.get(hash, false)
+}
+
+// GetLocal reads the blob from the local storage only, bypassing both the hot blobs cache and the S3 read-through (e.g.
+// for the scrubber that needs to check the local copy)
+func (bs *BlobStore) GetLocal(ctx context.Context, hash string) ([]byte, error) {
+	_, fromHttp := ctxutil.Request(ctx)
+	bs.log.Info("OP GetLocal", "from_http", fromHttp, "hash", hash)
+	deleted, err := bs.Deleted(hash)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		return nil, clientutil.ErrBlobNotFound
+	}
 	return bs.back.Get(hash)
 }
 
+func (bs *BlobStore) get(hash string, useCache bool) ([]byte, error) {
+	deleted, err := bs.Deleted(hash)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		return nil, clientutil.ErrBlobNotFound
+	}
+	if useCache {
+		if data, ok := bs.cache.Get(hash); ok {
+			return data, nil
+		}
+	}
+	data, err := bs.back.Get(hash)
+	if err == clientutil.ErrBlobNotFound && bs.readThrough() {
+		data, err = bs.getFromS3(hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if useCache {
+		bs.cache.Add(hash, data)
+	}
+	return data, nil
+}
+
+// CacheStats returns the hot blobs cache metrics, or nil if the cache is disabled
+func (bs *BlobStore) CacheStats() *blobcache.Stats {
+	if bs.cache == nil {
+		return nil
+	}
+	return bs.cache.Stats()
+}
+
+// readThrough returns true if the blobs missing locally should be fetched from S3
+func (bs *BlobStore) readThrough() bool {
+	return bs.s3back != nil && bs.conf.S3Repl.ReadThrough
+}
+
+// getFromS3 fetches (and verifies) the blob from the S3 replication, and saves it locally if requested
+func (bs *BlobStore) getFromS3(hash string) ([]byte, error) {
+	bs.log.Debug("fetching blob from s3", "hash", hash)
+	data, err := bs.s3back.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if bs.conf.S3Repl.CacheLocal {
+		// The blob is already known by the indexes, no need to trigger the hub
+		if err := bs.back.Put(hash, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
 func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
 	_, fromHttp := ctxutil.Request(ctx)
 	bs.log.Info("OP Stat", "from_http", fromHttp, "hash", hash)
-	return bs.back.Exists(hash)
+	return bs.stat(hash)
+}
+
+// StatMany checks the existence of multiple blobs at once, returns a map hash => exists
+func (bs *BlobStore) StatMany(ctx context.Context, hashes []string) (map[string]bool, error) {
+	_, fromHttp := ctxutil.Request(ctx)
+	bs.log.Info("OP StatMany", "from_http", fromHttp, "hashes_count", len(hashes))
+	res := map[string]bool{}
+	for _, hash := range hashes {
+		exists, err := bs.stat(hash)
+		if err != nil {
+			return nil, err
+		}
+		res[hash] = exists
+	}
+	return res, nil
+}
+
+func (bs *BlobStore) stat(hash string) (bool, error) {
+	deleted, err := bs.Deleted(hash)
+	if err != nil {
+		return false, err
+	}
+	if deleted {
+		return false, nil
+	}
+	if bs.cache != nil {
+		if bs.cache.Contains(hash) {
+			return true, nil
+		}
+		if bs.cache.Missing(hash) {
+			return false, nil
+		}
+	}
+	exists, err := bs.back.Exists(hash)
+	if err != nil {
+		return false, err
+	}
+	if !exists && bs.readThrough() {
+		exists, err = bs.s3back.Exists(hash)
+		if err != nil {
+			return false, err
+		}
+	}
+	if !exists && bs.cache != nil {
+		bs.cache.AddMissing(hash)
+	}
+	return exists, nil
+}
+
+// CanDelete returns true if the blobs can be physically removed from the storage backend (e.g. BlobsFile can't)
+func (bs *BlobStore) CanDelete() bool {
+	return backend.SupportsDelete(bs.back)
+}
+
+// Delete removes the blob, a tombstone is kept so the blob won't be saved again (e.g. by a sync or a replication),
+// returns `backend.ErrDeleteNotSupported` (and keeps the blob) if the backend can't physically remove it
+func (bs *BlobStore) Delete(ctx context.Context, hash string) error {
+	_, fromHttp := ctxutil.Request(ctx)
+	bs.log.Info("OP Delete", "from_http", fromHttp, "hash", hash)
+
+	// Don't pretend the blob is gone if the data would stay on disk
+	if !bs.CanDelete() {
+		return backend.ErrDeleteNotSupported
+	}
+
+	// Only keep a tombstone once the data is gone, a blob that failed to be removed must not be reported as deleted
+	if err := bs.Remove(ctx, hash); err != nil {
+		return err
+	}
+
+	if err := bs.tombstones.Add(hash, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	// Wait for adding the blob to the S3 deletion queue if enabled
+	if bs.s3back != nil {
+		if err := bs.s3back.Delete(hash); err != nil {
+			return err
+		}
+	}
+
+	// Wait for subscribed event completion
+	if err := bs.hub.DeleteBlobEvent(ctx, &blob.Blob{Hash: hash}, nil); err != nil {
+		return err
+	}
+
+	bs.log.Debug("blob deleted", "hash", hash)
+	return nil
+}
+
+// Remove removes the blob from the storage backend without keeping a tombstone (the blob can be saved again),
+// returns `backend.ErrDeleteNotSupported` if the backend can't
+func (bs *BlobStore) Remove(ctx context.Context, hash string) error {
+	_, fromHttp := ctxutil.Request(ctx)
+	bs.log.Info("OP Remove", "from_http", fromHttp, "hash", hash)
+	if bs.cache != nil {
+		bs.cache.Remove(hash)
+	}
+	deleter, ok := bs.back.(backend.Deleter)
+	if !ok {
+		return backend.ErrDeleteNotSupported
+	}
+	return deleter.Delete(hash)
+}
+
+// Repair overwrites a blob (that failed the integrity check) with a known good copy, returns
+// `backend.ErrDeleteNotSupported` if the blob is still stored and the backend can't remove it (saving an existing blob
+// is a no-op, so the corrupted copy would be kept)
+func (bs *BlobStore) Repair(ctx context.Context, blob *blob.Blob) error {
+	_, fromHttp := ctxutil.Request(ctx)
+	bs.log.Info("OP Repair", "from_http", fromHttp, "hash", blob.Hash)
+
+	// Ensure the blob hash match the blob content
+	if err := blob.Check(); err != nil {
+		return err
+	}
+
+	// Remove the corrupted blob first
+	if err := bs.Remove(ctx, blob.Hash); err != nil {
+		if err != backend.ErrDeleteNotSupported {
+			return err
+		}
+		// Only a missing blob can be saved again
+		exists, err := bs.back.Exists(blob.Hash)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return backend.ErrDeleteNotSupported
+		}
+	}
+	if err := bs.back.Put(blob.Hash, blob.Data); err != nil {
+		return err
+	}
+	// A `Stat` may have cached the blob as missing while it was being replaced
+	if bs.cache != nil {
+		bs.cache.Remove(blob.Hash)
+	}
+	return nil
+}
+
+// Rebalance moves the blobs to their preferred disks, returns `ErrMultiDiskDisabled` if a single disk is used
+func (bs *BlobStore) Rebalance(ctx context.Context) (*multidisk.Report, error) {
+	if bs.multidisk == nil {
+		return nil, ErrMultiDiskDisabled
+	}
+	bs.log.Info("starting rebalance")
+	report, err := bs.multidisk.Rebalance(ctx)
+	if report != nil {
+		bs.log.Info("rebalance done", "blobs_count", report.BlobsCount, "copied", report.Copied, "removed", report.Removed, "failed", len(report.Failed), "duration", report.Duration)
+	}
+	return report, err
+}
+
+// S3Backend returns the S3 replication backend, or nil if the replication is disabled
+func (bs *BlobStore) S3Backend() *s3.S3Backend {
+	return bs.s3back
+}
+
+// Deleted returns true if the blob has been deleted
+func (bs *BlobStore) Deleted(hash string) (bool, error) {
+	_, deleted, err := bs.tombstones.Deleted(hash)
+	return deleted, err
 }
 
 // func (backend *BlobsFileBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, stop string, limit int) error {
 func (bs *BlobStore) Enumerate(ctx context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, error) {
-	return bs.enumerate(ctx, start, end, limit, false)
+	refs := []*blob.SizedBlobRef{}
+	if err := bs.iter(ctx, start, end, limit, false, func(ref *blob.SizedBlobRef) error {
+		refs = append(refs, ref)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// Iter calls `fn` for every blob between `start` and `end` (in lexicographical order, up to `limit` blobs if > 0)
+// without keeping the refs in memory, the iteration stops as soon as `fn` returns an error or `ctx` is canceled.
+func (bs *BlobStore) Iter(ctx context.Context, start, end string, limit int, fn func(*blob.SizedBlobRef) error) error {
+	return bs.iter(ctx, start, end, limit, false, fn)
 }
 
 func (bs *BlobStore) Scan(ctx context.Context) error {
-	_, err := bs.enumerate(ctx, "", "\xff", 0, true)
-	return err
+	return bs.iter(ctx, "", "\xff", 0, true, func(_ *blob.SizedBlobRef) error {
+		return nil
+	})
 }
 
-func (bs *BlobStore) enumerate(ctx context.Context, start, end string, limit int, scan bool) ([]*blob.SizedBlobRef, error) {
+func (bs *BlobStore) iter(ctx context.Context, start, end string, limit int, scan bool, fn func(*blob.SizedBlobRef) error) error {
 	_, fromHttp := ctxutil.Request(ctx)
 	bs.log.Info("OP Enumerate", "from_http", fromHttp, "start", start, "end", end, "limit", limit)
-	out := make(chan *blobsfile.Blob)
+	var cnt int
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Fetch the refs from the backend by batch
+		page, err := bs.enumerateBackend(start, end, iterBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, ref := range page {
+			// Skip the blobs that are only "logically" deleted
+			deleted, err := bs.Deleted(ref.Hash)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				continue
+			}
+			if scan {
+				fullblob, err := bs.get(ref.Hash, false)
+				if err != nil {
+					return err
+				}
+				if err := bs.hub.ScanBlobEvent(ctx, &blob.Blob{Hash: ref.Hash, Data: fullblob}, nil); err != nil {
+					return err
+				}
+			}
+			if err := fn(ref); err != nil {
+				return err
+			}
+			cnt++
+			if limit > 0 && cnt == limit {
+				return nil
+			}
+		}
+		if len(page) < iterBatchSize {
+			return nil
+		}
+		last := page[len(page)-1].Hash
+		next := nextHexKey(last)
+		if next <= last {
+			// The last possible hash was reached
+			return nil
+		}
+		start = next
+	}
+}
+
+func (bs *BlobStore) enumerateBackend(start, end string, limit int) ([]*blob.SizedBlobRef, error) {
+	out := make(chan *blob.SizedBlobRef)
 	refs := []*blob.SizedBlobRef{}
 	errc := make(chan error, 1)
 	go func() {
 		errc <- bs.back.Enumerate(out, start, end, limit)
 	}()
-	for cblob := range out {
-		if scan {
-			fullblob, err := bs.Get(ctx, cblob.Hash)
-			if err != nil {
-				return nil, err
-			}
-			if err := bs.hub.ScanBlobEvent(ctx, &blob.Blob{Hash: cblob.Hash, Data: fullblob}, nil); err != nil {
-				return nil, err
-			}
-		}
-		refs = append(refs, &blob.SizedBlobRef{Hash: cblob.Hash, Size: cblob.Size})
+	for ref := range out {
+		refs = append(refs, ref)
 	}
 	if err := <-errc; err != nil {
 		return nil, err
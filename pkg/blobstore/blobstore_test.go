@@ -0,0 +1,270 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+)
+
+// newTestBlobStore returns a BlobStore using the given backend in a temp dir, the options can update the config
+func newTestBlobStore(t *testing.T, backendName string, opts ...func(*config.Config)) (*BlobStore, string, func()) {
+	dir, err := ioutil.TempDir("", "blobstore_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{DataDir: dir, BlobStore: &config.BlobStoreConfig{Backend: backendName}}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	chub := hub.New(logger)
+	bs, err := New(logger, conf, chub)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return bs, dir, func() {
+		bs.Close()
+		chub.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// onDisk returns true if any file in dir contains data
+func onDisk(t *testing.T, dir string, data []byte) bool {
+	var found bool
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(content, data) {
+			found = true
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestDelete(t *testing.T) {
+	bs, dir, cleanup := newTestBlobStore(t, BackendBlobsDir)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := []byte("some content that must be erased")
+	b := blob.New(data)
+	if err := bs.Put(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk(t, dir, data) {
+		t.Fatalf("the blob should be on disk")
+	}
+	if err := bs.Delete(ctx, b.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk(t, dir, data) {
+		t.Errorf("the deleted blob data should be removed from disk")
+	}
+	if exists, err := bs.Stat(ctx, b.Hash); err != nil || exists {
+		t.Errorf("the deleted blob should not exist (err=%v)", err)
+	}
+	if err := bs.Put(ctx, b); err != ErrBlobDeleted {
+		t.Errorf("saving a deleted blob should fail with ErrBlobDeleted, got %v", err)
+	}
+}
+
+func TestDeleteNotSupported(t *testing.T) {
+	bs, _, cleanup := newTestBlobStore(t, BackendBlobsFile)
+	defer cleanup()
+	ctx := context.Background()
+
+	b := blob.New([]byte("append-only"))
+	if err := bs.Put(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Delete(ctx, b.Hash); err != backend.ErrDeleteNotSupported {
+		t.Fatalf("expected ErrDeleteNotSupported, got %v", err)
+	}
+	// Nothing was removed, so no tombstone is kept
+	deleted, err := bs.Deleted(b.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Errorf("the blob should not be marked as deleted")
+	}
+	if _, err := bs.Get(ctx, b.Hash); err != nil {
+		t.Errorf("the blob should still be readable: %v", err)
+	}
+}
+
+// failingDeleter is a backend that can't remove the blobs
+type failingDeleter struct {
+	backend.Backend
+}
+
+func (b *failingDeleter) Delete(hash string) error {
+	return fmt.Errorf("failed to remove %s", hash)
+}
+
+func TestDeleteFailure(t *testing.T) {
+	bs, _, cleanup := newTestBlobStore(t, BackendBlobsDir)
+	defer cleanup()
+	ctx := context.Background()
+	bs.back = &failingDeleter{bs.back}
+
+	b := blob.New([]byte("still stored"))
+	if err := bs.Put(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Delete(ctx, b.Hash); err == nil {
+		t.Fatalf("the deletion should have failed")
+	}
+	// The blob is still there, so it's not marked as deleted and can be saved again
+	deleted, err := bs.Deleted(b.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Errorf("the blob should not be marked as deleted")
+	}
+	if err := bs.Put(ctx, b); err != nil {
+		t.Errorf("the blob should be saved again, got %v", err)
+	}
+}
+
+func TestRepairNegativeCache(t *testing.T) {
+	bs, _, cleanup := newTestBlobStore(t, BackendBlobsDir, func(conf *config.Config) {
+		conf.BlobStore.CacheSize = 1
+	})
+	defer cleanup()
+	ctx := context.Background()
+
+	b := blob.New([]byte("repaired"))
+	if exists, err := bs.Stat(ctx, b.Hash); err != nil || exists {
+		t.Fatalf("the blob should be missing (err=%v)", err)
+	}
+	if err := bs.Repair(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := bs.Stat(ctx, b.Hash); err != nil || !exists {
+		t.Errorf("the repaired blob should exist (err=%v)", err)
+	}
+}
+
+func TestRepairNotSupported(t *testing.T) {
+	bs, _, cleanup := newTestBlobStore(t, BackendBlobsFile)
+	defer cleanup()
+	ctx := context.Background()
+
+	// The stored copy can't be replaced
+	b := blob.New([]byte("append-only"))
+	if err := bs.Put(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Repair(ctx, b); err != backend.ErrDeleteNotSupported {
+		t.Errorf("expected ErrDeleteNotSupported, got %v", err)
+	}
+
+	// But a missing blob can be saved
+	missing := blob.New([]byte("missing"))
+	if err := bs.Repair(ctx, missing); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetLocal(ctx, missing.Hash); err != nil {
+		t.Errorf("the missing blob should have been saved: %v", err)
+	}
+}
+
+// putBlobs saves n blobs, and returns their sorted hashes
+func putBlobs(t *testing.T, bs *BlobStore, n int) []string {
+	t.Helper()
+	var hashes []string
+	for i := 0; i < n; i++ {
+		b := blob.New([]byte(fmt.Sprintf("blob %d", i)))
+		if err := bs.Put(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, b.Hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func TestIter(t *testing.T) {
+	// Iterate over several pages
+	defer func(size int) { iterBatchSize = size }(iterBatchSize)
+	iterBatchSize = 3
+
+	for _, backendName := range []string{BackendBlobsDir, BackendBlobsFile} {
+		bs, _, cleanup := newTestBlobStore(t, backendName)
+		hashes := putBlobs(t, bs, 10)
+		ctx := context.Background()
+
+		iter := func(start, end string, limit int) []string {
+			var out []string
+			if err := bs.Iter(ctx, start, end, limit, func(ref *blob.SizedBlobRef) error {
+				out = append(out, ref.Hash)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			return out
+		}
+		for _, tc := range []struct {
+			start, end string
+			limit      int
+			expected   []string
+		}{
+			{"", "\xff", 0, hashes},
+			{"", "\xff", 4, hashes[:4]},
+			{"", "\xff", 3, hashes[:3]},
+			{hashes[2], hashes[8], 0, hashes[2:9]},
+			{hashes[2], "\xff", 5, hashes[2:7]},
+			{nextHexKey(hashes[9]), "\xff", 0, nil},
+		} {
+			if out := iter(tc.start, tc.end, tc.limit); fmt.Sprintf("%v", out) != fmt.Sprintf("%v", tc.expected) {
+				t.Errorf("%s: bad refs for start=%q end=%q limit=%d, expected %v, got %v", backendName, tc.start, tc.end, tc.limit, tc.expected, out)
+			}
+		}
+
+		// The iteration stops on the first error
+		errStop := fmt.Errorf("stop")
+		var cnt int
+		if err := bs.Iter(ctx, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+			cnt++
+			if cnt == 5 {
+				return errStop
+			}
+			return nil
+		}); err != errStop || cnt != 5 {
+			t.Errorf("%s: expected the iteration to stop after 5 refs, got %d (err=%v)", backendName, cnt, err)
+		}
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := bs.Iter(cctx, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+			return nil
+		}); err != context.Canceled {
+			t.Errorf("%s: expected context.Canceled, got %v", backendName, err)
+		}
+		cleanup()
+	}
+}
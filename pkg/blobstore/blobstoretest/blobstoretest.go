@@ -0,0 +1,74 @@
+/*
+
+Package blobstoretest provides a temporary BlobStore (along with the hub and the meta handler) for the tests.
+
+*/
+package blobstoretest // import "a4.io/blobstash/pkg/blobstore/blobstoretest"
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+)
+
+// Env holds the apps backing a test BlobStore
+type Env struct {
+	Dir       string // the data dir
+	Conf      *config.Config
+	Logger    log.Logger
+	Hub       *hub.Hub
+	BlobStore *blobstore.BlobStore
+	Meta      *meta.Meta
+}
+
+// New initializes a BlobStore (using the blobsdir backend) in a temp dir, the options can update the config before the
+// apps are initialized, the returned func closes the apps and removes the dir
+func New(t testing.TB, opts ...func(*config.Config)) (*Env, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "blobstoretest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{DataDir: dir, BlobStore: &config.BlobStoreConfig{Backend: blobstore.BackendBlobsDir}}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	env := &Env{Dir: dir, Conf: conf, Logger: logger, Hub: hub.New(logger)}
+	cleanup := func() {
+		// Stop the async subscribers first
+		env.Hub.Close()
+		if env.Meta != nil {
+			env.Meta.Close()
+		}
+		if env.BlobStore != nil {
+			env.BlobStore.Close()
+		}
+		os.RemoveAll(dir)
+	}
+	if env.BlobStore, err = blobstore.New(logger, conf, env.Hub); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if env.Meta, err = meta.New(logger, conf, env.BlobStore, env.Hub); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return env, cleanup
+}
+
+// Check fails the test if err is not nil
+func Check(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,12 +3,16 @@ package blobstore
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"golang.org/x/net/context"
 
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/backend/multidisk"
 	mblob "a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/client/clientutil"
 	"a4.io/blobstash/pkg/ctxutil"
@@ -19,14 +23,83 @@ import (
 func (bs *BlobStore) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	r.Handle("/blobs", basicAuth(http.HandlerFunc(bs.enumerateHandler())))
 	r.Handle("/upload", basicAuth(http.HandlerFunc(bs.uploadHandler())))
+	r.Handle("/exists", basicAuth(http.HandlerFunc(bs.existsHandler())))
 	r.Handle("/blob/{hash}", basicAuth(http.HandlerFunc(bs.blobHandler())))
+	r.Handle("/cache", basicAuth(http.HandlerFunc(bs.cacheHandler())))
+	r.Handle("/rebalance", basicAuth(http.HandlerFunc(bs.rebalanceReportHandler())))
+	r.Handle("/_rebalance", basicAuth(http.HandlerFunc(bs.rebalanceHandler())))
 }
 
-func (bs *BlobStore) uploadHandler() func(http.ResponseWriter, *http.Request) {
+// rebalanceReportHandler returns the last rebalance report
+func (bs *BlobStore) rebalanceReportHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if bs.multidisk == nil {
+				httputil.WriteJSONError(w, http.StatusNotFound, ErrMultiDiskDisabled.Error())
+				return
+			}
+			report, running := bs.multidisk.LastReport()
+			httputil.WriteJSON(w, map[string]interface{}{
+				"running":        running,
+				"last_report":    report,
+				"layout_changed": bs.multidisk.LayoutChanged(),
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (bs *BlobStore) rebalanceHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if bs.multidisk == nil {
+				httputil.WriteJSONError(w, http.StatusNotFound, ErrMultiDiskDisabled.Error())
+				return
+			}
+			if _, running := bs.multidisk.LastReport(); running {
+				httputil.WriteJSONError(w, http.StatusConflict, multidisk.ErrAlreadyRunning.Error())
+				return
+			}
+			// The result will be available in the report
+			go func() {
+				if _, err := bs.Rebalance(context.Background()); err != nil {
+					bs.log.Error("rebalance failed", "err", err)
+				}
+			}()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// cacheHandler returns the hot blobs cache metrics
+func (bs *BlobStore) cacheHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
-			// FIXME(tsileo): download the content from r.URL.Query().Get("url") and upload it, returns its ref
+			stats := bs.CacheStats()
+			if stats == nil {
+				httputil.WriteJSONError(w, http.StatusNotFound, "cache disabled")
+				return
+			}
+			httputil.WriteJSON(w, stats)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// The maximum size of an uploaded blob (the biggest chunk created by the filetree chunker is 8MB)
+const maxBlobSize = 16 << 20
+
+func (bs *BlobStore) uploadHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The content of an URL can be uploaded using the filetree `/fetch` endpoint
+		switch r.Method {
 		//POST takes the uploaded file(s) and saves it to disk.
 		case "POST":
 			ctx := ctxutil.WithRequest(context.Background(), r)
@@ -52,17 +125,37 @@ func (bs *BlobStore) uploadHandler() func(http.ResponseWriter, *http.Request) {
 					return
 				}
 				hash := part.FormName()
+				// Hash the blob (using the algorithm of the ref) while reading the part, and don't buffer more than
+				// `maxBlobSize`
+				h, err := hashutil.NewHasherFor(hash)
+				if err != nil {
+					httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid hash \"%s\"", hash))
+					return
+				}
 				var buf bytes.Buffer
-				buf.ReadFrom(part)
+				n, err := io.Copy(io.MultiWriter(&buf, h), io.LimitReader(part, maxBlobSize+1))
+				if err != nil {
+					httputil.Error(w, err)
+					return
+				}
+				if n > maxBlobSize {
+					httputil.WriteJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("blob %s is too large", hash))
+					return
+				}
 				blob := buf.Bytes()
-				chash := hashutil.Compute(blob)
+				chash := h.Ref()
 				if hash != chash {
-					httputil.WriteJSONError(w, http.StatusInternalServerError, "blob corrupted, hash does not match, expected "+chash)
+					httputil.WriteJSONError(w, http.StatusBadRequest, "blob corrupted, hash does not match, expected "+chash)
 					return
 				}
 				b := &mblob.Blob{Hash: hash, Data: blob}
 				if err := bs.Put(ctx, b); err != nil {
+					if err == ErrBlobDeleted {
+						httputil.WriteJSONError(w, http.StatusGone, err.Error())
+						return
+					}
 					httputil.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+					return
 				}
 			}
 			// XXX(tsileo): returns a `http.StatusNoContent` here?
@@ -72,6 +165,53 @@ func (bs *BlobStore) uploadHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// The maximum number of hashes that can be checked in a single request
+const maxExistsHashes = 10000
+
+// ExistsRequest is the payload of the batch existence check endpoint
+type ExistsRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+// ExistsResponse contains the existence of each requested hash
+type ExistsResponse struct {
+	Exists map[string]bool `json:"exists"`
+}
+
+func (bs *BlobStore) existsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			ctx := ctxutil.WithRequest(context.Background(), r)
+
+			req := &ExistsRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "invalid JSON payload")
+				return
+			}
+			if len(req.Hashes) > maxExistsHashes {
+				httputil.WriteJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("too many hashes (max %d)", maxExistsHashes))
+				return
+			}
+			for _, hash := range req.Hashes {
+				if _, err := hex.DecodeString(hash); err != nil {
+					httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid hash %q", hash))
+					return
+				}
+			}
+
+			exists, err := bs.StatMany(ctx, req.Hashes)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, &ExistsResponse{Exists: exists})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
 func (bs *BlobStore) blobHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := ctxutil.WithRequest(context.Background(), r)
@@ -106,6 +246,17 @@ func (bs *BlobStore) blobHandler() func(http.ResponseWriter, *http.Request) {
 			}
 			httputil.WriteJSONError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
 			return
+		case "DELETE":
+			if err := bs.Delete(ctx, vars["hash"]); err != nil {
+				if err == backend.ErrDeleteNotSupported {
+					httputil.WriteJSONError(w, http.StatusNotImplemented, err.Error())
+					return
+				}
+				httputil.Error(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
@@ -136,6 +287,27 @@ func (bs *BlobStore) enumerateHandler() func(http.ResponseWriter, *http.Request)
 		case "GET":
 			q := httputil.NewQuery(r.URL.Query())
 			end := q.GetDefault("end", "\xff")
+
+			// Stream all the refs (as newline-delimited JSON) if requested
+			if q.Get("format") == "ndjson" || r.Header.Get("Accept") == "application/x-ndjson" {
+				limit, err := q.GetIntDefault("limit", 0)
+				if err != nil {
+					httputil.Error(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				srw := httputil.NewSnappyResponseWriter(w, r)
+				defer srw.Close()
+				enc := json.NewEncoder(srw)
+				if err := bs.Iter(ctxutil.WithRequest(r.Context(), r), q.Get("start"), end, limit, func(ref *mblob.SizedBlobRef) error {
+					return enc.Encode(ref)
+				}); err != nil {
+					// The headers are already sent
+					bs.log.Error("failed to stream the refs", "err", err)
+				}
+				return
+			}
+
 			limit, err := q.GetInt("limit", 50, 1000)
 			if err != nil {
 				httputil.Error(w, err)
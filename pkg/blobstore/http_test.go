@@ -0,0 +1,228 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+)
+
+func TestNextHexKey(t *testing.T) {
+	for key, expected := range map[string]string{
+		"00":   "01",
+		"0aff": "0b00",
+		"00ff": "0100",
+		"ffff": "0000",
+	} {
+		if next := nextHexKey(key); next != expected {
+			t.Errorf("expected %s after %s, got %s", expected, key, next)
+		}
+	}
+}
+
+func TestEnumerateNDJSON(t *testing.T) {
+	defer func(size int) { iterBatchSize = size }(iterBatchSize)
+	iterBatchSize = 3
+
+	bs, _, cleanup := newTestBlobStore(t, BackendBlobsDir)
+	defer cleanup()
+	hashes := putBlobs(t, bs, 10)
+
+	// enumerate returns the refs streamed by the handler, one JSON object per line
+	enumerate := func(query, accept string) []string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/blobs?"+query, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		bs.enumerateHandler()(w, r)
+		if w.Code != 200 || w.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		body := w.Body.String()
+		if body != "" && !strings.HasSuffix(body, "\n") {
+			t.Errorf("the last ref should end with a newline")
+		}
+		var out []string
+		scanner := bufio.NewScanner(strings.NewReader(body))
+		for scanner.Scan() {
+			ref := &blob.SizedBlobRef{}
+			if err := json.Unmarshal(scanner.Bytes(), ref); err != nil {
+				t.Fatalf("bad line %q: %v", scanner.Text(), err)
+			}
+			if ref.Size == 0 {
+				t.Errorf("missing size for %s", ref.Hash)
+			}
+			out = append(out, ref.Hash)
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		query, accept string
+		expected      []string
+	}{
+		{"format=ndjson", "", hashes},
+		{"", "application/x-ndjson", hashes},
+		{"format=ndjson&limit=4", "", hashes[:4]},
+		{"format=ndjson&start=" + hashes[5], "", hashes[5:]},
+		{"format=ndjson&start=" + hashes[1] + "&end=" + hashes[3], "", hashes[1:4]},
+		{"format=ndjson&start=" + nextHexKey(hashes[9]), "", nil},
+	} {
+		out := enumerate(tc.query, tc.accept)
+		if strings.Join(out, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("bad refs for %q, expected %v, got %v", tc.query, tc.expected, out)
+		}
+	}
+
+	// The JSON mode is still paginated
+	w := httptest.NewRecorder()
+	bs.enumerateHandler()(w, httptest.NewRequest("GET", "/blobs?limit=4", nil))
+	resp := struct {
+		Refs   []*blob.SizedBlobRef `json:"refs"`
+		Cursor string               `json:"cursor"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Refs) != 4 || resp.Cursor != nextHexKey(hashes[3]) {
+		t.Errorf("unexpected page %+v", resp)
+	}
+}
+
+func TestExists(t *testing.T) {
+	bs, _, cleanup := newTestBlobStore(t, BackendBlobsDir)
+	defer cleanup()
+	hashes := putBlobs(t, bs, 2)
+	missing := blob.New([]byte("missing")).Hash
+
+	exists := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		bs.existsHandler()(w, httptest.NewRequest(method, "/exists", strings.NewReader(body)))
+		return w
+	}
+
+	w := exists("POST", `{"hashes": ["`+hashes[0]+`", "`+hashes[1]+`", "`+missing+`"]}`)
+	resp := &ExistsResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || len(resp.Exists) != 3 || !resp.Exists[hashes[0]] || !resp.Exists[hashes[1]] || resp.Exists[missing] {
+		t.Errorf("unexpected response %d %+v", w.Code, resp)
+	}
+
+	tooMany, err := json.Marshal(&ExistsRequest{Hashes: make([]string, maxExistsHashes+1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		method, body string
+		status       int
+	}{
+		{"POST", `{"hashes": []}`, http.StatusOK},
+		{"POST", `{"hashes": [`, http.StatusBadRequest},
+		{"POST", `{"hashes": ["nothex"]}`, http.StatusBadRequest},
+		{"POST", string(tooMany), http.StatusRequestEntityTooLarge},
+		{"GET", "", http.StatusMethodNotAllowed},
+	} {
+		if w := exists(tc.method, tc.body); w.Code != tc.status {
+			t.Errorf("expected a %d for %s %.40q, got %d", tc.status, tc.method, tc.body, w.Code)
+		}
+	}
+}
+
+// upload posts the given parts (form name => content) to the upload handler
+func upload(t *testing.T, bs *BlobStore, parts map[string][]byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, data := range parts {
+		part, err := mw.CreateFormFile(name, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/upload", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	bs.uploadHandler()(w, r)
+	return w
+}
+
+func TestUpload(t *testing.T) {
+	bs, _, cleanup := newTestBlobStore(t, BackendBlobsDir)
+	defer cleanup()
+	ctx := context.Background()
+	stat := func(hash string) bool {
+		exists, err := bs.Stat(ctx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	b1, b2 := blob.New([]byte("blob 1")), blob.New([]byte("blob 2"))
+	if w := upload(t, bs, map[string][]byte{b1.Hash: b1.Data, b2.Hash: b2.Data}); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if !stat(b1.Hash) || !stat(b2.Hash) {
+		t.Errorf("the blobs should have been saved")
+	}
+
+	// The blob is not saved if the hash doesn't match, and the upload fails with a 400 (even with valid blobs)
+	corrupted := blob.New([]byte("corrupted"))
+	valid := blob.New([]byte("valid"))
+	if w := upload(t, bs, map[string][]byte{corrupted.Hash: []byte("not the content")}); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "hash does not match") {
+		t.Errorf("a corrupted blob should be rejected with a 400, got %d %s", w.Code, w.Body.String())
+	}
+	if stat(corrupted.Hash) {
+		t.Errorf("the corrupted blob should not have been saved")
+	}
+	if w := upload(t, bs, map[string][]byte{valid.Hash: []byte("valid"), blob.New([]byte("other")).Hash: []byte("not other")}); w.Code != http.StatusBadRequest {
+		t.Errorf("an upload with a corrupted blob should be rejected with a 400, got %d", w.Code)
+	}
+
+	// The upload stops once `maxBlobSize` is reached
+	big := blob.New(make([]byte, maxBlobSize+1))
+	if w := upload(t, bs, map[string][]byte{big.Hash: big.Data}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a blob over maxBlobSize should be rejected, got %d", w.Code)
+	}
+	if stat(big.Hash) {
+		t.Errorf("the big blob should not have been saved")
+	}
+	max := blob.New(make([]byte, maxBlobSize))
+	if w := upload(t, bs, map[string][]byte{max.Hash: max.Data}); w.Code != http.StatusOK || !stat(max.Hash) {
+		t.Errorf("a blob of maxBlobSize should be saved, got %d", w.Code)
+	}
+
+	if w := upload(t, bs, map[string][]byte{"nothex": []byte("data")}); w.Code != http.StatusBadRequest {
+		t.Errorf("an invalid hash should return a 400, got %d", w.Code)
+	}
+
+	// A deleted blob can't be uploaded again
+	if err := bs.Delete(ctx, b1.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if w := upload(t, bs, map[string][]byte{b1.Hash: b1.Data}); w.Code != http.StatusGone {
+		t.Errorf("a deleted blob should return a 410, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	bs.uploadHandler()(w, httptest.NewRequest("GET", "/upload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected a 405, got %d", w.Code)
+	}
+}
@@ -0,0 +1,80 @@
+// +build integration
+
+package blobstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/backend/s3/s3test"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestReadThrough(t *testing.T) {
+	var srv *s3test.Server
+	var closeFunc func()
+	bs, _, cleanup := newTestBlobStore(t, BackendBlobsDir, func(conf *config.Config) {
+		conf.S3Repl, srv, closeFunc = s3test.New(t, conf.DataDir)
+		conf.S3Repl.ReadThrough = true
+		conf.S3Repl.CacheLocal = true
+	})
+	defer closeFunc()
+	defer cleanup()
+	ctx := context.Background()
+
+	// Upload a blob to the bucket
+	b := blob.New([]byte("only in the bucket"))
+	if err := bs.Put(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.S3Backend().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		status, err := bs.S3Backend().Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.UploadedCount == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if exists, err := bs.S3Backend().Exists(b.Hash); err != nil || !exists {
+		t.Fatalf("the blob should have been uploaded (err=%v)", err)
+	}
+
+	// Remove the local copy, the blob must be fetched from the bucket, and saved locally (`cache_local`)
+	if err := bs.back.(backend.Deleter).Delete(b.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetLocal(ctx, b.Hash); err != clientutil.ErrBlobNotFound {
+		t.Errorf("GetLocal should not read through, got %v", err)
+	}
+	data, err := bs.GetNoCache(ctx, b.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(b.Data) {
+		t.Errorf("bad blob, got %q", data)
+	}
+	if data, err := bs.back.Get(b.Hash); err != nil || string(data) != string(b.Data) {
+		t.Errorf("the blob should have been saved locally (err=%v)", err)
+	}
+
+	// A miss must be answered from the index, without listing the bucket
+	lists := 0
+	if srv != nil {
+		lists = srv.Lists()
+	}
+	if _, err := bs.GetNoCache(ctx, blob.New([]byte("missing")).Hash); err != clientutil.ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+	if srv != nil && srv.Lists() != lists {
+		t.Errorf("the bucket should not be listed on a miss")
+	}
+}
@@ -0,0 +1,79 @@
+/*
+
+Package tombstone implements a disk-backed index of deleted blobs.
+
+A tombstone prevents a deleted blob from being saved again (e.g. by a sync or a replication), it stores the deletion time.
+
+*/
+package tombstone // import "a4.io/blobstash/pkg/blobstore/tombstone"
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cznic/kv"
+)
+
+// Tombstones holds the deleted blobs hashes
+type Tombstones struct {
+	db   *kv.DB
+	path string
+	sync.Mutex
+}
+
+// New creates a new database.
+func New(path string) (*Tombstones, error) {
+	createOpen := kv.Open
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		createOpen = kv.Create
+	}
+
+	kvdb, err := createOpen(path, &kv.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tombstones{
+		db:   kvdb,
+		path: path,
+	}, nil
+}
+
+// Close the underlying db file.
+func (t *Tombstones) Close() error {
+	return t.db.Close()
+}
+
+// Add records the deletion of the given blob
+func (t *Tombstones) Add(hash string, deleted time.Time) error {
+	t.Lock()
+	defer t.Unlock()
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(deleted.UnixNano()))
+	return t.db.Set(bhash, v)
+}
+
+// Deleted returns the deletion time if the blob has been deleted
+func (t *Tombstones) Deleted(hash string) (time.Time, bool, error) {
+	t.Lock()
+	defer t.Unlock()
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	v, err := t.db.Get(nil, bhash)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if v == nil || len(v) != 8 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v))), true, nil
+}
@@ -0,0 +1,41 @@
+package tombstone
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	ts, err := New("tombstones_test")
+	defer func() {
+		ts.Close()
+		os.Remove("tombstones_test")
+	}()
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	h := "c0f1480a26c2fd4deb8e738a52b7530ed111b9bcd17bbb09259ce03f12998800"
+	h2 := "c0f1480a26c2fd4deb8e738a52b7530ed111b9bcd17bbb09259ce03f129988c5"
+	now := time.Now()
+	check(ts.Add(h, now))
+	deletedAt, ok, err := ts.Deleted(h)
+	check(err)
+	if !ok {
+		t.Errorf("h \"%s\" should be deleted", h)
+	}
+	if !deletedAt.Equal(time.Unix(0, now.UnixNano())) {
+		t.Errorf("bad deletion time, expected %v, got %v", now, deletedAt)
+	}
+	_, ok2, err := ts.Deleted(h2)
+	check(err)
+	if ok2 {
+		t.Errorf("h \"%s\" should not be deleted", h2)
+	}
+}
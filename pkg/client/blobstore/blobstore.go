@@ -3,6 +3,7 @@ package blobstore // import "a4.io/blobstash/pkg/client/blobstore"
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
@@ -13,6 +14,9 @@ import (
 var defaultServerAddr = "http://localhost:8050"
 var defaultUserAgent = "BlobStore Go client v1"
 
+// The maximum number of hashes the server accepts in a single `/exists` request
+var maxStatManyHashes = 10000
+
 type BlobStore struct {
 	client *clientutil.Client
 }
@@ -82,6 +86,56 @@ func (bs *BlobStore) Stat(hash string) (bool, error) {
 	}
 }
 
+// StatMany checks the existence of multiple blobs (by batch of `maxStatManyHashes`), returns a map hash => exists
+func (bs *BlobStore) StatMany(hashes []string) (map[string]bool, error) {
+	res := make(map[string]bool, len(hashes))
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > maxStatManyHashes {
+			n = maxStatManyHashes
+		}
+		exists, err := bs.statMany(hashes[:n])
+		if err != nil {
+			return nil, err
+		}
+		for hash, ok := range exists {
+			res[hash] = ok
+		}
+		hashes = hashes[n:]
+	}
+	return res, nil
+}
+
+// statMany checks the existence of the given blobs in a single request
+func (bs *BlobStore) statMany(hashes []string) (map[string]bool, error) {
+	js, err := json.Marshal(map[string]interface{}{"hashes": hashes})
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	resp, err := bs.client.DoReq("POST", "/api/blobstore/exists", headers, bytes.NewReader(js))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == 200:
+		res := struct {
+			Exists map[string]bool `json:"exists"`
+		}{}
+		if err := json.Unmarshal(body, &res); err != nil {
+			return nil, err
+		}
+		return res.Exists, nil
+	default:
+		return nil, fmt.Errorf("failed to stat blobs status %d: %v", resp.StatusCode, string(body))
+	}
+}
+
 func (bs *BlobStore) Put(hash string, blob []byte) error {
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
@@ -109,4 +163,23 @@ func (bs *BlobStore) Put(hash string, blob []byte) error {
 	}
 }
 
+// Delete removes the blob (a tombstone is kept on the server)
+func (bs *BlobStore) Delete(hash string) error {
+	resp, err := bs.client.DoReq("DELETE", fmt.Sprintf("/api/blobstore/blob/%s", hash), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case 204:
+		return nil
+	default:
+		return fmt.Errorf("failed to delete blob %v: %v", hash, string(body))
+	}
+}
+
 // TODO(tsileo): add Enumerate and all other methods from the other client
@@ -0,0 +1,81 @@
+package blobstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"a4.io/blobstash/pkg/client/clientutil"
+)
+
+func TestStatMany(t *testing.T) {
+	defer func(max int) { maxStatManyHashes = max }(maxStatManyHashes)
+	maxStatManyHashes = 3
+
+	// Only the even hashes exist, and the requests are limited to `maxStatManyHashes` like on the server
+	var mu sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/blobstore/exists" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		req := struct {
+			Hashes []string `json:"hashes"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(req.Hashes) > maxStatManyHashes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		exists := map[string]bool{}
+		for _, hash := range req.Hashes {
+			var i int
+			fmt.Sscanf(hash, "%x", &i)
+			exists[hash] = i%2 == 0
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"exists": exists})
+	}))
+	defer srv.Close()
+
+	bs := New(&clientutil.Opts{Host: srv.URL})
+	var hashes []string
+	for i := 0; i < 8; i++ {
+		hashes = append(hashes, fmt.Sprintf("%02x", i))
+	}
+	exists, err := bs.StatMany(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exists) != len(hashes) {
+		t.Errorf("expected %d results, got %v", len(hashes), exists)
+	}
+	for i, hash := range hashes {
+		if exists[hash] != (i%2 == 0) {
+			t.Errorf("bad result for %s: %v", hash, exists[hash])
+		}
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+
+	// No request if there's nothing to check
+	exists, err = bs.StatMany(nil)
+	if err != nil || len(exists) != 0 || requests != 3 {
+		t.Errorf("unexpected result %v (err=%v, %d requests)", exists, err, requests)
+	}
+
+	// The errors are returned
+	if _, err := New(&clientutil.Opts{Host: srv.URL + "/nope"}).StatMany(hashes); err == nil {
+		t.Errorf("a failed request should return an error")
+	}
+}
@@ -34,6 +34,65 @@ type S3Repl struct {
 	Bucket  string `yaml:"bucket"`
 	Region  string `yaml:"region"`
 	KeyFile string `yaml:"key_file"`
+
+	OldKeyFiles []string `yaml:"old_key_files"` // Rotated keys, only used to decrypt the blobs sealed before the rotation
+
+	ReadThrough bool `yaml:"read_through"` // Fetch the blobs missing locally from the bucket
+	CacheLocal  bool `yaml:"cache_local"`  // Save the blobs fetched from the bucket locally (when `read_through` is enabled)
+
+	// S3-compatible services (MinIO...)
+	Endpoint        string `yaml:"endpoint"`      // Custom endpoint URL, e.g. "http://localhost:9000"
+	PathStyle       bool   `yaml:"path_style"`    // Use path-style addressing ("<endpoint>/<bucket>/<key>")
+	AccessKeyID     string `yaml:"access_key_id"` // Static credentials (the default AWS credentials chain is used if empty)
+	SecretAccessKey string `yaml:"secret_access_key"`
+	DisableSSL      bool   `yaml:"disable_ssl"`
+
+	// TLS options
+	CACertFile         string `yaml:"tls_ca_cert_file"` // PEM-encoded CA certificates to trust (e.g. for a self-signed MinIO)
+	InsecureSkipVerify bool   `yaml:"tls_insecure_skip_verify"`
+}
+
+// BlobStoreConfig holds the BlobStore configuration items
+type BlobStoreConfig struct {
+	Backend     string `yaml:"backend"`     // Storage backend, either "blobsfile" (default) or "blobsdir"
+	Compression string `yaml:"compression"` // Compression at rest, either "none" (default) or "snappy"
+	KeyFile     string `yaml:"key_file"`    // Enable the encryption at rest with the given (32 bytes) key
+	CacheSize   int    `yaml:"cache_size"`  // Size (in MB) of the in-memory hot blobs cache, disabled if 0
+
+	// Spread the blobs across several directories (one per disk), each blob is stored `replicas` times (2 by default)
+	Disks    []string `yaml:"disks"`
+	Replicas int      `yaml:"replicas"`
+}
+
+// Key returns the key used for the encryption at rest, or nil if encryption is disabled
+func (bsc *BlobStoreConfig) Key() (*[32]byte, error) {
+	return readKey(bsc.KeyFile)
+}
+
+// ScrubberConfig holds the integrity scrubber configuration
+type ScrubberConfig struct {
+	Interval string `yaml:"interval"` // Run the scrubber periodically (e.g. "24h"), can only be triggered manually if empty
+}
+
+// FetchConfig holds the configuration of the filetree URL fetching
+type FetchConfig struct {
+	MaxSize int `yaml:"max_size"` // Max size (in MB) of a fetched file (1024 by default)
+
+	// Allow fetching the loopback, private and link-local addresses (e.g. the cloud metadata endpoint), blocked by default
+	AllowPrivateNetworks bool `yaml:"allow_private_networks"`
+}
+
+// Webhook holds an outbound webhook configuration
+type Webhook struct {
+	Name   string   `yaml:"name"`
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"` // Key used to sign the payloads (HMAC-SHA256), not signed if empty
+	Events []string `yaml:"events"` // "new_blob", "delete_blob", "kv" and/or "docstore"
+
+	KeyPrefix   string   `yaml:"key_prefix"`  // Only send the "kv" events for the keys starting with this prefix
+	Collections []string `yaml:"collections"` // Only send the "docstore" events of these collections (all if empty)
+
+	MaxAttempts int `yaml:"max_attempts"` // Delivery attempts before giving up on an event (5 by default)
 }
 
 type Replication struct {
@@ -46,11 +105,28 @@ type ReplicateFrom struct {
 }
 
 func (s3 *S3Repl) Key() (*[32]byte, error) {
-	if s3.KeyFile == "" {
+	return readKey(s3.KeyFile)
+}
+
+// OldKeys returns the rotated keys
+func (s3 *S3Repl) OldKeys() ([]*[32]byte, error) {
+	var keys []*[32]byte
+	for _, path := range s3.OldKeyFiles {
+		key, err := readKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func readKey(path string) (*[32]byte, error) {
+	if path == "" {
 		return nil, nil
 	}
 	var out [32]byte
-	data, err := ioutil.ReadFile(s3.KeyFile)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -72,10 +148,15 @@ type Config struct {
 	DataDir    string  `yaml:"data_dir"`
 	S3Repl     *S3Repl `yaml:"s3_replication"`
 
+	BlobStore *BlobStoreConfig `yaml:"blobstore"`
+	Scrubber  *ScrubberConfig  `yaml:"scrubber"`
+	Fetch     *FetchConfig     `yaml:"filetree_fetch"`
+
 	Apps          []*AppConfig    `yaml:"apps"`
 	Docstore      *DocstoreConfig `yaml:"docstore"`
 	Replication   *Replication    `yaml:"replication"`
 	ReplicateFrom *ReplicateFrom  `yaml:"replicate_from"`
+	Webhooks      []*Webhook      `yaml:"webhooks"`
 
 	// Items defined with the CLI flags
 	ScanMode      bool `yaml:"-"`
@@ -0,0 +1,257 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"a4.io/blobstash/pkg/config"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// Timeout for fetching an URL (including reading the body)
+const fetchTimeout = 10 * time.Minute
+
+// Default max size (in MB) of a fetched file
+const defaultFetchMaxSize = 1024
+
+// blockedNets can't be fetched unless `allow_private_networks` is set (loopback, private and link-local networks)
+var blockedNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		blockedNets = append(blockedNets, ipnet)
+	}
+}
+
+func blockedIP(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, ipnet := range blockedNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetcher holds the HTTP client used to fetch the URLs
+type fetcher struct {
+	client  *http.Client
+	maxSize int64
+}
+
+// newFetcher initializes the fetcher, the addresses are checked when dialing (i.e. after the DNS resolution), so
+// redirects can't reach a blocked address either
+func newFetcher(conf *config.FetchConfig) *fetcher {
+	if conf == nil {
+		conf = &config.FetchConfig{}
+	}
+	maxSize := conf.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultFetchMaxSize
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second}
+	if conf.AllowPrivateNetworks {
+		transport.Proxy = http.ProxyFromEnvironment
+	} else {
+		// No proxy as it would dial the blocked addresses itself
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				if blockedIP(ip.IP) {
+					return nil, &fetchError{fmt.Errorf("%s resolves to a blocked address (%s)", host, ip.IP), http.StatusForbidden}
+				}
+			}
+			// Dial the checked address, a second lookup could return a different one
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+		}
+	}
+
+	return &fetcher{
+		client:  &http.Client{Timeout: fetchTimeout, Transport: transport},
+		maxSize: int64(maxSize) << 20,
+	}
+}
+
+// fetchError implements `httputil.PublicErrorer`, the status depends on whether the URL is invalid or the remote
+// server failed
+type fetchError struct {
+	err    error
+	status int
+}
+
+func (e *fetchError) Error() string { return e.err.Error() }
+func (e *fetchError) Status() int   { return e.status }
+
+func badURL(msg string, args ...interface{}) error {
+	return &fetchError{fmt.Errorf(msg, args...), http.StatusBadRequest}
+}
+
+func badGateway(msg string, args ...interface{}) error {
+	return &fetchError{fmt.Errorf(msg, args...), http.StatusBadGateway}
+}
+
+func tooLarge(max int64) error {
+	return &fetchError{fmt.Errorf("the content exceeds the max size (%d bytes)", max), http.StatusRequestEntityTooLarge}
+}
+
+// limitedBody fails the upload once the limit is exceeded (the limit is set to max size + 1)
+type limitedBody struct {
+	io.LimitedReader
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.N <= 0 {
+		return 0, errors.New("max size exceeded")
+	}
+	return b.LimitedReader.Read(p)
+}
+
+// FetchRequest is the payload of the fetch endpoint
+type FetchRequest struct {
+	URL      string                 `json:"url"`
+	Name     string                 `json:"name,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// Fetch downloads the content of the URL and saves it as a new file node (outside of any FS), the origin (URL, fetch
+// time and content type) is stored in the node metadata
+func (ft *FileTreeExt) Fetch(ctx context.Context, rawurl, name string, data map[string]interface{}) (*rnode.RawNode, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, badURL("invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, badURL("unsupported URL scheme \"%s\"", u.Scheme)
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := ft.fetcher.client.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			if ferr, ok := uerr.Err.(*fetchError); ok {
+				// A blocked address
+				return nil, ferr
+			}
+		}
+		return nil, badGateway("failed to fetch %s: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, badGateway("failed to fetch %s: %s", u, resp.Status)
+	}
+	if resp.ContentLength > ft.fetcher.maxSize {
+		return nil, tooLarge(ft.fetcher.maxSize)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if name == "" {
+		name = fetchName(resp, u, contentType)
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["origin"] = map[string]interface{}{
+		"url":          u.String(),
+		"fetched_at":   time.Now().UTC().Format(time.RFC3339),
+		"content_type": contentType,
+	}
+
+	// The body is chunked and uploaded while being read
+	body := &limitedBody{io.LimitedReader{R: resp.Body, N: ft.fetcher.maxSize + 1}}
+	uploader := writer.NewUploader(&BlobStore{ft.blobStore})
+	meta, err := uploader.PutReader(name, body, data)
+	if body.N <= 0 {
+		return nil, tooLarge(ft.fetcher.maxSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ft.log.Info("URL fetched", "url", u.String(), "ref", meta.Hash, "size", meta.Size)
+	return meta, nil
+}
+
+// fetchName guesses the filename from the Content-Disposition header or the URL path
+func fetchName(resp *http.Response, u *url.URL, contentType string) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	if name := path.Base(u.Path); name != "/" && name != "." {
+		return name
+	}
+	// Use "index" with an extension matching the content type (e.g. "index.html")
+	name := "index"
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+func (ft *FileTreeExt) fetchHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			req := &FetchRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid payload: %v", err))
+				return
+			}
+			if req.URL == "" {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "missing url")
+				return
+			}
+			meta, err := ft.Fetch(r.Context(), req.URL, req.Name, req.Metadata)
+			if err != nil {
+				if perr, ok := err.(httputil.PublicErrorer); ok {
+					httputil.WriteJSONError(w, perr.Status(), perr.Error())
+					return
+				}
+				httputil.Error(w, err)
+				return
+			}
+			node, err := metaToNode(meta)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, node)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
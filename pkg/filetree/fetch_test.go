@@ -0,0 +1,147 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/blobstore/blobstoretest"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/kvstore"
+)
+
+// newTestFileTree initializes a FileTreeExt on top of a temp blobstore and kvstore
+func newTestFileTree(t *testing.T, opts ...func(*config.Config)) (*FileTreeExt, func()) {
+	env, cleanup := blobstoretest.New(t, opts...)
+	kvs, err := kvstore.New(env.Logger, env.Conf, env.BlobStore, env.Meta)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	ft, err := New(env.Logger, env.Conf, nil, kvs, env.BlobStore, env.Hub)
+	if err != nil {
+		kvs.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+	return ft, func() {
+		ft.Close()
+		kvs.Close()
+		cleanup()
+	}
+}
+
+// fetchStatus returns the status of a `httputil.PublicErrorer` (like `fetchError`), or 0
+func fetchStatus(err error) int {
+	if perr, ok := err.(httputil.PublicErrorer); ok {
+		return perr.Status()
+	}
+	return 0
+}
+
+func TestFetch(t *testing.T) {
+	big := bytes.Repeat([]byte("a"), 1<<20+1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/article.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<p>article</p>"))
+		case "/download":
+			w.Header().Set("Content-Disposition", `attachment; filename="report.txt"`)
+			w.Write([]byte("report"))
+		case "/":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		case "/big":
+			w.Header().Set("Content-Length", "1048577")
+			w.Write(big)
+		case "/big-chunked":
+			// No Content-Length, the size is only known while reading the body
+			w.Write(big[:1<<19])
+			w.(http.Flusher).Flush()
+			w.Write(big[1<<19:])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	// The test server listens on the loopback
+	ft, cleanup := newTestFileTree(t, func(conf *config.Config) {
+		conf.Fetch = &config.FetchConfig{MaxSize: 1, AllowPrivateNetworks: true}
+	})
+	defer cleanup()
+	ctx := context.Background()
+
+	// The origin is kept in the metadata
+	meta, err := ft.Fetch(ctx, srv.URL+"/article.html", "", map[string]interface{}{"tags": []string{"bookmark"}})
+	blobstoretest.Check(t, err)
+	if meta.Name != "article.html" || meta.Size != len("<p>article</p>") || meta.Metadata["tags"] == nil {
+		t.Errorf("unexpected node %+v", meta)
+	}
+	origin, ok := meta.Metadata["origin"].(map[string]interface{})
+	if !ok || origin["url"] != srv.URL+"/article.html" || origin["content_type"] != "text/html" || origin["fetched_at"] == "" {
+		t.Errorf("unexpected origin %+v", meta.Metadata["origin"])
+	}
+
+	// Name guessing
+	for p, expected := range map[string]string{
+		"/download": "report.txt",
+		"/":         "index.json",
+	} {
+		meta, err := ft.Fetch(ctx, srv.URL+p, "", nil)
+		blobstoretest.Check(t, err)
+		if meta.Name != expected {
+			t.Errorf("expected name %q for %s, got %q", expected, p, meta.Name)
+		}
+	}
+	meta, err = ft.Fetch(ctx, srv.URL+"/download", "custom.txt", nil)
+	blobstoretest.Check(t, err)
+	if meta.Name != "custom.txt" {
+		t.Errorf("the name should not be guessed when set, got %q", meta.Name)
+	}
+
+	// Errors
+	for rawurl, status := range map[string]int{
+		srv.URL + "/missing":     http.StatusBadGateway,
+		"ftp://example.com/file": http.StatusBadRequest,
+		srv.URL + "/big":         http.StatusRequestEntityTooLarge,
+		srv.URL + "/big-chunked": http.StatusRequestEntityTooLarge,
+	} {
+		if _, err := ft.Fetch(ctx, rawurl, "", nil); fetchStatus(err) != status {
+			t.Errorf("expected a %d error for %s, got %v", status, rawurl, err)
+		}
+	}
+
+	// The status is returned by the handler
+	w := httptest.NewRecorder()
+	ft.fetchHandler()(w, httptest.NewRequest("POST", "/fetch", strings.NewReader(`{"url": "`+srv.URL+`/big-chunked"}`)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a 413, got %d", w.Code)
+	}
+}
+
+func TestFetchPrivateNetworks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	ft, cleanup := newTestFileTree(t)
+	defer cleanup()
+	for _, rawurl := range []string{
+		srv.URL,
+		"http://localhost:" + srv.URL[strings.LastIndex(srv.URL, ":")+1:],
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/",
+		"http://[::1]/",
+	} {
+		if _, err := ft.Fetch(context.Background(), rawurl, "", nil); fetchStatus(err) != http.StatusForbidden {
+			t.Errorf("fetching %s should be forbidden, got %v", rawurl, err)
+		}
+	}
+}
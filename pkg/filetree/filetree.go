@@ -1,14 +1,12 @@
 package filetree // import "a4.io/blobstash/pkg/filetree"
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -44,8 +42,6 @@ var (
 	// PermTreeName = "filetree:root:"
 	// PermWrite    = "write"
 	// PermRead     = "read"
-
-	MaxUploadSize int64 = 512 << 20
 )
 
 // TODO(tsileo): rename to FileTree
@@ -59,6 +55,7 @@ type FileTreeExt struct {
 	shareTTL      time.Duration
 	thumbCache    *cache.Cache
 	metadataCache *cache.Cache
+	fetcher       *fetcher
 
 	log log.Logger
 }
@@ -120,6 +117,7 @@ func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bo
 		authFunc:      authFunc,
 		shareTTL:      1 * time.Hour,
 		hub:           chub,
+		fetcher:       newFetcher(conf.Fetch),
 		log:           logger,
 	}, nil
 }
@@ -147,6 +145,7 @@ func (ft *FileTreeExt) Register(r *mux.Router, root *mux.Router, basicAuth func(
 	// r.Handle("/fs/{name}", http.HandlerFunc(ft.fsByNameHandler()))
 
 	r.Handle("/upload", basicAuth(http.HandlerFunc(ft.uploadHandler())))
+	r.Handle("/fetch", basicAuth(http.HandlerFunc(ft.fetchHandler())))
 
 	// Hook the standard endpint
 	r.Handle("/dir/{ref}", dirHandler)
@@ -434,6 +433,36 @@ func (ft *FileTreeExt) buildIndex(path string, node *Node) map[string]string {
 	return out
 }
 
+// invalidUploadError implements `httputil.PublicErrorer`
+type invalidUploadError struct {
+	err error
+}
+
+func (e *invalidUploadError) Error() string { return e.err.Error() }
+func (e *invalidUploadError) Status() int   { return http.StatusBadRequest }
+
+// filePart returns the "file" part of the multipart upload, so the file can be streamed without buffering the whole
+// request (the parts before it are skipped)
+func filePart(r *http.Request) (*multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, &invalidUploadError{fmt.Errorf("invalid multipart upload: %v", err)}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, &invalidUploadError{fmt.Errorf("missing \"file\" part")}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
 // Handle multipart form upload to create a new Node (outside of any FS)
 func (ft *FileTreeExt) uploadHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -454,24 +483,23 @@ func (ft *FileTreeExt) uploadHandler() func(http.ResponseWriter, *http.Request)
 		}
 		fmt.Printf("parsed data=%+v\n", data)
 
-		r.ParseMultipartForm(MaxUploadSize)
-		file, handler, err := r.FormFile("file")
+		file, err := filePart(r)
 		if err != nil {
+			if perr, ok := err.(httputil.PublicErrorer); ok {
+				httputil.WriteJSONError(w, perr.Status(), perr.Error())
+				return
+			}
 			panic(err)
 		}
-		defer file.Close()
 		uploader := writer.NewUploader(&BlobStore{ft.blobStore})
-		fdata, err := ioutil.ReadAll(file)
+		meta, err := uploader.PutReader(file.FileName(), file, data)
 		if err != nil {
 			panic(err)
 		}
-		reader := bytes.NewReader(fdata)
-		meta, err := uploader.PutReader(handler.Filename, reader, data)
-		if err != nil {
-			panic(err)
-		}
-		reader.Seek(0, os.SEEK_SET)
-		info, err := ft.fetchInfo(reader, handler.Filename, meta.Hash)
+		// The file is streamed to the uploader, read it back from the BlobStore to extract the info
+		f := filereader.NewFile(ft.blobStore, meta)
+		defer f.Close()
+		info, err := ft.fetchInfo(f, file.FileName(), meta.Hash)
 		if err != nil {
 			panic(err)
 		}
@@ -617,12 +645,14 @@ func (ft *FileTreeExt) fsHandler() func(http.ResponseWriter, *http.Request) {
 			}
 			// fmt.Printf("Current node:%v %+v %+v\n", path, node, node.meta)
 			// fmt.Printf("Current node parent:%+v %+v\n", node.parent, node.parent.meta)
-			r.ParseMultipartForm(MaxUploadSize)
-			file, _, err := r.FormFile("file")
+			file, err := filePart(r)
 			if err != nil {
+				if perr, ok := err.(httputil.PublicErrorer); ok {
+					httputil.WriteJSONError(w, perr.Status(), perr.Error())
+					return
+				}
 				panic(err)
 			}
-			defer file.Close()
 			uploader := writer.NewUploader(&BlobStore{ft.blobStore})
 
 			// Create/save me Meta
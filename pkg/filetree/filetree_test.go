@@ -0,0 +1,84 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/blobstore/blobstoretest"
+)
+
+// multipartUpload returns an upload request with the given fields, and a "file" part if content is not empty
+func multipartUpload(t *testing.T, fields map[string]string, filename, content string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		blobstoretest.Check(t, mw.WriteField(k, v))
+	}
+	if content != "" {
+		part, err := mw.CreateFormFile("file", filename)
+		blobstoretest.Check(t, err)
+		_, err = part.Write([]byte(content))
+		blobstoretest.Check(t, err)
+	}
+	blobstoretest.Check(t, mw.Close())
+	r := httptest.NewRequest("POST", "/upload", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestFilePart(t *testing.T) {
+	// The parts before the file are skipped
+	part, err := filePart(multipartUpload(t, map[string]string{"name": "ignored"}, "hello.txt", "hello"))
+	blobstoretest.Check(t, err)
+	content, err := ioutil.ReadAll(part)
+	blobstoretest.Check(t, err)
+	if part.FileName() != "hello.txt" || string(content) != "hello" {
+		t.Errorf("unexpected part %q %q", part.FileName(), content)
+	}
+
+	for _, r := range []*http.Request{
+		multipartUpload(t, map[string]string{"name": "ignored"}, "", ""),
+		httptest.NewRequest("POST", "/upload", strings.NewReader("hello")),
+	} {
+		if _, err := filePart(r); fetchStatus(err) != http.StatusBadRequest {
+			t.Errorf("expected a 400 error, got %v", err)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	ft, cleanup := newTestFileTree(t)
+	defer cleanup()
+
+	// The file is streamed to the BlobStore
+	content := strings.Repeat("hello ", 100000)
+	w := httptest.NewRecorder()
+	ft.uploadHandler()(w, multipartUpload(t, map[string]string{"name": "ignored"}, "hello.txt", content))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	node := &Node{}
+	blobstoretest.Check(t, json.Unmarshal(w.Body.Bytes(), node))
+	if node.Name != "hello.txt" || node.Type != "file" || node.Size != len(content) {
+		t.Errorf("unexpected node %+v", node)
+	}
+	exists, err := ft.blobStore.Stat(context.Background(), node.Hash)
+	blobstoretest.Check(t, err)
+	if !exists {
+		t.Errorf("the meta blob %s should have been saved", node.Hash)
+	}
+
+	w = httptest.NewRecorder()
+	ft.uploadHandler()(w, multipartUpload(t, map[string]string{"name": "ignored"}, "", ""))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a missing file part should return a 400, got %d", w.Code)
+	}
+}
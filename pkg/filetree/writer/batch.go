@@ -0,0 +1,87 @@
+package writer
+
+import (
+	"sync"
+	"time"
+)
+
+// How long to wait for other stat requests before sending a batch
+var statBatchDelay = 5 * time.Millisecond
+
+// BatchStater is implemented by the BlobStore that can check the existence of multiple blobs at once (like the HTTP
+// client), the stat requests of all the concurrent uploads are then grouped.
+type BatchStater interface {
+	StatMany([]string) (map[string]bool, error)
+}
+
+type statResult struct {
+	exists bool
+	err    error
+}
+
+// statBatcher groups the concurrent stat requests, the first caller waits for `statBatchDelay` and then sends the
+// whole batch (so no goroutine is needed to consume the requests).
+type statBatcher struct {
+	bs BatchStater
+
+	pending   map[string][]chan statResult
+	scheduled bool
+	mu        sync.Mutex
+}
+
+func newStatBatcher(bs BatchStater) *statBatcher {
+	return &statBatcher{
+		bs:      bs,
+		pending: map[string][]chan statResult{},
+	}
+}
+
+// statMany returns a map hash => exists for all the given hashes
+func (b *statBatcher) statMany(hashes []string) (map[string]bool, error) {
+	chans := make([]chan statResult, len(hashes))
+
+	b.mu.Lock()
+	for i, hash := range hashes {
+		c := make(chan statResult, 1)
+		chans[i] = c
+		b.pending[hash] = append(b.pending[hash], c)
+	}
+	leader := !b.scheduled
+	b.scheduled = true
+	b.mu.Unlock()
+
+	if leader {
+		b.flush()
+	}
+
+	res := map[string]bool{}
+	for i, c := range chans {
+		r := <-c
+		if r.err != nil {
+			return nil, r.err
+		}
+		res[hashes[i]] = r.exists
+	}
+	return res, nil
+}
+
+func (b *statBatcher) flush() {
+	time.Sleep(statBatchDelay)
+
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = map[string][]chan statResult{}
+	b.scheduled = false
+	b.mu.Unlock()
+
+	hashes := make([]string, 0, len(pending))
+	for hash := range pending {
+		hashes = append(hashes, hash)
+	}
+	exists, err := b.bs.StatMany(hashes)
+	for hash, chans := range pending {
+		for _, c := range chans {
+			c <- statResult{exists: exists[hash], err: err}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package writer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStater records the batches, the blobs with an odd hash exists
+type fakeStater struct {
+	batches [][]string
+	err     error
+	mu      sync.Mutex
+}
+
+func (s *fakeStater) StatMany(hashes []string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sorted := append([]string{}, hashes...)
+	sort.Strings(sorted)
+	s.batches = append(s.batches, sorted)
+	if s.err != nil {
+		return nil, s.err
+	}
+	res := map[string]bool{}
+	for _, hash := range hashes {
+		var i int
+		fmt.Sscanf(hash, "%x", &i)
+		res[hash] = i%2 == 1
+	}
+	return res, nil
+}
+
+func TestStatBatcher(t *testing.T) {
+	defer func(delay time.Duration) { statBatchDelay = delay }(statBatchDelay)
+	statBatchDelay = 50 * time.Millisecond
+
+	// Concurrent requests (with a duplicated hash) are grouped in a single batch
+	bs := &fakeStater{}
+	b := newStatBatcher(bs)
+	var wg sync.WaitGroup
+	results := make([]map[string]bool, 4)
+	errs := make([]error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = b.statMany([]string{fmt.Sprintf("%02x", i), fmt.Sprintf("%02x", i+1)})
+		}(i)
+	}
+	wg.Wait()
+	if len(bs.batches) != 1 || len(bs.batches[0]) != 5 {
+		t.Errorf("expected a single batch of 5 hashes, got %v", bs.batches)
+	}
+	for i, res := range results {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if len(res) != 2 || res[fmt.Sprintf("%02x", i)] != (i%2 == 1) || res[fmt.Sprintf("%02x", i+1)] != (i%2 == 0) {
+			t.Errorf("unexpected result %v for caller %d", res, i)
+		}
+	}
+
+	// The next requests start a new batch
+	if _, err := b.statMany([]string{"0a"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.batches) != 2 || len(bs.batches[1]) != 1 || bs.batches[1][0] != "0a" {
+		t.Errorf("unexpected batches %v", bs.batches)
+	}
+
+	// The error is returned to every caller
+	bs.err = fmt.Errorf("stat failed")
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = nil
+			_, errs[i] = b.statMany([]string{fmt.Sprintf("%02x", i)})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs[:2] {
+		if err != bs.err {
+			t.Errorf("expected the stat error, got %v", err)
+		}
+	}
+}
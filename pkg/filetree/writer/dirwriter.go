@@ -131,7 +131,7 @@ func (up *Uploader) DirWriterNode(node *node) {
 	// node.meta.Size = node.wr.Size
 	mhash, mjs := node.meta.Encode()
 	node.meta.Hash = mhash
-	mexists, err := up.bs.Stat(mhash)
+	mexists, err := up.stat(mhash)
 	if err != nil {
 		node.err = err
 		return
@@ -17,6 +17,43 @@ var (
 	pol = chunker.Pol(0x3c657535c4d6f5)
 )
 
+// Maximum number of chunks (and total size) kept in memory before checking their existence
+const (
+	chunksBatchCount = 64
+	chunksBatchSize  = 8 << 20
+)
+
+type chunkData struct {
+	hash string
+	data []byte
+}
+
+// putChunks uploads the chunks that don't exist yet
+func (up *Uploader) putChunks(chunks []*chunkData) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		hashes[i] = chunk.hash
+	}
+	exists, err := up.statMany(hashes)
+	if err != nil {
+		return fmt.Errorf("failed to stat blobs: %v", err)
+	}
+	for _, chunk := range chunks {
+		if exists[chunk.hash] {
+			continue
+		}
+		if err := up.bs.Put(chunk.hash, chunk.data); err != nil {
+			return fmt.Errorf("failed to put blob %v: %v", chunk.hash, err)
+		}
+		// The same chunk may appear multiple times in the batch
+		exists[chunk.hash] = true
+	}
+	return nil
+}
+
 func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*WriteResult, error) {
 	// writeResult := NewWriteResult()
 	// Init the rolling checksum
@@ -30,31 +67,40 @@ func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*W
 	// TODO don't read one byte at a time if meta.Size < chunker.ChunkMinSize
 	// Prepare the blob writer
 	var size uint
+	// Chunks are stat'ed by batch
+	var pending []*chunkData
+	var pendingSize int
 	for {
 		chunk, err := chunkSplitter.Next(buf)
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return err
+		}
 		chunkHash := hashutil.Compute(chunk.Data)
 		size += chunk.Length
 
-		exists, err := up.bs.Stat(chunkHash)
-		if err != nil {
-			panic(fmt.Sprintf("DB error: %v", err))
-		}
-		if !exists {
-			if err := up.bs.Put(chunkHash, chunk.Data); err != nil {
-				panic(fmt.Errorf("failed to PUT blob %v", err))
-			}
-		}
+		// The buffer is reused, the chunk must be copied
+		data := make([]byte, len(chunk.Data))
+		copy(data, chunk.Data)
+		pending = append(pending, &chunkData{hash: chunkHash, data: data})
+		pendingSize += len(data)
 
 		// Save the location and the blob hash into a sorted list (with the offset as index)
 		meta.AddIndexedRef(int(size), chunkHash)
 
-		if err != nil {
-			return err
+		if len(pending) >= chunksBatchCount || pendingSize >= chunksBatchSize {
+			if err := up.putChunks(pending); err != nil {
+				return err
+			}
+			pending = nil
+			pendingSize = 0
 		}
 	}
+	if err := up.putChunks(pending); err != nil {
+		return err
+	}
 	meta.Size = int(size)
 	meta.AddData("blake2b-hash", fmt.Sprintf("%x", fullHash.Sum(nil)))
 	return nil
@@ -99,7 +145,7 @@ func (up *Uploader) PutFile(path string) (*rnode.RawNode, error) { // , *WriteRe
 		// wr = cwr
 	}
 	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(mhash)
+	mexists, err := up.stat(mhash)
 	if err != nil {
 		return nil, fmt.Errorf("failed to stat blob %v: %v", mhash, err)
 	}
@@ -120,7 +166,7 @@ func (up *Uploader) PutFile(path string) (*rnode.RawNode, error) { // , *WriteRe
 
 func (up *Uploader) PutMeta(meta *rnode.RawNode) error {
 	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(mhash)
+	mexists, err := up.stat(mhash)
 	if err != nil {
 		return fmt.Errorf("failed to stat blob %v: %v", mhash, err)
 	}
@@ -142,7 +188,7 @@ func (up *Uploader) PutMeta(meta *rnode.RawNode) error {
 func (up *Uploader) RenameMeta(meta *rnode.RawNode, name string) error {
 	meta.Name = filepath.Base(name)
 	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(mhash)
+	mexists, err := up.stat(mhash)
 	if err != nil {
 		return fmt.Errorf("failed to stat blob %v: %v", mhash, err)
 	}
@@ -185,7 +231,7 @@ func (up *Uploader) PutReader(name string, reader io.Reader, data map[string]int
 	// wr.free()
 	// wr = cwr
 	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(mhash)
+	mexists, err := up.stat(mhash)
 	if err != nil {
 		return nil, fmt.Errorf("failed to stat blob %v: %v", mhash, err)
 	}
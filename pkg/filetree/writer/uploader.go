@@ -13,7 +13,8 @@ type BlobStorer interface {
 }
 
 type Uploader struct {
-	bs BlobStorer
+	bs      BlobStorer
+	batcher *statBatcher
 
 	uploader    chan struct{}
 	dirUploader chan struct{}
@@ -23,12 +24,45 @@ type Uploader struct {
 }
 
 func NewUploader(bs BlobStorer) *Uploader {
-	return &Uploader{
+	up := &Uploader{
 		bs: bs,
 		// kvs:         kvs,
 		uploader:    make(chan struct{}, uploader),
 		dirUploader: make(chan struct{}, dirUploader),
 	}
+	// Group the stat requests if the BlobStore supports it
+	if bstater, ok := bs.(BatchStater); ok {
+		up.batcher = newStatBatcher(bstater)
+	}
+	return up
+}
+
+// stat checks if the blob already exists
+func (up *Uploader) stat(hash string) (bool, error) {
+	if up.batcher == nil {
+		return up.bs.Stat(hash)
+	}
+	res, err := up.batcher.statMany([]string{hash})
+	if err != nil {
+		return false, err
+	}
+	return res[hash], nil
+}
+
+// statMany checks the existence of multiple blobs, returns a map hash => exists
+func (up *Uploader) statMany(hashes []string) (map[string]bool, error) {
+	if up.batcher != nil {
+		return up.batcher.statMany(hashes)
+	}
+	res := map[string]bool{}
+	for _, hash := range hashes {
+		exists, err := up.bs.Stat(hash)
+		if err != nil {
+			return nil, err
+		}
+		res[hash] = exists
+	}
+	return res, nil
 }
 
 // Block until the client can start the upload, thus limiting the number of file descriptor used.
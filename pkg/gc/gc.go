@@ -0,0 +1,243 @@
+/*
+
+Package gc implements a mark-and-sweep garbage collector for the BlobStore.
+
+The mark phase walks every version of every key-value entry and marks:
+
+- the referenced hash (kv hashes, docstore documents)
+- the docstore documents pointers (`@blobs/json:<hash>` and `@filetree/ref:<hash>`)
+- the whole tree of filetree nodes (FS roots and `rnode.RawNode.Refs`)
+
+Meta blobs are always considered reachable as they are needed to rebuild the indexes.
+
+Every other blob is unreachable, and will be deleted (unless the dry-run mode is used) like with
+`BlobStore.Delete`: a tombstone is kept and the S3 copy is removed too, so a S3 restore or a sync won't bring the blob
+back (uploading it again returns `blobstore.ErrBlobDeleted`).
+
+Only the blobs saved before the GC started are candidates for removal, and the blobs uploaded (or uploaded again)
+while the GC is running are marked, but a client that started uploading blobs *before* the GC and updates the
+key-value store after may lose some blobs, the GC should be run when the instance is idle.
+
+Removing blobs requires a backend that supports deletion (i.e. not BlobsFile), only the dry-run mode is available
+otherwise.
+
+*/
+package gc // import "a4.io/blobstash/pkg/gc"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	logext "github.com/inconshreveable/log15/ext"
+
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+)
+
+var ErrAlreadyRunning = errors.New("gc already running")
+
+// Stats holds the result of a GC run
+type Stats struct {
+	DryRun          bool     `json:"dry_run"`
+	BlobsCount      int      `json:"blobs_count"`
+	MarkedCount     int      `json:"marked_count"`
+	MetaCount       int      `json:"meta_count"`
+	Unreachable     int      `json:"unreachable_count"`
+	UnreachableSize int      `json:"unreachable_size"`
+	Removed         int      `json:"removed_count"`
+	Hashes          []string `json:"unreachable_hashes,omitempty"`
+	Duration        string   `json:"gc_duration"`
+}
+
+type GarbageCollector struct {
+	blobStore *blobstore.BlobStore
+	kvStore   *kvstore.KvStore
+	hub       *hub.Hub
+
+	running bool
+	marked  map[string]struct{}
+	mu      sync.Mutex
+
+	// Called between the mark and the sweep phases (only set in the tests)
+	afterMark func()
+
+	log log.Logger
+}
+
+// New initializes the garbage collector
+func New(logger log.Logger, blobStore *blobstore.BlobStore, kvStore *kvstore.KvStore, chub *hub.Hub) *GarbageCollector {
+	logger.Debug("init")
+	gc := &GarbageCollector{
+		blobStore: blobStore,
+		kvStore:   kvStore,
+		hub:       chub,
+		log:       logger,
+	}
+	// Blobs saved while the GC is running must be kept
+	chub.Subscribe(hub.NewBlob, "gc", gc.newBlobCallback)
+	chub.Subscribe(hub.ExistingBlob, "gc", gc.newBlobCallback)
+	return gc
+}
+
+func (gc *GarbageCollector) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/_run", basicAuth(http.HandlerFunc(gc.runHandler())))
+}
+
+func (gc *GarbageCollector) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
+	gc.mark(blob.Hash)
+	return nil
+}
+
+// mark adds the hash to the reachable set (if a GC is running), returns true if the hash wasn't already marked
+func (gc *GarbageCollector) mark(hash string) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if !gc.running {
+		return false
+	}
+	if _, ok := gc.marked[hash]; ok {
+		return false
+	}
+	gc.marked[hash] = struct{}{}
+	return true
+}
+
+func (gc *GarbageCollector) isMarked(hash string) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	_, ok := gc.marked[hash]
+	return ok
+}
+
+// Run performs a full mark-and-sweep, unreachable blobs are only reported if `dryRun` is true, returns
+// `backend.ErrDeleteNotSupported` if `dryRun` is false and the blobs can't be removed
+func (gc *GarbageCollector) Run(ctx context.Context, dryRun bool) (*Stats, error) {
+	if !dryRun && !gc.blobStore.CanDelete() {
+		return nil, backend.ErrDeleteNotSupported
+	}
+
+	gc.mu.Lock()
+	if gc.running {
+		gc.mu.Unlock()
+		return nil, ErrAlreadyRunning
+	}
+	gc.running = true
+	gc.marked = map[string]struct{}{}
+	gc.mu.Unlock()
+
+	defer func() {
+		gc.mu.Lock()
+		defer gc.mu.Unlock()
+		gc.running = false
+		gc.marked = nil
+	}()
+
+	l := gc.log.New("gc_id", logext.RandId(6))
+	l.Info("Starting GC", "dry_run", dryRun)
+	start := time.Now()
+	stats := &Stats{DryRun: dryRun}
+
+	// The blobs saved from now on will be marked by the hub callback (it's called after the blob is written, so a blob
+	// seen by the sweep may not be marked yet)
+	candidates := map[string]struct{}{}
+	if err := gc.blobStore.Iter(ctx, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+		candidates[ref.Hash] = struct{}{}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list the blobs: %v", err)
+	}
+
+	if err := NewWalker(l, gc.blobStore, gc.kvStore, gc.mark).All(ctx); err != nil {
+		return nil, fmt.Errorf("mark failed: %v", err)
+	}
+	l.Info("mark done", "duration", time.Since(start))
+	if gc.afterMark != nil {
+		gc.afterMark()
+	}
+
+	if err := gc.sweep(ctx, stats, candidates); err != nil {
+		return nil, fmt.Errorf("sweep failed: %v", err)
+	}
+
+	stats.Duration = time.Since(start).String()
+	l.Info("GC done", "stats", fmt.Sprintf("%+v", stats))
+	return stats, nil
+}
+
+// sweep removes all the unmarked candidates (except meta blobs)
+func (gc *GarbageCollector) sweep(ctx context.Context, stats *Stats, candidates map[string]struct{}) error {
+	return gc.blobStore.Iter(ctx, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+		stats.BlobsCount++
+		if _, ok := candidates[ref.Hash]; !ok {
+			// Saved while the GC is running
+			stats.MarkedCount++
+			return nil
+		}
+		if gc.isMarked(ref.Hash) {
+			stats.MarkedCount++
+			return nil
+		}
+		// Don't evict the hot blobs, every candidate is read once
+		data, err := gc.blobStore.GetNoCache(ctx, ref.Hash)
+		if err != nil {
+			return err
+		}
+		if _, _, isMeta := meta.IsMetaBlob(data); isMeta {
+			stats.MetaCount++
+			return nil
+		}
+		stats.Unreachable++
+		stats.UnreachableSize += ref.Size
+		if stats.DryRun {
+			stats.Hashes = append(stats.Hashes, ref.Hash)
+			return nil
+		}
+		// Keep a tombstone and remove the S3 copy too, so a restore or a sync won't bring the blob back
+		if err := gc.blobStore.Delete(ctx, ref.Hash); err != nil {
+			return err
+		}
+		stats.Removed++
+		// Only notify the indexes once the blob is actually gone
+		if err := gc.hub.GarbageCollectionEvent(ctx, &blob.Blob{Hash: ref.Hash, Data: data}, nil); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (gc *GarbageCollector) runHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			// The dry-run mode is the default, `?dry_run=0` must be set to actually remove the blobs
+			dryRun := r.URL.Query().Get("dry_run") != "0"
+			stats, err := gc.Run(context.Background(), dryRun)
+			if err != nil {
+				switch err {
+				case ErrAlreadyRunning:
+					httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+					return
+				case backend.ErrDeleteNotSupported:
+					httputil.WriteJSONError(w, http.StatusNotImplemented, err.Error())
+					return
+				}
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, stats)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/backend"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/blobstore/blobstoretest"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/filetree"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/kvstore"
+)
+
+// newTestGC initializes a GC on top of a temp blobstore and kvstore
+func newTestGC(t *testing.T, opts ...func(*config.Config)) (*GarbageCollector, func()) {
+	env, cleanup := blobstoretest.New(t, opts...)
+	kvs, err := kvstore.New(env.Logger, env.Conf, env.BlobStore, env.Meta)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return New(env.Logger, env.BlobStore, kvs, env.Hub), func() {
+		kvs.Close()
+		cleanup()
+	}
+}
+
+func putBlob(t *testing.T, bs *blobstore.BlobStore, data []byte) string {
+	t.Helper()
+	b := blob.New(data)
+	blobstoretest.Check(t, bs.Put(context.Background(), b))
+	return b.Hash
+}
+
+func putNode(t *testing.T, bs *blobstore.BlobStore, n *rnode.RawNode) string {
+	t.Helper()
+	hash, data := n.Encode()
+	blobstoretest.Check(t, bs.Put(context.Background(), &blob.Blob{Hash: hash, Data: data}))
+	return hash
+}
+
+func exists(t *testing.T, bs *blobstore.BlobStore, hash string) bool {
+	t.Helper()
+	ok, err := bs.Stat(context.Background(), hash)
+	blobstoretest.Check(t, err)
+	return ok
+}
+
+func TestGC(t *testing.T) {
+	gc, cleanup := newTestGC(t)
+	defer cleanup()
+	ctx := context.Background()
+	bs, kvs := gc.blobStore, gc.kvStore
+
+	// Reachable from a key
+	value := putBlob(t, bs, []byte("value"))
+	_, err := kvs.Put(ctx, "key", value, nil, -1)
+	blobstoretest.Check(t, err)
+
+	// Reachable from a filetree FS
+	chunk := putBlob(t, bs, []byte("chunk"))
+	file := &rnode.RawNode{Name: "file", Type: "file"}
+	file.AddIndexedRef(len("chunk"), chunk)
+	fileHash := putNode(t, bs, file)
+	dir := &rnode.RawNode{Name: "dir", Type: "dir"}
+	dir.AddRef(fileHash)
+	dirHash := putNode(t, bs, dir)
+	js, err := json.Marshal(&filetree.FS{Ref: dirHash})
+	blobstoretest.Check(t, err)
+	_, err = kvs.Put(ctx, fmt.Sprintf(filetree.FSKeyFmt, "myfs"), "", js, -1)
+	blobstoretest.Check(t, err)
+
+	// Reachable from a document pointer
+	pointed := putBlob(t, bs, []byte(`{"pointed": true}`))
+	doc, err := msgpack.Marshal(map[string]interface{}{"ptr": docstore.PointerBlobJSON + pointed})
+	blobstoretest.Check(t, err)
+	docHash := putBlob(t, bs, doc)
+	_, err = kvs.Put(ctx, fmt.Sprintf(docstore.KeyFmt, "col", "doc1"), docHash, []byte{docstore.FlagNoop}, -1)
+	blobstoretest.Check(t, err)
+
+	// A dangling reference must not fail the mark phase
+	_, err = kvs.Put(ctx, "dangling", blob.New([]byte("missing")).Hash, nil, -1)
+	blobstoretest.Check(t, err)
+
+	unreachable := []string{putBlob(t, bs, []byte("garbage 1")), putBlob(t, bs, []byte("garbage 2"))}
+	sort.Strings(unreachable)
+
+	// The dry run only reports the unreachable blobs
+	stats, err := gc.Run(ctx, true)
+	blobstoretest.Check(t, err)
+	sort.Strings(stats.Hashes)
+	if stats.Unreachable != 2 || stats.Removed != 0 || len(stats.Hashes) != 2 || stats.Hashes[0] != unreachable[0] || stats.Hashes[1] != unreachable[1] {
+		t.Errorf("unexpected dry run stats %+v", stats)
+	}
+	// 4 kv meta blobs
+	if stats.MetaCount != 4 {
+		t.Errorf("expected 4 meta blobs, got %d", stats.MetaCount)
+	}
+	for _, hash := range unreachable {
+		if !exists(t, bs, hash) {
+			t.Errorf("blob %s should not have been removed by the dry run", hash)
+		}
+	}
+
+	// Blobs uploaded while the GC is running are kept, even if they're already saved
+	var uploaded string
+	gc.afterMark = func() {
+		uploaded = putBlob(t, bs, []byte("uploaded during the GC"))
+		putBlob(t, bs, []byte("garbage 2"))
+	}
+	stats, err = gc.Run(ctx, false)
+	blobstoretest.Check(t, err)
+	if stats.Unreachable != 1 || stats.Removed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	reuploaded := blob.New([]byte("garbage 2")).Hash
+	for _, hash := range []string{value, chunk, fileHash, dirHash, pointed, docHash, uploaded, reuploaded} {
+		if !exists(t, bs, hash) {
+			t.Errorf("blob %s should have been kept", hash)
+		}
+	}
+	removed := blob.New([]byte("garbage 1")).Hash
+	if exists(t, bs, removed) {
+		t.Errorf("blob %s should have been removed", removed)
+	}
+	// A tombstone is kept, so the blob won't be brought back by a restore or a sync
+	deleted, err := bs.Deleted(removed)
+	blobstoretest.Check(t, err)
+	if !deleted {
+		t.Errorf("blob %s should have a tombstone", removed)
+	}
+}
+
+func TestGCCache(t *testing.T) {
+	gc, cleanup := newTestGC(t, func(conf *config.Config) {
+		conf.BlobStore.CacheSize = 1
+	})
+	defer cleanup()
+	putBlob(t, gc.blobStore, []byte("garbage"))
+
+	// The candidates are read without going through the hot blobs cache
+	before := gc.blobStore.CacheStats()
+	stats, err := gc.Run(context.Background(), true)
+	blobstoretest.Check(t, err)
+	after := gc.blobStore.CacheStats()
+	if stats.Unreachable != 1 || after.Hits != before.Hits || after.Misses != before.Misses {
+		t.Errorf("the cache should not be used, got %+v before and %+v after", before, after)
+	}
+}
+
+func TestGCDeleteNotSupported(t *testing.T) {
+	gc, cleanup := newTestGC(t, func(conf *config.Config) {
+		conf.BlobStore.Backend = blobstore.BackendBlobsFile
+	})
+	defer cleanup()
+	ctx := context.Background()
+	garbage := putBlob(t, gc.blobStore, []byte("garbage"))
+
+	if _, err := gc.Run(ctx, false); err != backend.ErrDeleteNotSupported {
+		t.Fatalf("expected ErrDeleteNotSupported, got %v", err)
+	}
+	// The dry run is still available
+	stats, err := gc.Run(ctx, true)
+	blobstoretest.Check(t, err)
+	if stats.Unreachable != 1 || !exists(t, gc.blobStore, garbage) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
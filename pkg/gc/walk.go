@@ -0,0 +1,199 @@
+package gc // import "a4.io/blobstash/pkg/gc"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/filetree"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/kvstore"
+)
+
+// Walker finds the blobs reachable from the key-value entries (as described in the package documentation), it's used
+// by the GC mark phase, and to export a subset of the blobs
+type Walker struct {
+	blobStore *blobstore.BlobStore
+	kvStore   *kvstore.KvStore
+
+	// mark is called for every reachable blob, and must return false if the blob was already marked
+	mark  func(string) bool
+	nodes map[string]struct{}
+	mu    sync.Mutex
+
+	log log.Logger
+}
+
+// NewWalker returns a walker calling `mark` for every reachable blob
+func NewWalker(logger log.Logger, blobStore *blobstore.BlobStore, kvStore *kvstore.KvStore, mark func(string) bool) *Walker {
+	return &Walker{
+		blobStore: blobStore,
+		kvStore:   kvStore,
+		mark:      mark,
+		nodes:     map[string]struct{}{},
+		log:       logger,
+	}
+}
+
+// All marks all the blobs reachable from the key-value store
+func (w *Walker) All(ctx context.Context) error {
+	keys, _, err := w.kvStore.Keys(ctx, "", "\xff", 0)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := w.Key(ctx, key.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Key marks the blobs reachable from every version of the key
+func (w *Walker) Key(ctx context.Context, key string) error {
+	versions, _, err := w.kvStore.Versions(ctx, key, -1, 0)
+	if err != nil {
+		return err
+	}
+	for _, kv := range versions.Versions {
+		kv.Key = key
+		if err := w.KeyValue(ctx, kv.Key, kv.HexHash(), kv.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyValue marks the blobs reachable from the key-value entry
+func (w *Walker) KeyValue(ctx context.Context, key, hash string, data []byte) error {
+	switch {
+	case strings.HasPrefix(key, fmt.Sprintf(filetree.FSKeyFmt, "")):
+		// The FS root is stored in the JSON-encoded data
+		fs := &filetree.FS{}
+		if err := json.Unmarshal(data, fs); err != nil {
+			return fmt.Errorf("failed to unmarshal FS %s: %v", key, err)
+		}
+		if fs.Ref != "" {
+			return w.Node(ctx, fs.Ref)
+		}
+	case strings.HasPrefix(key, docstore.PrefixKey):
+		if hash == "" {
+			// The document has been deleted
+			return nil
+		}
+		if w.mark(hash) {
+			return w.markDoc(ctx, hash)
+		}
+	case hash != "":
+		// The key may point to a filetree node
+		return w.Node(ctx, hash)
+	}
+	return nil
+}
+
+// markDoc marks the document pointers
+func (w *Walker) markDoc(ctx context.Context, hash string) error {
+	data, err := w.get(ctx, hash)
+	if err != nil || data == nil {
+		return err
+	}
+	doc := map[string]interface{}{}
+	if err := msgpack.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to unmarshal doc %s: %v", hash, err)
+	}
+	return w.markPointers(ctx, doc)
+}
+
+func (w *Walker) markPointers(ctx context.Context, v interface{}) error {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for _, v := range vv {
+			if err := w.markPointers(ctx, v); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for _, v := range vv {
+			if err := w.markPointers(ctx, v); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, v := range vv {
+			if err := w.markPointers(ctx, v); err != nil {
+				return err
+			}
+		}
+	case string:
+		switch {
+		case strings.HasPrefix(vv, docstore.PointerBlobJSON):
+			w.mark(vv[len(docstore.PointerBlobJSON):])
+		case strings.HasPrefix(vv, docstore.PointerFiletreeRef):
+			return w.Node(ctx, vv[len(docstore.PointerFiletreeRef):])
+		}
+	}
+	return nil
+}
+
+// Node marks the filetree node and all its children recursively (if the blob is a valid node)
+func (w *Walker) Node(ctx context.Context, hash string) error {
+	w.mark(hash)
+	w.mu.Lock()
+	if _, ok := w.nodes[hash]; ok {
+		w.mu.Unlock()
+		return nil
+	}
+	w.nodes[hash] = struct{}{}
+	w.mu.Unlock()
+
+	data, err := w.get(ctx, hash)
+	if err != nil || data == nil {
+		return err
+	}
+	n, err := rnode.NewNodeFromBlob(hash, data)
+	if err != nil {
+		// Not a node
+		return nil
+	}
+	switch n.Type {
+	case "dir":
+		for _, ref := range n.Refs {
+			if h, ok := ref.(string); ok {
+				if err := w.Node(ctx, h); err != nil {
+					return err
+				}
+			}
+		}
+	case "file":
+		for _, ref := range n.Refs {
+			if iref, ok := ref.([]interface{}); ok && len(iref) == 2 {
+				if h, ok := iref[1].(string); ok {
+					w.mark(h)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// get fetches the blob, returns nil if the blob is missing (a dangling reference)
+func (w *Walker) get(ctx context.Context, hash string) ([]byte, error) {
+	data, err := w.blobStore.Get(ctx, hash)
+	switch err {
+	case nil:
+		return data, nil
+	case clientutil.ErrBlobNotFound:
+		w.log.Warn("dangling reference", "hash", hash)
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
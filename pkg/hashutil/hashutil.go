@@ -1,13 +1,56 @@
+/*
+
+Package hashutil implements the hash functions used to address the blobs.
+
+Blobs are addressed by their BLAKE2b-256 hash (hex-encoded) by default. Blobs can also be addressed using another
+algorithm, the ref is then prefixed by the multihash header (the algorithm code and the digest length, hex-encoded):
+
+	<64 hex digest>             BLAKE2b-256 (the default)
+	1220<64 hex digest>         SHA-256
+
+Refs are always hex-encoded, and the existing (BLAKE2b) refs are still valid.
+
+*/
 package hashutil // import "a4.io/blobstash/pkg/hashutil"
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	_ "hash"
+	"hash"
+	"strings"
 	_ "sync"
 
 	"github.com/dchest/blake2b"
 )
 
+// Supported hash algorithms
+const (
+	Blake2b = "blake2b-256"
+	SHA256  = "sha2-256"
+)
+
+// Default is the algorithm used to address the blobs created by BlobStash
+const Default = Blake2b
+
+// ErrInvalidRef is returned when the ref does not match any supported algorithm
+var ErrInvalidRef = errors.New("invalid ref")
+
+// The length of the digest of all the supported algorithms
+const digestSize = 32
+
+type algorithm struct {
+	// hex-encoded multihash header (empty for the default algorithm)
+	prefix string
+	new    func() hash.Hash
+}
+
+var algorithms = map[string]*algorithm{
+	Blake2b: &algorithm{"", blake2b.New256},
+	SHA256:  &algorithm{"1220", sha256.New},
+}
+
 // var hashPool sync.Pool
 
 // func NewHash() (h hash.Hash) {
@@ -20,6 +63,12 @@ import (
 // 	}
 // 	return
 // }
+
+// NewHash returns a new Blake2B hash, to compute the hash of a blob while reading it
+func NewHash() hash.Hash {
+	return blake2b.New256()
+}
+
 // Compute returns the Blake2B hash hex-encoded
 func ComputeRaw(data []byte) [32]byte {
 	return blake2b.Sum256(data)
@@ -29,3 +78,63 @@ func ComputeRaw(data []byte) [32]byte {
 func Compute(data []byte) string {
 	return fmt.Sprintf("%x", blake2b.Sum256(data))
 }
+
+// Algorithm returns the algorithm used to compute the ref
+func Algorithm(ref string) (string, error) {
+	if _, err := hex.DecodeString(ref); err != nil {
+		return "", ErrInvalidRef
+	}
+	for name, algo := range algorithms {
+		if len(ref) == len(algo.prefix)+digestSize*2 && strings.HasPrefix(ref, algo.prefix) {
+			return name, nil
+		}
+	}
+	return "", ErrInvalidRef
+}
+
+// Digest returns the hex-encoded digest of the ref (without the multihash header)
+func Digest(ref string) string {
+	if len(ref) < digestSize*2 {
+		return ref
+	}
+	return ref[len(ref)-digestSize*2:]
+}
+
+// ComputeWith returns the ref of the data using the given algorithm
+func ComputeWith(algo string, data []byte) (string, error) {
+	h, err := NewHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return h.Ref(), nil
+}
+
+// Hasher computes the ref of the data written to it
+type Hasher struct {
+	hash.Hash
+	prefix string
+}
+
+// Ref returns the ref of the data written so far
+func (h *Hasher) Ref() string {
+	return h.prefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// NewHasher returns a new Hasher for the given algorithm
+func NewHasher(algo string) (*Hasher, error) {
+	a, ok := algorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm \"%s\"", algo)
+	}
+	return &Hasher{a.new(), a.prefix}, nil
+}
+
+// NewHasherFor returns a new Hasher using the same algorithm as the given ref
+func NewHasherFor(ref string) (*Hasher, error) {
+	algo, err := Algorithm(ref)
+	if err != nil {
+		return nil, err
+	}
+	return NewHasher(algo)
+}
@@ -0,0 +1,54 @@
+package hashutil
+
+import (
+	"testing"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	data := []byte("hello")
+	// echo -n hello | sha256sum
+	sha := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	ref, err := ComputeWith(SHA256, data)
+	check(err)
+	if ref != "1220"+sha {
+		t.Errorf("bad SHA-256 ref %s", ref)
+	}
+	ref2, err := ComputeWith(Blake2b, data)
+	check(err)
+	if ref2 != Compute(data) {
+		t.Errorf("the default ref should not be prefixed, got %s", ref2)
+	}
+
+	for ref, expected := range map[string]string{ref: SHA256, ref2: Blake2b} {
+		algo, err := Algorithm(ref)
+		check(err)
+		if algo != expected {
+			t.Errorf("bad algorithm for %s, expected %s, got %s", ref, expected, algo)
+		}
+		if Digest(ref) != ref[len(ref)-64:] {
+			t.Errorf("bad digest %s", Digest(ref))
+		}
+		h, err := NewHasherFor(ref)
+		check(err)
+		h.Write(data)
+		if h.Ref() != ref {
+			t.Errorf("bad ref, expected %s, got %s", ref, h.Ref())
+		}
+	}
+	if Digest(ref) != sha {
+		t.Errorf("bad SHA-256 digest %s", Digest(ref))
+	}
+
+	for _, ref := range []string{"", "deadbeef", "1220deadbeef", "zz" + sha[2:], "1320" + sha} {
+		if _, err := Algorithm(ref); err != ErrInvalidRef {
+			t.Errorf("%q should be invalid, got %v", ref, err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package hub // import "a4.io/blobstash/pkg/hub"
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/httputil"
+)
+
+func (h *Hub) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/subscribers", basicAuth(http.HandlerFunc(h.subscribersHandler())))
+}
+
+// subscribersHandler returns the delivery state of every subscriber
+func (h *Hub) subscribersHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			status, err := h.Status()
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, map[string]interface{}{
+				"data": status,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -1,12 +1,33 @@
+/*
+
+Package hub implements the notification of the BlobStore events to the other apps.
+
+Subscribers are either:
+
+- synchronous (e.g. the indexers like `meta`): the callback is called before the BlobStore operation returns, and an
+  error fails the operation
+- asynchronous: the event is saved in a durable queue (one per subscriber), and the callback is called in the
+  background, failed deliveries are retried (with a backoff) up to `maxAttempts` times, the event is then parked in a
+  dead-letter queue (`<queue path>.dead`) so it won't block the next ones
+
+Async callbacks only get the blob hash (the data is not kept in the queue), and the namespace (see `ctxutil`).
+
+*/
 package hub // import "a4.io/blobstash/pkg/hub"
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
 	"a4.io/blobstash/pkg/blob"
-	_ "a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/queue"
 )
 
 type EventType int
@@ -15,24 +36,399 @@ const (
 	NewBlob EventType = iota
 	ScanBlob
 	GarbageCollection
+	DeleteBlob
+	ExistingBlob // an already saved blob has been uploaded again
+)
+
+var eventNames = map[EventType]string{
+	NewBlob:           "new_blob",
+	ScanBlob:          "scan_blob",
+	GarbageCollection: "garbage_collection",
+	DeleteBlob:        "delete_blob",
+	ExistingBlob:      "existing_blob",
+}
+
+func (e EventType) String() string {
+	if name, ok := eventNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("event_%d", int(e))
+}
+
+// Delivery modes
+const (
+	Sync  = "sync"
+	Async = "async"
+)
+
+// Delay between two delivery attempts of a failed async event
+var (
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 2 * time.Minute
 )
 
+// The number of delivery attempts of an async event before parking it in the dead-letter queue
+var maxAttempts = 20
+
+type callbackFunc func(context.Context, *blob.Blob, interface{}) error
+
+// Status holds the delivery state of a subscriber
+type Status struct {
+	Name        string     `json:"name"`
+	Mode        string     `json:"mode"`
+	Events      []string   `json:"events"`
+	Delivered   int64      `json:"delivered_count"`
+	Failed      int64      `json:"failed_count"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+
+	// Only for the async subscribers
+	Pending       int        `json:"pending_count"`
+	OldestPending *time.Time `json:"oldest_pending,omitempty"`
+	FailedEvents  int        `json:"failed_events_count"` // Events given up after `maxAttempts`, see the dead-letter queue
+}
+
+// subscriber holds the callbacks of a subscriber (per event type)
+type subscriber struct {
+	name      string
+	callbacks map[EventType]callbackFunc
+
+	// Only set for the async subscribers
+	queue       *queue.Queue
+	deadLetters *queue.Queue
+	notify      chan struct{}
+	stop        chan struct{}
+	stopped     chan struct{}
+
+	// The queues sizes are tracked in memory (`queue.Size` scans the whole queue)
+	pending, failedEvents int
+
+	delivered, failed int64
+	lastError         string
+	lastErrorAt       *time.Time
+	mu                sync.Mutex
+}
+
+// event is an async event, as stored in the queue
+type event struct {
+	Type      EventType `json:"type"`
+	Hash      string    `json:"hash"`
+	Namespace string    `json:"namespace,omitempty"`
+	Time      time.Time `json:"time"`
+
+	// Only set in the dead-letter queue
+	Error string `json:"error,omitempty"`
+}
+
 type Hub struct {
 	log         log.Logger
-	subscribers map[EventType]map[string]func(context.Context, *blob.Blob, interface{}) error
+	subscribers map[EventType]map[string]*subscriber
+	all         map[string]*subscriber
+	mu          sync.Mutex
 }
 
+// Subscribe registers a synchronous callback
 func (h *Hub) Subscribe(etype EventType, name string, callback func(context.Context, *blob.Blob, interface{}) error) {
-	h.log.Info("new subscription", "type", etype, "name", name)
-	h.subscribers[etype][name] = callback
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.log.Info("new subscription", "type", etype, "name", name, "mode", Sync)
+	sub, ok := h.all[name]
+	if !ok {
+		sub = &subscriber{name: name, callbacks: map[EventType]callbackFunc{}}
+		h.all[name] = sub
+	}
+	sub.mu.Lock()
+	sub.callbacks[etype] = callback
+	sub.mu.Unlock()
+	h.subscribers[etype][name] = sub
+}
+
+// SubscribeAsync registers the asynchronous callbacks of a subscriber (all at once, so the events queued before a
+// restart can be delivered right away), the events are saved in a durable queue at `path`
+func (h *Hub) SubscribeAsync(name, path string, callbacks map[EventType]func(context.Context, *blob.Blob, interface{}) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.all[name]; ok {
+		return fmt.Errorf("subscriber \"%s\" is already registered", name)
+	}
+	q, err := queue.New(path)
+	if err != nil {
+		return fmt.Errorf("failed to init the queue for subscriber \"%s\": %v", name, err)
+	}
+	dq, err := queue.New(path + ".dead")
+	if err != nil {
+		q.Close()
+		return fmt.Errorf("failed to init the dead-letter queue for subscriber \"%s\": %v", name, err)
+	}
+	pending, err := q.Size()
+	if err != nil {
+		q.Close()
+		dq.Close()
+		return err
+	}
+	failedEvents, err := dq.Size()
+	if err != nil {
+		q.Close()
+		dq.Close()
+		return err
+	}
+	sub := &subscriber{
+		name:         name,
+		callbacks:    map[EventType]callbackFunc{},
+		queue:        q,
+		deadLetters:  dq,
+		notify:       make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		pending:      pending,
+		failedEvents: failedEvents,
+	}
+	for etype, callback := range callbacks {
+		h.log.Info("new subscription", "type", etype, "name", name, "mode", Async)
+		sub.callbacks[etype] = callback
+		h.subscribers[etype][name] = sub
+	}
+	h.all[name] = sub
+	go h.worker(sub)
+	// Deliver the events queued before a restart
+	sub.wakeUp()
+	return nil
 }
 
 func (h *Hub) newEvent(ctx context.Context, etype EventType, blob *blob.Blob, data interface{}) error {
 	l := h.log.New("type", etype, "blob", blob, "data", data)
 	l.Debug("new event")
-	for name, callback := range h.subscribers[etype] {
-		h.log.Debug("triggering callback", "name", name)
-		if err := callback(ctx, blob, data); err != nil {
+	h.mu.Lock()
+	subs := make([]*subscriber, 0, len(h.subscribers[etype]))
+	for _, sub := range h.subscribers[etype] {
+		subs = append(subs, sub)
+	}
+	h.mu.Unlock()
+
+	// Every subscriber is notified, even if a sync callback fails
+	var errs []error
+	var msgs []string
+	for _, sub := range subs {
+		if sub.queue != nil {
+			ns, _ := ctxutil.Namespace(ctx)
+			// Count the event before the worker can dequeue it
+			sub.updatePending(1)
+			if err := sub.queue.Enqueue(&event{Type: etype, Hash: blob.Hash, Namespace: ns, Time: time.Now().UTC()}); err != nil {
+				sub.updatePending(-1)
+				errs = append(errs, err)
+				msgs = append(msgs, fmt.Sprintf("%s: failed to queue event: %v", sub.name, err))
+				continue
+			}
+			sub.wakeUp()
+			continue
+		}
+		h.log.Debug("triggering callback", "name", sub.name)
+		sub.mu.Lock()
+		callback := sub.callbacks[etype]
+		sub.mu.Unlock()
+		err := callback(ctx, blob, data)
+		sub.record(err)
+		if err != nil {
+			errs = append(errs, err)
+			msgs = append(msgs, fmt.Sprintf("%s: %v", sub.name, err))
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		// Return the error as is, so it can still be checked by the caller
+		return errs[0]
+	default:
+		sort.Strings(msgs)
+		return fmt.Errorf("%s event failed for subscribers: %s", etype, strings.Join(msgs, ", "))
+	}
+}
+
+// wakeUp notifies the async worker that a new event is available
+func (s *subscriber) wakeUp() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// updatePending updates the number of queued events
+func (s *subscriber) updatePending(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending += delta
+}
+
+// done removes the event from the queue
+func (s *subscriber) done(deqFunc func(bool)) {
+	deqFunc(true)
+	s.updatePending(-1)
+}
+
+// park moves the event to the dead-letter queue
+func (s *subscriber) park(evt *event, deqFunc func(bool), err error) error {
+	evt.Error = err.Error()
+	if err := s.deadLetters.Enqueue(evt); err != nil {
+		return err
+	}
+	s.done(deqFunc)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failedEvents++
+	return nil
+}
+
+// record updates the delivery state
+func (s *subscriber) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.delivered++
+		return
+	}
+	now := time.Now().UTC()
+	s.failed++
+	s.lastError = err.Error()
+	s.lastErrorAt = &now
+}
+
+// worker delivers the queued events of an async subscriber, in order
+func (h *Hub) worker(sub *subscriber) {
+	defer close(sub.stopped)
+	l := h.log.New("name", sub.name)
+	delay := minRetryDelay
+	var attempts int
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-sub.notify:
+		}
+
+		for {
+			evt := &event{}
+			ok, deqFunc, err := sub.queue.Dequeue(evt)
+			if err != nil {
+				l.Error("failed to dequeue event", "err", err)
+				sub.record(err)
+				if deqFunc == nil {
+					// Wait for the next event
+					break
+				}
+				// Skip the malformed event
+				sub.done(deqFunc)
+				continue
+			}
+			if !ok {
+				break
+			}
+			sub.mu.Lock()
+			callback, ok := sub.callbacks[evt.Type]
+			sub.mu.Unlock()
+			if !ok {
+				sub.done(deqFunc)
+				continue
+			}
+			ctx := context.Background()
+			if evt.Namespace != "" {
+				ctx = ctxutil.WithNamespace(ctx, evt.Namespace)
+			}
+			l.Debug("triggering async callback", "type", evt.Type, "hash", evt.Hash)
+			err = callback(ctx, &blob.Blob{Hash: evt.Hash}, nil)
+			sub.record(err)
+			if err == nil {
+				sub.done(deqFunc)
+				delay = minRetryDelay
+				attempts = 0
+				continue
+			}
+
+			attempts++
+			if attempts >= maxAttempts {
+				// Give up, so the next events can be delivered
+				l.Error("async callback failed, parking the event", "type", evt.Type, "hash", evt.Hash, "err", err, "attempts", attempts)
+				perr := sub.park(evt, deqFunc, err)
+				if perr == nil {
+					delay = minRetryDelay
+					attempts = 0
+					continue
+				}
+				l.Error("failed to park the event", "err", perr)
+			}
+
+			// Keep the event in the queue, and retry later
+			deqFunc(false)
+			l.Error("async callback failed", "type", evt.Type, "hash", evt.Hash, "err", err, "retry_in", delay)
+			select {
+			case <-sub.stop:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+	}
+}
+
+// Status returns the delivery state of every subscriber
+func (h *Hub) Status() ([]*Status, error) {
+	h.mu.Lock()
+	subs := make([]*subscriber, 0, len(h.all))
+	for _, sub := range h.all {
+		subs = append(subs, sub)
+	}
+	h.mu.Unlock()
+	sort.Slice(subs, func(i, j int) bool { return subs[i].name < subs[j].name })
+
+	out := []*Status{}
+	for _, sub := range subs {
+		status := &Status{Name: sub.name, Mode: Sync, Events: []string{}}
+		sub.mu.Lock()
+		for etype := range sub.callbacks {
+			status.Events = append(status.Events, etype.String())
+		}
+		status.Delivered = sub.delivered
+		status.Failed = sub.failed
+		status.LastError = sub.lastError
+		status.LastErrorAt = sub.lastErrorAt
+		status.Pending = sub.pending
+		status.FailedEvents = sub.failedEvents
+		sub.mu.Unlock()
+		sort.Strings(status.Events)
+
+		if sub.queue != nil {
+			status.Mode = Async
+			if status.Pending > 0 {
+				evt := &event{}
+				ok, deqFunc, err := sub.queue.Dequeue(evt)
+				if err == nil && ok {
+					deqFunc(false)
+					status.OldestPending = &evt.Time
+				}
+			}
+		}
+		out = append(out, status)
+	}
+	return out, nil
+}
+
+// Close stops the async workers, the pending events will be delivered after a restart
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sub := range h.all {
+		if sub.queue == nil {
+			continue
+		}
+		close(sub.stop)
+		<-sub.stopped
+		if err := sub.queue.Close(); err != nil {
+			return err
+		}
+		if err := sub.deadLetters.Close(); err != nil {
 			return err
 		}
 	}
@@ -47,13 +443,29 @@ func (h *Hub) ScanBlobEvent(ctx context.Context, blob *blob.Blob, data interface
 	return h.newEvent(ctx, ScanBlob, blob, data)
 }
 
+func (h *Hub) GarbageCollectionEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, GarbageCollection, blob, data)
+}
+
+func (h *Hub) DeleteBlobEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, DeleteBlob, blob, data)
+}
+
+func (h *Hub) ExistingBlobEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, ExistingBlob, blob, data)
+}
+
 func New(logger log.Logger) *Hub {
 	logger.Debug("init")
 	return &Hub{
 		log: logger,
-		subscribers: map[EventType]map[string]func(context.Context, *blob.Blob, interface{}) error{
-			NewBlob:  map[string]func(context.Context, *blob.Blob, interface{}) error{},
-			ScanBlob: map[string]func(context.Context, *blob.Blob, interface{}) error{},
+		subscribers: map[EventType]map[string]*subscriber{
+			NewBlob:           map[string]*subscriber{},
+			ScanBlob:          map[string]*subscriber{},
+			GarbageCollection: map[string]*subscriber{},
+			DeleteBlob:        map[string]*subscriber{},
+			ExistingBlob:      map[string]*subscriber{},
 		},
+		all: map[string]*subscriber{},
 	}
 }
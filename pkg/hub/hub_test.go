@@ -0,0 +1,267 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/ctxutil"
+)
+
+// newTestHub returns a hub along with a temp dir for the queues, the returned func removes the dir
+func newTestHub(t *testing.T) (*Hub, string, func()) {
+	dir, err := ioutil.TempDir("", "hub_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	return New(logger), dir, func() { os.RemoveAll(dir) }
+}
+
+// subStatus returns the status of the given subscriber
+func subStatus(t *testing.T, h *Hub, name string) *Status {
+	t.Helper()
+	statuses, err := h.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range statuses {
+		if st.Name == name {
+			return st
+		}
+	}
+	t.Fatalf("subscriber %s not found", name)
+	return nil
+}
+
+func TestAsyncRetry(t *testing.T) {
+	minRetryDelay = 10 * time.Millisecond
+	h, dir, cleanup := newTestHub(t)
+	defer cleanup()
+	defer h.Close()
+
+	// The first two attempts fail
+	var attempts int
+	delivered := make(chan string, 1)
+	if err := h.SubscribeAsync("async", filepath.Join(dir, "async.queue"), map[EventType]func(context.Context, *blob.Blob, interface{}) error{
+		NewBlob: func(ctx context.Context, b *blob.Blob, _ interface{}) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("not yet")
+			}
+			delivered <- b.Hash
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := blob.New([]byte("ok"))
+	if err := h.NewBlobEvent(context.Background(), b, nil); err != nil {
+		t.Fatalf("a failing async subscriber should not fail the event: %v", err)
+	}
+	select {
+	case hash := <-delivered:
+		if hash != b.Hash {
+			t.Errorf("expected %s, got %s", b.Hash, hash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the event has not been delivered")
+	}
+
+	// The worker records the delivery after the callback returns
+	var st *Status
+	for i := 0; i < 100; i++ {
+		if st = subStatus(t, h, "async"); st.Delivered == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.Mode != Async || st.Delivered != 1 || st.Failed != 2 || st.LastError != "not yet" || st.Pending != 0 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+func TestAsyncRestart(t *testing.T) {
+	minRetryDelay = 10 * time.Millisecond
+	h, dir, cleanup := newTestHub(t)
+	defer cleanup()
+	path := filepath.Join(dir, "async.queue")
+
+	// Nothing is delivered before the close
+	if err := h.SubscribeAsync("async", path, map[EventType]func(context.Context, *blob.Blob, interface{}) error{
+		NewBlob: func(context.Context, *blob.Blob, interface{}) error { return errors.New("down") },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var blobs []*blob.Blob
+	for _, data := range []string{"blob 1", "blob 2", "blob 3"} {
+		b := blob.New([]byte(data))
+		if err := h.NewBlobEvent(ctxutil.WithNamespace(context.Background(), "ns"), b, nil); err != nil {
+			t.Fatal(err)
+		}
+		blobs = append(blobs, b)
+	}
+	if st := subStatus(t, h, "async"); st.Pending != 3 || st.OldestPending == nil {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued events are delivered in order after reopening
+	h = New(h.log)
+	defer h.Close()
+	var mu sync.Mutex
+	var hashes []string
+	done := make(chan struct{})
+	if err := h.SubscribeAsync("async", path, map[EventType]func(context.Context, *blob.Blob, interface{}) error{
+		NewBlob: func(ctx context.Context, b *blob.Blob, _ interface{}) error {
+			if ns, _ := ctxutil.Namespace(ctx); ns != "ns" {
+				t.Errorf("the namespace should be kept, got %q", ns)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			hashes = append(hashes, b.Hash)
+			if len(hashes) == len(blobs) {
+				close(done)
+			}
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the queued events have not been delivered")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, b := range blobs {
+		if hashes[i] != b.Hash {
+			t.Errorf("events delivered out of order: %v", hashes)
+			break
+		}
+	}
+}
+
+func TestSyncFailure(t *testing.T) {
+	h, _, cleanup := newTestHub(t)
+	defer cleanup()
+	defer h.Close()
+
+	called := map[string]int{}
+	errFailing := errors.New("failing")
+	subscribe := func(name string, err error) {
+		h.Subscribe(NewBlob, name, func(context.Context, *blob.Blob, interface{}) error {
+			called[name]++
+			return err
+		})
+	}
+	subscribe("a", nil)
+	subscribe("failing", errFailing)
+	subscribe("z", nil)
+
+	// Every subscriber is called, and a single error is returned as is
+	if err := h.NewBlobEvent(context.Background(), blob.New([]byte("ok")), nil); err != errFailing {
+		t.Errorf("expected errFailing, got %v", err)
+	}
+	for _, name := range []string{"a", "failing", "z"} {
+		if called[name] != 1 {
+			t.Errorf("subscriber %s should have been called once, got %d", name, called[name])
+		}
+	}
+
+	// The errors are combined
+	subscribe("failing2", errors.New("failing too"))
+	err := h.NewBlobEvent(context.Background(), blob.New([]byte("ok")), nil)
+	if err == nil || !strings.Contains(err.Error(), "failing: failing") || !strings.Contains(err.Error(), "failing2: failing too") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if called["a"] != 2 || called["z"] != 2 {
+		t.Errorf("every subscriber should have been called, got %v", called)
+	}
+	if st := subStatus(t, h, "failing"); st.Mode != Sync || st.Failed != 2 || st.LastError != "failing" {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if st := subStatus(t, h, "a"); st.Delivered != 2 || st.Failed != 0 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+func TestAsyncDeadLetter(t *testing.T) {
+	minRetryDelay = 10 * time.Millisecond
+	defer func(max int) { maxAttempts = max }(maxAttempts)
+	maxAttempts = 3
+	h, dir, cleanup := newTestHub(t)
+	defer cleanup()
+	path := filepath.Join(dir, "async.queue")
+
+	// The poisoned event always fails, it must not block the next one
+	poisoned, ok := blob.New([]byte("poisoned")), blob.New([]byte("ok"))
+	delivered := make(chan string, 1)
+	callbacks := map[EventType]func(context.Context, *blob.Blob, interface{}) error{
+		NewBlob: func(ctx context.Context, b *blob.Blob, _ interface{}) error {
+			if b.Hash == poisoned.Hash {
+				return errors.New("poisoned")
+			}
+			delivered <- b.Hash
+			return nil
+		},
+	}
+	if err := h.SubscribeAsync("async", path, callbacks); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*blob.Blob{poisoned, ok} {
+		if err := h.NewBlobEvent(context.Background(), b, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case hash := <-delivered:
+		if hash != ok.Hash {
+			t.Errorf("expected %s, got %s", ok.Hash, hash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the event after the poisoned one has not been delivered")
+	}
+	var st *Status
+	for i := 0; i < 100; i++ {
+		if st = subStatus(t, h, "async"); st.Delivered == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.Delivered != 1 || st.Failed != 3 || st.FailedEvents != 1 || st.Pending != 0 || st.OldestPending != nil {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parked event is kept in the dead-letter queue
+	h = New(h.log)
+	defer h.Close()
+	if err := h.SubscribeAsync("async", path, callbacks); err != nil {
+		t.Fatal(err)
+	}
+	if st := subStatus(t, h, "async"); st.FailedEvents != 1 || st.Pending != 0 {
+		t.Errorf("unexpected status after a restart %+v", st)
+	}
+	evt := &event{}
+	found, _, err := h.all["async"].deadLetters.Dequeue(evt)
+	if err != nil || !found || evt.Hash != poisoned.Hash || evt.Error != "poisoned" {
+		t.Errorf("unexpected dead letter %+v (err=%v)", evt, err)
+	}
+}
@@ -63,18 +63,22 @@ func New(logger log.Logger, conf *config.Config, blobStore *blobstore.BlobStore,
 		conf:      conf,
 		vkv:       kv,
 	}
-	metaHandler.RegisterApplyFunc(KvType, kvStore.applyMetaFunc)
+	metaHandler.RegisterType(&meta.Type{
+		Name:          KvType,
+		Version:       vkv.CurrentSchemaVersion,
+		SchemaVersion: vkv.DecodeSchemaVersion,
+		Migrations: map[int]func([]byte) ([]byte, error){
+			// The format did not change when the schema version was added
+			0: func(data []byte) ([]byte, error) { return data, nil },
+		},
+		Apply: kvStore.applyMetaFunc,
+	})
 	return kvStore, nil
 }
 
 func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 	kv.log.Debug("Apply meta init", "hash", hash)
-	// applied, err := kv.vkv.MetaBlobApplied(hash)
-	// if err != nil {
-	// return err
-	// }
-	// if !applied {
-	// kv.log.Debug("meta not yet applied")
+	// The applied meta blobs are tracked by the meta index
 	rkv, err := vkv.UnserializeBlob(data)
 	if err != nil {
 		return fmt.Errorf("failed to unserialize blob: %v", err)
@@ -83,7 +87,6 @@ func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 		return fmt.Errorf("failed to put: %v", err)
 	}
 	kv.log.Debug("Applied meta", "kv", rkv)
-	// }
 	return nil
 }
 
@@ -0,0 +1,80 @@
+package meta // import "a4.io/blobstash/pkg/meta"
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/httputil"
+)
+
+func (m *Meta) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/types", basicAuth(http.HandlerFunc(m.typesHandler())))
+	r.Handle("/reindex", basicAuth(http.HandlerFunc(m.reindexReportHandler())))
+	r.Handle("/reindex/{type}", basicAuth(http.HandlerFunc(m.reindexHandler())))
+}
+
+// typesHandler returns the state of the meta types (including the unknown ones with parked meta blobs)
+func (m *Meta) typesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			types, err := m.TypesStatus()
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, map[string]interface{}{
+				"types": types,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (m *Meta) reindexReportHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			report, running := m.LastReindex()
+			httputil.WriteJSON(w, map[string]interface{}{
+				"types":       m.Types(),
+				"running":     running,
+				"last_report": report,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// reindexHandler starts the reindex of the given meta type (`?full=1` to clear the index first)
+func (m *Meta) reindexHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			metaType := mux.Vars(r)["type"]
+			if _, ok := m.types[metaType]; !ok {
+				err := &unknownTypeError{metaType}
+				httputil.WriteJSONError(w, err.Status(), err.Error())
+				return
+			}
+			if _, running := m.LastReindex(); running {
+				httputil.WriteJSONError(w, http.StatusConflict, ErrAlreadyRunning.Error())
+				return
+			}
+			full := r.URL.Query().Get("full") == "1"
+			// The result will be available in the report
+			go func() {
+				if _, err := m.Reindex(context.Background(), metaType, full); err != nil {
+					m.log.Error("reindex failed", "type", metaType, "err", err)
+				}
+			}()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -1,3 +1,16 @@
+/*
+
+Package meta implements the meta blobs, the blobs used to rebuild the indexes (e.g. the key-value store).
+
+Every meta blob is recorded in a disk-backed index (by type), along with a flag telling whether it has already been
+applied, so the indexes can be rebuilt by only reading the meta blobs (see `Reindex`).
+
+Each meta type is registered with its current schema version, and the migrations from the older versions. The meta
+blobs that can't be applied yet (unknown type, or a schema version newer than the registered one, e.g. when syncing
+from a newer peer) are parked: they're kept in the index as not applied, and applied on the next start once the type
+is known (see `Resume`).
+
+*/
 package meta // import "a4.io/blobstash/pkg/meta"
 
 import (
@@ -5,10 +18,16 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 
+	"github.com/cznic/kv"
 	log "github.com/inconshreveable/log15"
 
 	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/hub"
 )
 
@@ -24,42 +43,181 @@ type MetaData interface {
 	// Load([]byte)
 }
 
+// Type describes a meta type
+type Type struct {
+	Name string
+
+	// The current schema version
+	Version int
+
+	// SchemaVersion returns the schema version of the serialized data (optional, the data is considered to be at the
+	// current version if not set)
+	SchemaVersion func(data []byte) (int, error)
+
+	// Migrations upgrade the serialized data from a schema version (the key) to the next one
+	Migrations map[int]func(data []byte) ([]byte, error)
+
+	// Apply updates the index using the data (always at the current schema version)
+	Apply func(hash string, data []byte) error
+
+	// Reset clears the index, called before a full reindex (optional, the meta blobs are applied again over the
+	// existing index if not set)
+	Reset func() error
+}
+
+// parkedError is returned when a meta blob can't be applied yet
+type parkedError struct {
+	reason string
+}
+
+func (e *parkedError) Error() string { return fmt.Sprintf("meta blob parked: %s", e.reason) }
+
+// decode returns the data upgraded to the current schema version
+func (t *Type) decode(data []byte) ([]byte, error) {
+	if t.SchemaVersion == nil {
+		return data, nil
+	}
+	version, err := t.SchemaVersion(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the schema version: %v", err)
+	}
+	if version > t.Version {
+		return nil, &parkedError{fmt.Sprintf("unsupported %s schema version %d (current is %d)", t.Name, version, t.Version)}
+	}
+	for ; version < t.Version; version++ {
+		migration, ok := t.Migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("no migration for %s schema version %d", t.Name, version)
+		}
+		if data, err = migration(data); err != nil {
+			return nil, fmt.Errorf("failed to migrate %s from schema version %d: %v", t.Name, version, err)
+		}
+	}
+	return data, nil
+}
+
 type Meta struct {
-	log        log.Logger
-	applyFuncs map[string]func(string, []byte) error // map[<metadata type>]<load func>
-	hub        *hub.Hub
+	log       log.Logger
+	types     map[string]*Type
+	hub       *hub.Hub
+	blobStore *blobstore.BlobStore
+
+	db *kv.DB
+
+	lastReindex *ReindexReport
+	running     bool
+	mu          sync.Mutex
 }
 
-func New(logger log.Logger, chub *hub.Hub) (*Meta, error) {
+func New(logger log.Logger, conf *config.Config, blobStore *blobstore.BlobStore, chub *hub.Hub) (*Meta, error) {
+	logger.Debug("init")
+	path := filepath.Join(conf.VarDir(), "meta.index")
+	createOpen := kv.Open
+	created := false
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		createOpen = kv.Create
+		created = true
+	}
+	db, err := createOpen(path, &kv.Options{})
+	if err != nil {
+		return nil, err
+	}
 	meta := &Meta{
-		log:        logger,
-		hub:        chub,
-		applyFuncs: map[string]func(string, []byte) error{},
+		log:       logger,
+		hub:       chub,
+		blobStore: blobStore,
+		db:        db,
+		types:     map[string]*Type{},
+	}
+	if created {
+		// The existing meta blobs will be discovered by the first reindex
+		empty, err := blobStore.Enumerate(context.Background(), "", "\xff", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(empty) == 0 {
+			if err := db.Set(keyComplete, []byte{1}); err != nil {
+				return nil, err
+			}
+		}
 	}
 	// Subscribe to "new blob" notification
 	meta.hub.Subscribe(hub.NewBlob, "meta", meta.newBlobCallback)
-	meta.hub.Subscribe(hub.ScanBlob, "meta", meta.newBlobCallback)
-	// XXX(tsileo): register to ScanBlob event too?
+	meta.hub.Subscribe(hub.ScanBlob, "meta", meta.scanBlobCallback)
 	return meta, nil
 }
 
+// Close the underlying db file.
+func (m *Meta) Close() error {
+	return m.db.Close()
+}
+
 func (m *Meta) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
+	return m.apply(blob, false)
+}
+
+// scanBlobCallback applies the meta blobs even if they're already applied, as the indexes may have been removed
+func (m *Meta) scanBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
+	return m.apply(blob, true)
+}
+
+// apply records the meta blob, and calls the apply func of its type (unless the blob is already applied)
+func (m *Meta) apply(blob *blob.Blob, force bool) error {
 	metaType, metaData, isMeta := IsMetaBlob(blob.Data)
 	m.log.Debug("newBlobCallback", "is_meta", isMeta, "meta_type", metaType, "blob_size", len(blob.Data))
-	if isMeta {
-		m.log.Debug("blob callback", "blob", string(blob.Data))
-		// TODO(tsileo): should we check for already applied blobs and use the same callback for both scan and new blob?
-		if _, ok := m.applyFuncs[metaType]; !ok {
-			return fmt.Errorf("Unknown meta type \"%s\"", metaType)
+	if !isMeta {
+		return nil
+	}
+	m.log.Debug("blob callback", "blob", string(blob.Data))
+	applied, err := m.applied(metaType, blob.Hash)
+	if err != nil {
+		return err
+	}
+	if applied && !force {
+		return nil
+	}
+	if !applied {
+		// Record the meta blob first, so it's found by a reindex even if it can't be applied yet
+		if err := m.db.Set(encodeKey(metaType, blob.Hash), []byte{0}); err != nil {
+			return err
+		}
+	}
+	if err := m.applyData(metaType, blob.Hash, blob.Data, metaData); err != nil {
+		if perr, ok := err.(*parkedError); ok {
+			// Don't fail the upload, the blob will be applied once the type is upgraded
+			m.log.Info("meta blob parked", "hash", blob.Hash, "type", metaType, "reason", perr.reason)
+			return nil
 		}
-		return m.applyFuncs[metaType](blob.Hash, metaData)
+		return err
+	}
+	return m.db.Set(encodeKey(metaType, blob.Hash), []byte{1})
+}
+
+// applyData decodes and applies the meta blob data, returns a `*parkedError` if it can't be applied yet
+func (m *Meta) applyData(metaType, hash string, blob, metaData []byte) error {
+	if version := metaBlobVersion(blob); version > MetaBlobVersion {
+		return &parkedError{fmt.Sprintf("unsupported meta blob version %d", version)}
+	}
+	t, ok := m.types[metaType]
+	if !ok {
+		return &parkedError{fmt.Sprintf("unknown meta type \"%s\"", metaType)}
+	}
+	data, err := t.decode(metaData)
+	if err != nil {
+		return err
 	}
-	return nil
+	return t.Apply(hash, data)
+}
+
+// RegisterType registers a meta type
+func (m *Meta) RegisterType(t *Type) {
+	m.log.Debug("new meta type", "type", t.Name, "version", t.Version)
+	m.types[t.Name] = t
 }
 
-// RegisterApplyFunc registers a callback func for the given meta type
+// RegisterApplyFunc registers a callback func for the given meta type (without schema versioning)
 func (m *Meta) RegisterApplyFunc(t string, f func(string, []byte) error) {
-	m.applyFuncs[t] = f
+	m.RegisterType(&Type{Name: t, Apply: f})
 }
 
 // Build convert the MetaData into a blo
@@ -85,9 +243,9 @@ func (m *Meta) Build(data MetaData) (*blob.Blob, error) {
 	return metaBlob, nil
 }
 
-func (m *Meta) Scan() error {
-	// FIXME(ts): Scan
-	return nil
+// metaBlobVersion returns the version of the meta blob format
+func metaBlobVersion(blob []byte) int {
+	return int(binary.BigEndian.Uint32(blob[MetaBlobOverhead : MetaBlobOverhead+4]))
 }
 
 func IsMetaBlob(blob []byte) (string, []byte, bool) { // returns (string, bool) string => meta type
@@ -0,0 +1,242 @@
+package meta
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+)
+
+// newTestMeta returns a Meta on top of a temp BlobStore (`blobstoretest` can't be used as it depends on this package)
+func newTestMeta(t *testing.T) (*Meta, *blobstore.BlobStore, func()) {
+	dir, err := ioutil.TempDir("", "meta_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{DataDir: dir, BlobStore: &config.BlobStoreConfig{Backend: blobstore.BackendBlobsDir}}
+	chub := hub.New(logger)
+	bs, err := blobstore.New(logger, conf, chub)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	m, err := New(logger, conf, bs, chub)
+	if err != nil {
+		bs.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return m, bs, func() {
+		chub.Close()
+		m.Close()
+		bs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+type testData struct {
+	metaType string
+	data     string
+}
+
+func (d *testData) Type() string          { return d.metaType }
+func (d *testData) Dump() ([]byte, error) { return []byte(d.data), nil }
+
+// putMeta saves a meta blob, and returns its hash
+func putMeta(t *testing.T, m *Meta, bs *blobstore.BlobStore, metaType, data string) string {
+	t.Helper()
+	mblob, err := m.Build(&testData{metaType, data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Put(context.Background(), mblob); err != nil {
+		t.Fatal(err)
+	}
+	return mblob.Hash
+}
+
+// typeStatus returns the status of the given meta type
+func typeStatus(t *testing.T, m *Meta, name string) *TypeStatus {
+	t.Helper()
+	types, err := m.TypesStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range types {
+		if status.Name == name {
+			return status
+		}
+	}
+	t.Fatalf("meta type %s not found", name)
+	return nil
+}
+
+// versioned returns a "note" type at the given schema version, the data is prefixed by "v<version>:" (no prefix for
+// the version 0), the applied data is appended to `applied`
+func versioned(version int, applied *[]string) *Type {
+	return &Type{
+		Name:    "note",
+		Version: version,
+		SchemaVersion: func(data []byte) (int, error) {
+			var v int
+			if _, err := fmt.Sscanf(string(data), "v%d:", &v); err != nil {
+				return 0, nil
+			}
+			return v, nil
+		},
+		Migrations: map[int]func([]byte) ([]byte, error){
+			0: func(data []byte) ([]byte, error) { return []byte("v1:" + string(data)), nil },
+			1: func(data []byte) ([]byte, error) {
+				return []byte(strings.Replace(string(data), "v1:", "v2:", 1)), nil
+			},
+		},
+		Apply: func(hash string, data []byte) error {
+			*applied = append(*applied, string(data))
+			return nil
+		},
+	}
+}
+
+func TestParkedMetaBlobs(t *testing.T) {
+	m, bs, cleanup := newTestMeta(t)
+	defer cleanup()
+
+	// An unknown type is parked, the upload doesn't fail
+	putMeta(t, m, bs, "note", "v1:unknown type")
+	if status := typeStatus(t, m, "note"); status.Registered || status.Count != 1 || status.Pending != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// A schema version newer than the registered one is parked too
+	var applied []string
+	m.RegisterType(versioned(1, &applied))
+	putMeta(t, m, bs, "note", "v2:newer version")
+	if status := typeStatus(t, m, "note"); !status.Registered || status.Count != 2 || status.Pending != 2 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if len(applied) != 0 {
+		t.Errorf("nothing should have been applied, got %v", applied)
+	}
+
+	// Both are applied once the type is upgraded
+	m.RegisterType(versioned(2, &applied))
+	if err := m.Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := typeStatus(t, m, "note"); status.Pending != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if len(applied) != 2 {
+		t.Errorf("expected 2 meta blobs applied, got %v", applied)
+	}
+	for _, data := range applied {
+		if !strings.HasPrefix(data, "v2:") {
+			t.Errorf("the data should have been migrated, got %q", data)
+		}
+	}
+
+	// Nothing left to apply
+	applied = nil
+	if err := m.Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("nothing should have been applied again, got %v", applied)
+	}
+}
+
+func TestMigration(t *testing.T) {
+	m, bs, cleanup := newTestMeta(t)
+	defer cleanup()
+	var applied []string
+	m.RegisterType(versioned(2, &applied))
+
+	putMeta(t, m, bs, "note", "legacy")
+	putMeta(t, m, bs, "note", "v1:old")
+	putMeta(t, m, bs, "note", "v2:current")
+	expected := []string{"v2:legacy", "v2:old", "v2:current"}
+	if fmt.Sprintf("%v", applied) != fmt.Sprintf("%v", expected) {
+		t.Errorf("expected %v, got %v", expected, applied)
+	}
+
+	// A missing migration fails the upload
+	t2 := versioned(2, &applied)
+	delete(t2.Migrations, 0)
+	m.RegisterType(t2)
+	mblob, err := m.Build(&testData{"note", "no migration"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Put(context.Background(), mblob); err == nil {
+		t.Errorf("a meta blob without migration should fail")
+	}
+}
+
+func TestResumeReindex(t *testing.T) {
+	m, bs, cleanup := newTestMeta(t)
+	defer cleanup()
+	var applied []string
+	var resets int
+	note := versioned(2, &applied)
+	note.Reset = func() error {
+		resets++
+		return nil
+	}
+	m.RegisterType(note)
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		hashes = append(hashes, putMeta(t, m, bs, "note", fmt.Sprintf("v2:note %d", i)))
+	}
+
+	// A full reindex interrupted after the reset, and the first blob
+	applied = nil
+	if err := m.clearApplied("note"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.db.Set(encodeKey("note", hashes[0]), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.saveState(&reindexState{Type: "note", Full: true, Reset: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reindex is resumed where it stopped
+	if err := m.Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resets != 0 {
+		t.Errorf("the index should not be reset again")
+	}
+	if len(applied) != 2 {
+		t.Errorf("expected 2 meta blobs applied, got %v", applied)
+	}
+	report, running := m.LastReindex()
+	if running || report == nil || !report.Full || report.Applied != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if state, err := m.state(); err != nil || state != nil {
+		t.Errorf("the reindex state should have been removed, got %+v (err=%v)", state, err)
+	}
+
+	// A full reindex interrupted before the reset starts over
+	applied = nil
+	if err := m.saveState(&reindexState{Type: "note", Full: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resets != 1 || len(applied) != 3 {
+		t.Errorf("expected a reset and 3 meta blobs applied, got %d resets and %v", resets, applied)
+	}
+}
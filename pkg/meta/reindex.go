@@ -0,0 +1,370 @@
+package meta // import "a4.io/blobstash/pkg/meta"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/blob"
+)
+
+var ErrAlreadyRunning = errors.New("reindex already running")
+
+// unknownTypeError implements `httputil.PublicErrorer`, returned when trying to reindex an unknown meta type
+type unknownTypeError struct {
+	metaType string
+}
+
+func (e *unknownTypeError) Error() string { return fmt.Sprintf("unknown meta type \"%s\"", e.metaType) }
+func (e *unknownTypeError) Status() int   { return http.StatusNotFound }
+
+// Index keys, the meta blobs are stored as `t:<type>:<hash>` => <applied flag>
+var (
+	// Set once all the existing blobs have been checked for meta blobs
+	keyComplete = []byte("_complete")
+	// Set while a reindex is running, so it can be resumed after a crash
+	keyReindex = []byte("_reindex")
+)
+
+func encodeKey(metaType, hash string) []byte {
+	return []byte(fmt.Sprintf("t:%s:%s", metaType, hash))
+}
+
+// ReindexReport holds the result of a reindex
+type ReindexReport struct {
+	Type       string    `json:"type"`
+	Full       bool      `json:"full"`
+	Started    time.Time `json:"started"`
+	Duration   string    `json:"duration"`
+	Discovered int       `json:"discovered_count"`
+	Applied    int       `json:"applied_count"`
+	Parked     int       `json:"parked_count"`
+	Failed     []string  `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// reindexState is saved while a reindex is running
+type reindexState struct {
+	Type  string `json:"type"`
+	Full  bool   `json:"full"`
+	Reset bool   `json:"reset"` // true once the index has been cleared (for a full reindex)
+}
+
+// applied returns true if the meta blob has already been applied
+func (m *Meta) applied(metaType, hash string) (bool, error) {
+	v, err := m.db.Get(nil, encodeKey(metaType, hash))
+	if err != nil {
+		return false, err
+	}
+	return len(v) > 0 && v[0] == 1, nil
+}
+
+// Types returns the meta types that can be reindexed
+func (m *Meta) Types() []string {
+	var types []string
+	for t := range m.types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// TypeStatus holds the state of a meta type
+type TypeStatus struct {
+	Name       string `json:"name"`
+	Registered bool   `json:"registered"`
+	Version    int    `json:"version,omitempty"`
+	Count      int    `json:"blobs_count"`
+	Pending    int    `json:"pending_count"` // meta blobs not applied yet (parked, or failed)
+}
+
+// TypesStatus returns the state of every meta type, including the unknown types with parked meta blobs
+func (m *Meta) TypesStatus() ([]*TypeStatus, error) {
+	index := map[string]*TypeStatus{}
+	for name, t := range m.types {
+		index[name] = &TypeStatus{Name: name, Registered: true, Version: t.Version}
+	}
+	enum, _, err := m.db.Seek([]byte("t:"))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF || (err == nil && !bytes.HasPrefix(k, []byte("t:"))) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(string(k), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		status, ok := index[parts[1]]
+		if !ok {
+			status = &TypeStatus{Name: parts[1]}
+			index[parts[1]] = status
+		}
+		status.Count++
+		if len(v) == 0 || v[0] != 1 {
+			status.Pending++
+		}
+	}
+	out := []*TypeStatus{}
+	for _, status := range index {
+		out = append(out, status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// LastReindex returns the report of the last reindex (nil if it never ran), and true if one is currently running
+func (m *Meta) LastReindex() (*ReindexReport, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastReindex, m.running
+}
+
+// Resume restarts the reindex interrupted by a crash (if any), and applies the parked meta blobs of the registered
+// types, must be called once all the types are registered
+func (m *Meta) Resume(ctx context.Context) error {
+	state, err := m.state()
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		m.log.Info("resuming reindex", "type", state.Type, "full", state.Full)
+		if _, err := m.reindex(ctx, state); err != nil {
+			return err
+		}
+	}
+
+	types, err := m.TypesStatus()
+	if err != nil {
+		return err
+	}
+	for _, t := range types {
+		if !t.Registered || t.Pending == 0 {
+			continue
+		}
+		m.log.Info("applying parked meta blobs", "type", t.Name, "pending", t.Pending)
+		if _, err := m.reindex(ctx, &reindexState{Type: t.Name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reindex applies the meta blobs of the given type that are not applied yet (by only reading the meta blobs), if
+// `full` is true, the index is cleared first (if the type supports it), and all the meta blobs are applied again
+func (m *Meta) Reindex(ctx context.Context, metaType string, full bool) (*ReindexReport, error) {
+	if _, ok := m.types[metaType]; !ok {
+		return nil, &unknownTypeError{metaType}
+	}
+	return m.reindex(ctx, &reindexState{Type: metaType, Full: full})
+}
+
+func (m *Meta) state() (*reindexState, error) {
+	v, err := m.db.Get(nil, keyReindex)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	state := &reindexState{}
+	if err := json.Unmarshal(v, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (m *Meta) saveState(state *reindexState) error {
+	js, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return m.db.Set(keyReindex, js)
+}
+
+func (m *Meta) reindex(ctx context.Context, state *reindexState) (*ReindexReport, error) {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return nil, ErrAlreadyRunning
+	}
+	m.running = true
+	m.mu.Unlock()
+
+	start := time.Now()
+	report := &ReindexReport{Type: state.Type, Full: state.Full, Started: start.UTC(), Failed: []string{}}
+	m.log.Info("starting reindex", "type", state.Type, "full", state.Full)
+	if err := m.doReindex(ctx, state, report); err != nil {
+		// Keep the partial report, the reindex will be resumed on the next start
+		report.Error = err.Error()
+	}
+	report.Duration = time.Since(start).String()
+	m.log.Info("reindex done", "type", state.Type, "discovered", report.Discovered, "applied", report.Applied, "parked", report.Parked, "failed", len(report.Failed), "duration", report.Duration)
+
+	m.mu.Lock()
+	m.running = false
+	m.lastReindex = report
+	m.mu.Unlock()
+
+	if report.Error != "" {
+		return report, errors.New(report.Error)
+	}
+	return report, nil
+}
+
+func (m *Meta) doReindex(ctx context.Context, state *reindexState, report *ReindexReport) error {
+	if err := m.saveState(state); err != nil {
+		return err
+	}
+
+	// Find the meta blobs saved before the index was created
+	complete, err := m.db.Get(nil, keyComplete)
+	if err != nil {
+		return err
+	}
+	if complete == nil {
+		cnt, err := m.discover(ctx)
+		if err != nil {
+			return err
+		}
+		report.Discovered = cnt
+	}
+
+	if state.Full && !state.Reset {
+		if t, ok := m.types[state.Type]; ok && t.Reset != nil {
+			if err := t.Reset(); err != nil {
+				return fmt.Errorf("failed to reset the index: %v", err)
+			}
+		}
+		if err := m.clearApplied(state.Type); err != nil {
+			return err
+		}
+		state.Reset = true
+		if err := m.saveState(state); err != nil {
+			return err
+		}
+	}
+
+	// Apply the meta blobs not applied yet, the applied flag is set after each blob so the progress is kept
+	hashes, err := m.pending(state.Type)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := m.blobStore.GetNoCache(ctx, hash)
+		if err == nil {
+			_, metaData, _ := IsMetaBlob(data)
+			err = m.applyData(state.Type, hash, data, metaData)
+		}
+		if _, ok := err.(*parkedError); ok {
+			report.Parked++
+			continue
+		}
+		if err != nil {
+			m.log.Error("failed to apply meta blob", "type", state.Type, "hash", hash, "err", err)
+			report.Failed = append(report.Failed, hash)
+			continue
+		}
+		if err := m.db.Set(encodeKey(state.Type, hash), []byte{1}); err != nil {
+			return err
+		}
+		report.Applied++
+	}
+
+	return m.db.Delete(keyReindex)
+}
+
+// discover reads every blob once to record the meta blobs in the index
+func (m *Meta) discover(ctx context.Context) (int, error) {
+	m.log.Info("discovering the existing meta blobs")
+	var cnt int
+	if err := m.blobStore.Iter(ctx, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+		data, err := m.blobStore.GetNoCache(ctx, ref.Hash)
+		if err != nil {
+			return err
+		}
+		metaType, _, isMeta := IsMetaBlob(data)
+		if !isMeta {
+			return nil
+		}
+		key := encodeKey(metaType, ref.Hash)
+		v, err := m.db.Get(nil, key)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			cnt++
+			return m.db.Set(key, []byte{0})
+		}
+		return nil
+	}); err != nil {
+		return cnt, err
+	}
+	return cnt, m.db.Set(keyComplete, []byte{1})
+}
+
+// iterType calls `fn` for each meta blob of the given type
+func (m *Meta) iterType(metaType string, fn func(hash string, applied bool) error) error {
+	prefix := encodeKey(metaType, "")
+	enum, _, err := m.db.Seek(prefix)
+	if err != nil {
+		return err
+	}
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF || (err == nil && !bytes.HasPrefix(k, prefix)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(string(k[len(prefix):]), len(v) > 0 && v[0] == 1); err != nil {
+			return err
+		}
+	}
+}
+
+// pending returns the meta blobs of the given type not applied yet
+func (m *Meta) pending(metaType string) ([]string, error) {
+	var hashes []string
+	if err := m.iterType(metaType, func(hash string, applied bool) error {
+		if !applied {
+			hashes = append(hashes, hash)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// clearApplied resets the applied flag of all the meta blobs of the given type
+func (m *Meta) clearApplied(metaType string) error {
+	var hashes []string
+	if err := m.iterType(metaType, func(hash string, applied bool) error {
+		if applied {
+			hashes = append(hashes, hash)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if err := m.db.Set(encodeKey(metaType, hash), []byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package nsdb // import "a4.io/blobstash/pkg/nsdb"
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// Register the namespaces routes, the enumeration and the stats of the BlobStore are filtered when the
+// `BlobStash-Namespace` header is set (must be registered before the blobstore and stats routes)
+func (db *DB) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/api/blobstore/blobs", basicAuth(http.HandlerFunc(db.enumerateHandler()))).Headers("BlobStash-Namespace", "")
+	r.Handle("/api/blobstore/stats", basicAuth(http.HandlerFunc(db.statsHandler()))).Headers("BlobStash-Namespace", "")
+	r.Handle("/api/blobstore/namespaces", basicAuth(http.HandlerFunc(db.namespacesHandler())))
+}
+
+func nextHexKey(key string) string {
+	bkey, err := hex.DecodeString(key)
+	if err != nil {
+		panic(err)
+	}
+	i := len(bkey)
+	for i > 0 {
+		i--
+		bkey[i]++
+		if bkey[i] != 0 {
+			break
+		}
+	}
+	return hex.EncodeToString(bkey)
+}
+
+func (db *DB) enumerateHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			ns := r.Header.Get("BlobStash-Namespace")
+			if !ValidNamespace(ns) {
+				httputil.WriteJSONError(w, http.StatusBadRequest, ErrInvalidNamespace.Error())
+				return
+			}
+			q := httputil.NewQuery(r.URL.Query())
+			end := q.GetDefault("end", "\xff")
+
+			// Stream all the refs (as newline-delimited JSON) if requested
+			if q.Get("format") == "ndjson" || r.Header.Get("Accept") == "application/x-ndjson" {
+				limit, err := q.GetIntDefault("limit", 0)
+				if err != nil {
+					httputil.Error(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				srw := httputil.NewSnappyResponseWriter(w, r)
+				defer srw.Close()
+				enc := json.NewEncoder(srw)
+				if err := db.Iter(ns, q.Get("start"), end, limit, func(ref *blob.SizedBlobRef) error {
+					return enc.Encode(ref)
+				}); err != nil {
+					// The headers are already sent
+					db.log.Error("failed to stream the refs", "err", err)
+				}
+				return
+			}
+
+			limit, err := q.GetInt("limit", 50, 1000)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			refs := []*blob.SizedBlobRef{}
+			if err := db.Iter(ns, q.Get("start"), end, limit, func(ref *blob.SizedBlobRef) error {
+				refs = append(refs, ref)
+				return nil
+			}); err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			var cursor string
+			if len(refs) > 0 {
+				cursor = nextHexKey(refs[len(refs)-1].Hash)
+			}
+			srw := httputil.NewSnappyResponseWriter(w, r)
+			httputil.WriteJSON(srw, map[string]interface{}{
+				"refs":   refs,
+				"cursor": cursor,
+			})
+			srw.Close()
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (db *DB) statsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			ns := r.Header.Get("BlobStash-Namespace")
+			if !ValidNamespace(ns) {
+				httputil.WriteJSONError(w, http.StatusBadRequest, ErrInvalidNamespace.Error())
+				return
+			}
+			stats, err := db.Stats(ns)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, stats)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (db *DB) namespacesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			namespaces, err := db.Namespaces()
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.WriteJSON(w, map[string]interface{}{
+				"namespaces": namespaces,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -1,14 +1,33 @@
+/*
+
+Package nsdb implements the namespaces index.
+
+A blob can belong to any number of namespaces, the namespace is set by the `BlobStash-Namespace` header when the blob
+is uploaded (even if the blob is already saved). Every (blob, namespace) pair is saved as a `NsMeta` meta blob, so the
+index can be rebuilt with a full scan (and the namespaces are replicated along with the blobs).
+
+The index is made of:
+
+- `<ns>:<raw hash>`: the size of the blob
+- `_blob:<raw hash><ns>`: the reverse index, used to remove a deleted blob from its namespaces
+
+The applied `NsMeta` blobs are tracked by the meta index, so the index can be rebuilt with `meta.Reindex`.
+
+*/
 package nsdb // import "a4.io/blobstash/pkg/nsdb"
 
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/cznic/kv"
@@ -24,15 +43,24 @@ import (
 
 const NsType = "ns"
 
+// ErrInvalidNamespace is returned when the namespace is empty, contains a ":" or starts with a "_" (reserved for the
+// internal keys)
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+var prefixReverse = []byte("_blob:")
+
 type NsMeta struct {
 	Hash      string `json:"hash"`
 	Namespace string `json:"ns"`
+	// Size of the blob (not set for the blobs saved before it was added)
+	Size int `json:"size,omitempty"`
 }
 
-func NewNsMeta(hash, namespace string) *NsMeta {
+func NewNsMeta(hash, namespace string, size int) *NsMeta {
 	return &NsMeta{
 		Hash:      hash,
 		Namespace: namespace,
+		Size:      size,
 	}
 }
 
@@ -44,6 +72,18 @@ func (ns *NsMeta) Dump() ([]byte, error) {
 	return json.Marshal(ns)
 }
 
+// NsStats holds the stats of a namespace
+type NsStats struct {
+	Namespace  string `json:"namespace"`
+	BlobsCount int64  `json:"blobs_count"`
+	BlobsSize  int64  `json:"blobs_size"`
+}
+
+// ValidNamespace returns true if the namespace can be used
+func ValidNamespace(ns string) bool {
+	return ns != "" && !strings.HasPrefix(ns, "_") && !strings.Contains(ns, ":")
+}
+
 type DB struct {
 	db        *kv.DB
 	path      string
@@ -76,8 +116,11 @@ func New(logger log.Logger, conf *config.Config, blobStore *blobstore.BlobStore,
 		path:      path,
 		conf:      conf,
 	}
-	m.RegisterApplyFunc(NsType, nsdb.applyMetaFunc)
+	m.RegisterType(&meta.Type{Name: NsType, Apply: nsdb.applyMetaFunc, Reset: nsdb.Reset})
 	nsdb.hub.Subscribe(hub.NewBlob, "nsdb", nsdb.newBlobCallback)
+	nsdb.hub.Subscribe(hub.ExistingBlob, "nsdb", nsdb.newBlobCallback)
+	nsdb.hub.Subscribe(hub.DeleteBlob, "nsdb", nsdb.removeBlobCallback)
+	nsdb.hub.Subscribe(hub.GarbageCollection, "nsdb", nsdb.removeBlobCallback)
 	return nsdb, nil
 }
 
@@ -87,7 +130,7 @@ func (db *DB) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{
 	if !(isMeta && metaType == NsType) {
 		if ns, ok := ctxutil.Namespace(ctx); ok {
 			db.log.Debug("creating namespace blob", "hash", blob.Hash, "namespace", ns)
-			if err := db.AddNs(blob.Hash, ns); err != nil {
+			if err := db.AddNs(blob.Hash, ns, len(blob.Data)); err != nil {
 				return err
 			}
 		}
@@ -95,6 +138,10 @@ func (db *DB) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{
 	return nil
 }
 
+func (db *DB) removeBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
+	return db.RemoveBlob(blob.Hash)
+}
+
 func (db *DB) Close() error {
 	return db.db.Close()
 }
@@ -107,27 +154,68 @@ func (db *DB) Destroy() error {
 	return nil
 }
 
+// Reset removes all the namespaces from the index
+func (db *DB) Reset() error {
+	db.Lock()
+	defer db.Unlock()
+	for {
+		// Collect the keys first, the enumerator can't be used while deleting
+		enum, err := db.db.SeekFirst()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var keys [][]byte
+		for len(keys) < 1000 {
+			k, _, err := enum.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, k := range keys {
+			if err := db.db.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 func (db *DB) applyMetaFunc(hash string, data []byte) error {
 	db.log.Debug("Applying meta init", "hash", hash)
 	nsMeta := &NsMeta{}
 	if err := json.Unmarshal(data, nsMeta); err != nil {
 		return err
 	}
-	applied, err := db.blobApplied(hash)
+	// Don't add back a deleted blob (its meta blobs are kept)
+	deleted, err := db.blobStore.Deleted(nsMeta.Hash)
 	if err != nil {
 		return err
 	}
-	if !applied {
-		db.log.Debug("Applying ns meta", "ns", nsMeta)
-		if err := db.addNs(nsMeta.Hash, nsMeta.Namespace); err != nil {
-			return err
+	if !deleted {
+		if nsMeta.Size == 0 {
+			// The size was not saved in the meta blob, the blob may not be available yet (e.g. during a sync)
+			if data, err := db.blobStore.Get(context.Background(), nsMeta.Hash); err == nil {
+				nsMeta.Size = len(data)
+			}
 		}
-		if err := db.applyMeta(hash); err != nil {
+		db.log.Debug("Applying ns meta", "ns", nsMeta)
+		db.Lock()
+		err := db.addNs(nsMeta.Hash, nsMeta.Namespace, nsMeta.Size)
+		db.Unlock()
+		if err != nil {
 			return err
 		}
 	}
 	return nil
-
 }
 
 func encodeKey(hexHash, ns string) []byte {
@@ -141,64 +229,228 @@ func encodeKey(hexHash, ns string) []byte {
 	return buf.Bytes()
 }
 
-func (db *DB) AddNs(hexHash, ns string) error {
-	if err := db.addNs(hexHash, ns); err != nil {
+func encodeReverseKey(hexHash, ns string) []byte {
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	buf.Write(prefixReverse)
+	buf.Write(hash)
+	buf.WriteString(ns)
+	return buf.Bytes()
+}
+
+func encodeSize(size int) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, uint64(size))
+	return out
+}
+
+func decodeSize(data []byte) int64 {
+	// The size was not saved by the first version of the index
+	if len(data) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+// AddNs adds the blob to the given namespace, and saves the `NsMeta` blob if the blob was not already in the
+// namespace
+func (db *DB) AddNs(hexHash, ns string, size int) error {
+	if !ValidNamespace(ns) {
+		return ErrInvalidNamespace
+	}
+	db.Lock()
+	exists, err := db.hasNs(hexHash, ns)
+	if err == nil && !exists {
+		err = db.addNs(hexHash, ns, size)
+	}
+	db.Unlock()
+	if err != nil || exists {
 		return err
 	}
-	nsMeta := NewNsMeta(hexHash, ns)
+	nsMeta := NewNsMeta(hexHash, ns, size)
 	// Save the meta blob
 	metaBlob, err := db.meta.Build(nsMeta)
 	if err != nil {
 		return err
 	}
-	// Set it as applied, so it won't be re-applied
-	db.applyMeta(metaBlob.Hash)
 	ctx := ctxutil.WithNamespace(context.Background(), ns)
 	return db.blobStore.Put(ctx, metaBlob)
 }
 
-func (db *DB) addNs(hexHash, ns string) error {
-	return db.db.Set(encodeKey(hexHash, ns), []byte{})
+func (db *DB) hasNs(hexHash, ns string) (bool, error) {
+	res, err := db.db.Get(nil, encodeKey(hexHash, ns))
+	if err != nil {
+		return false, err
+	}
+	return res != nil, nil
 }
 
-// Namespaces returns all blobs for the given namespace
-func (db *DB) Namespace(ns, prefix string) ([]string, error) {
-	res := []string{}
-	prefixBytes, err := hex.DecodeString(prefix)
+func (db *DB) addNs(hexHash, ns string, size int) error {
+	if err := db.db.Set(encodeKey(hexHash, ns), encodeSize(size)); err != nil {
+		return err
+	}
+	return db.db.Set(encodeReverseKey(hexHash, ns), []byte{})
+}
+
+// RemoveBlob removes the blob from all its namespaces
+func (db *DB) RemoveBlob(hexHash string) error {
+	db.Lock()
+	defer db.Unlock()
+	namespaces, err := db.namespaces(hexHash)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for _, ns := range namespaces {
+		if err := db.db.Delete(encodeKey(hexHash, ns)); err != nil {
+			return err
+		}
+		if err := db.db.Delete(encodeReverseKey(hexHash, ns)); err != nil {
+			return err
+		}
 	}
-	start := []byte(fmt.Sprintf("%s:%s", ns, string(prefixBytes)))
-	vstart := len(ns) + 1
+	return nil
+}
+
+// BlobNamespaces returns the namespaces of the given blob
+func (db *DB) BlobNamespaces(hexHash string) ([]string, error) {
+	db.Lock()
+	defer db.Unlock()
+	return db.namespaces(hexHash)
+}
+
+func (db *DB) namespaces(hexHash string) ([]string, error) {
+	res := []string{}
+	start := encodeReverseKey(hexHash, "")
 	enum, _, err := db.db.Seek(start)
 	if err != nil {
 		return nil, err
 	}
-	endBytes := append(start, '\xff')
 	for {
 		k, _, err := enum.Next()
 		if err == io.EOF {
 			break
 		}
-		if bytes.Compare(k, endBytes) > 0 {
-			return res, nil
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(k, start) {
+			break
 		}
-		res = append(res, fmt.Sprintf("%x", k[vstart:]))
+		res = append(res, string(k[len(start):]))
 	}
 	return res, nil
 }
 
-func (db *DB) applyMeta(hash string) error {
-	return db.db.Set([]byte(fmt.Sprintf("_meta:%s", hash)), []byte("1"))
+// Namespace returns all blobs for the given namespace
+func (db *DB) Namespace(ns, prefix string) ([]string, error) {
+	res := []string{}
+	if err := db.Iter(ns, prefix, prefix+"\xff", 0, func(ref *blob.SizedBlobRef) error {
+		res = append(res, ref.Hash)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
-func (db *DB) blobApplied(hash string) (bool, error) {
-	res, err := db.db.Get(nil, []byte(fmt.Sprintf("_meta:%s", hash)))
+// Iter calls `fn` for each blob of the namespace (in lexicographical order), between the `start` and `end` hashes
+// (like `BlobStore.Iter`), a limit of 0 means no limit
+func (db *DB) Iter(ns, start, end string, limit int, fn func(*blob.SizedBlobRef) error) error {
+	if !ValidNamespace(ns) {
+		return ErrInvalidNamespace
+	}
+	// Seek to the closest full byte of the start hash
+	rawStart, err := hex.DecodeString(start[:len(start)&^1])
 	if err != nil {
-		return false, err
+		return err
+	}
+	prefix := []byte(ns + ":")
+	enum, _, err := db.db.Seek(append(append([]byte{}, prefix...), rawStart...))
+	if err != nil {
+		return err
+	}
+	var i int
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		hash := hex.EncodeToString(k[len(prefix):])
+		if hash < start {
+			continue
+		}
+		if hash > end {
+			return nil
+		}
+		if err := fn(&blob.SizedBlobRef{Hash: hash, Size: int(decodeSize(v))}); err != nil {
+			return err
+		}
+		i++
+		if limit > 0 && i == limit {
+			return nil
+		}
+	}
+}
+
+// Stats returns the stats for the given namespace
+func (db *DB) Stats(ns string) (*NsStats, error) {
+	stats := &NsStats{Namespace: ns}
+	if err := db.Iter(ns, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+		stats.BlobsCount++
+		stats.BlobsSize += int64(ref.Size)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Namespaces returns the stats of every namespace
+func (db *DB) Namespaces() ([]*NsStats, error) {
+	res := []*NsStats{}
+	enum, err := db.db.SeekFirst()
+	if err == io.EOF {
+		return res, nil
 	}
-	if res == nil || len(res) == 0 {
-		return false, nil
+	if err != nil {
+		return nil, err
+	}
+	var current *NsStats
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if k[0] == '_' {
+			// Skip the internal keys (namespaces can't start with "_", seek to the key just after the prefix)
+			if enum, _, err = db.db.Seek([]byte{'_' + 1}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		i := bytes.IndexByte(k, ':')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid key %q", k)
+		}
+		if ns := string(k[:i]); current == nil || current.Namespace != ns {
+			current = &NsStats{Namespace: ns}
+			res = append(res, current)
+		}
+		current.BlobsCount++
+		current.BlobsSize += decodeSize(v)
 	}
-	return true, nil
 }
+
+
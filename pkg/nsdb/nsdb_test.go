@@ -1,35 +1,117 @@
 package nsdb
 
-import "testing"
+import (
+	"context"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore/blobstoretest"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/meta"
+)
 
-func check(e error) {
-	if e != nil {
-		panic(e)
-	}
-}
 func TestDB(t *testing.T) {
-	// db, err := New("db_base")
-	// defer db.Destroy()
-	// if err != nil {
-	// 	t.Fatalf("Error creating db %v", err)
-	// }
-	// h := "c0f1480a26c2fd4deb8e738a52b7530ed111b9bcd17bbb09259ce03f129988c5"
-	// ns, err := db.Namespaces(h)
-	// check(err)
-	// if len(ns) != 0 {
-	// 	t.Fatalf("Namespaces should be empty", ns)
-	// }
-	// check(db.AddNs(h, "ns1"))
-	// check(db.AddNs(h, "ns2"))
-	// ns, err = db.Namespaces(h)
-	// check(err)
-	// if len(ns) != 2 || ns[0] != "ns1" || ns[1] != "ns2" {
-	// 	t.Errorf("bad namespaces results, expected [ns1, ns2], got %q", ns)
-	// }
-	// check(db.RemoveNs(h, "ns1"))
-	// ns, err = db.Namespaces(h)
-	// check(err)
-	// if len(ns) != 1 || ns[0] != "ns2" {
-	// 	t.Errorf("bad namespaces results, expected [ns2], got %q", ns)
-	// }
+	env, cleanup := blobstoretest.New(t)
+	defer cleanup()
+	logger, conf, chub, bs, m := env.Logger, env.Conf, env.Hub, env.BlobStore, env.Meta
+	db, err := New(logger, conf, bs, m, chub)
+	blobstoretest.Check(t, err)
+	defer func() {
+		db.Close()
+	}()
+
+	ctx := context.Background()
+	ns1 := ctxutil.WithNamespace(ctx, "ns1")
+	ns2 := ctxutil.WithNamespace(ctx, "ns2")
+	b1 := blob.New([]byte("blob1"))
+	b2 := blob.New([]byte("blob2!"))
+	b3 := blob.New([]byte("blob3"))
+	blobstoretest.Check(t, bs.Put(ns1, b1))
+	blobstoretest.Check(t, bs.Put(ns1, b2))
+	// Already saved blobs are added to the namespace too
+	blobstoretest.Check(t, bs.Put(ns2, b2))
+	blobstoretest.Check(t, bs.Put(ns2, b2))
+	blobstoretest.Check(t, bs.Put(ctx, b3))
+
+	hashes, err := db.Namespace("ns1", "")
+	blobstoretest.Check(t, err)
+	if len(hashes) != 2 {
+		t.Errorf("expected 2 blobs in ns1, got %q", hashes)
+	}
+	namespaces, err := db.BlobNamespaces(b2.Hash)
+	blobstoretest.Check(t, err)
+	if len(namespaces) != 2 || namespaces[0] != "ns1" || namespaces[1] != "ns2" {
+		t.Errorf("bad namespaces results, expected [ns1, ns2], got %q", namespaces)
+	}
+
+	stats, err := db.Stats("ns1")
+	blobstoretest.Check(t, err)
+	if stats.BlobsCount != 2 || stats.BlobsSize != int64(len(b1.Data)+len(b2.Data)) {
+		t.Errorf("unexpected ns1 stats %+v", stats)
+	}
+	all, err := db.Namespaces()
+	blobstoretest.Check(t, err)
+	if len(all) != 2 || all[0].Namespace != "ns1" || all[1].Namespace != "ns2" || all[1].BlobsCount != 1 {
+		t.Errorf("unexpected namespaces %+v", all)
+	}
+
+	// One `NsMeta` blob must have been saved for each (blob, namespace) pair
+	var nsMetas int
+	blobstoretest.Check(t, bs.Iter(ctx, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+		data, err := bs.Get(ctx, ref.Hash)
+		blobstoretest.Check(t, err)
+		if metaType, _, isMeta := meta.IsMetaBlob(data); isMeta && metaType == NsType {
+			nsMetas++
+		}
+		return nil
+	}))
+	if nsMetas != 3 {
+		t.Errorf("expected 3 ns meta blobs, got %d", nsMetas)
+	}
+
+	// Rebuild the index from the meta blobs
+	blobstoretest.Check(t, db.Destroy())
+	db, err = New(logger, conf, bs, m, chub)
+	blobstoretest.Check(t, err)
+	blobstoretest.Check(t, bs.Scan(ctx))
+	all, err = db.Namespaces()
+	blobstoretest.Check(t, err)
+	if len(all) != 2 || all[0].BlobsCount != 2 || all[0].BlobsSize != int64(len(b1.Data)+len(b2.Data)) {
+		t.Errorf("unexpected namespaces after the rebuild %+v", all)
+	}
+
+	// Rebuild the index by only reading the meta blobs
+	report, err := m.Reindex(ctx, NsType, true)
+	blobstoretest.Check(t, err)
+	if report.Applied != 3 || len(report.Failed) != 0 {
+		t.Errorf("unexpected reindex report %+v", report)
+	}
+	all, err = db.Namespaces()
+	blobstoretest.Check(t, err)
+	if len(all) != 2 || all[0].BlobsCount != 2 || all[1].BlobsCount != 1 {
+		t.Errorf("unexpected namespaces after the reindex %+v", all)
+	}
+	// Nothing left to apply
+	report, err = m.Reindex(ctx, NsType, false)
+	blobstoretest.Check(t, err)
+	if report.Applied != 0 {
+		t.Errorf("unexpected incremental reindex report %+v", report)
+	}
+
+	// Deleted blobs are removed from their namespaces
+	blobstoretest.Check(t, bs.Delete(ctx, b2.Hash))
+	namespaces, err = db.BlobNamespaces(b2.Hash)
+	blobstoretest.Check(t, err)
+	if len(namespaces) != 0 {
+		t.Errorf("the deleted blob should not have namespaces, got %q", namespaces)
+	}
+	stats, err = db.Stats("ns2")
+	blobstoretest.Check(t, err)
+	if stats.BlobsCount != 0 {
+		t.Errorf("ns2 should be empty, got %+v", stats)
+	}
+
+	if err := db.AddNs(b1.Hash, "_meta", 0); err != ErrInvalidNamespace {
+		t.Errorf("expected ErrInvalidNamespace, got %v", err)
+	}
 }
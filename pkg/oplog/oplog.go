@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -45,7 +46,9 @@ func New(logger log.Logger, conf *config.Config, h *hub.Hub) (*Oplog, error) {
 		},
 		hub: h,
 	}
-	oplog.init()
+	if err := oplog.init(filepath.Join(conf.VarDir(), "oplog.queue")); err != nil {
+		return nil, err
+	}
 	return oplog, nil
 }
 
@@ -55,16 +58,27 @@ func (o *Oplog) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interfac
 	return nil
 }
 
+func (o *Oplog) deleteBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
+	// Send the deleted blob hash to the broker
+	o.broker.ops <- &Op{Event: "delete", Data: blob.Hash}
+	return nil
+}
+
 func (o *Oplog) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	// Register the SSE HTTP endpoint
 	r.Handle("/", basicAuth(o.broker))
 }
 
-func (o *Oplog) init() {
+func (o *Oplog) init(queuePath string) error {
 	// Start the SSE broker worker
 	o.broker.start()
-	// Register to the new blob event
-	o.hub.Subscribe(hub.NewBlob, "oplog", o.newBlobCallback)
+	// Register to the new/delete blob events, delivered asynchronously so a slow client won't block the writes
+	if err := o.hub.SubscribeAsync("oplog", queuePath, map[hub.EventType]func(context.Context, *blob.Blob, interface{}) error{
+		hub.NewBlob:    o.newBlobCallback,
+		hub.DeleteBlob: o.deleteBlobCallback,
+	}); err != nil {
+		return err
+	}
 
 	go func() {
 		for {
@@ -78,6 +92,7 @@ func (o *Oplog) init() {
 			}
 		}
 	}()
+	return nil
 }
 
 type Broker struct {
@@ -50,9 +50,31 @@ func (q *Queue) Remove() error {
 	return os.Remove(q.path)
 }
 
+// Size returns the number of items in the queue.
+func (q *Queue) Size() (int, error) {
+	enum, err := q.db.SeekFirst()
+	if err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var cnt int
+	for {
+		if _, _, err := enum.Next(); err != nil {
+			if err == io.EOF {
+				return cnt, nil
+			}
+			return 0, err
+		}
+		cnt++
+	}
+}
+
 // Enqueue the given `item`. Must be JSON serializable.
 func (q *Queue) Enqueue(item interface{}) error {
-	id, err := id.New(time.Now().Unix())
+	// Use a nanosecond timestamp, so the items enqueued during the same second are kept in order
+	id, err := id.New(time.Now().UnixNano())
 	if err != nil {
 		return err
 	}
@@ -62,9 +84,7 @@ func (q *Queue) Enqueue(item interface{}) error {
 		return err
 	}
 
-	q.db.Set(id.Raw(), js)
-
-	return nil
+	return q.db.Set(id.Raw(), js)
 }
 
 // Dequeue the older item, unserialize the given item.
@@ -30,6 +30,11 @@ func TestQueue(t *testing.T) {
 	check(q.Enqueue(item1))
 	time.Sleep(1 * time.Second)
 	check(q.Enqueue(item2))
+	size, err := q.Size()
+	check(err)
+	if size != 2 {
+		t.Errorf("queue size should be 2, got %d", size)
+	}
 
 	deq := &Item{}
 	ok, deqFunc, err := q.Dequeue(deq)
@@ -64,6 +69,11 @@ func TestQueue(t *testing.T) {
 	if deq2.Val != "ok2" {
 		t.Errorf("dequeued value should be \"ok2\", got \"%s\"", deq2.Val)
 	}
+	size, err = q.Size()
+	check(err)
+	if size != 0 {
+		t.Errorf("queue should be empty, got %d", size)
+	}
 	deq3 := &Item{}
 	ok, _, err = q.Dequeue(deq3)
 	if ok {
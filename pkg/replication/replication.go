@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"a4.io/blobstash/pkg/backend"
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/client/oplog"
@@ -15,6 +16,7 @@ import (
 	log "github.com/inconshreveable/log15"
 )
 
+// Backoff computes the delay between two attempts (exponential, capped to `maxDelay`)
 type Backoff struct {
 	delay    time.Duration
 	factor   float64
@@ -22,6 +24,15 @@ type Backoff struct {
 	attempt  int
 }
 
+// NewBackoff returns a new `Backoff`, the n-th delay is `delay * factor^n`
+func NewBackoff(delay, maxDelay time.Duration, factor float64) *Backoff {
+	return &Backoff{
+		delay:    delay,
+		maxDelay: maxDelay,
+		factor:   factor,
+	}
+}
+
 func (b *Backoff) Reset() {
 	b.attempt = 1
 }
@@ -57,12 +68,8 @@ func New(logger log.Logger, conf *config.Config, bs *blobstore.BlobStore, s *bsy
 		log:         logger,
 		remoteOplog: oplog.New(oplog.DefaultOpts().SetHost(conf.ReplicateFrom.URL, conf.ReplicateFrom.APIKey)),
 		synctable:   s,
-		backoff: &Backoff{
-			delay:    1 * time.Second,
-			maxDelay: 120 * time.Second,
-			factor:   1.6,
-		},
-		wg: wg,
+		backoff:     NewBackoff(1*time.Second, 120*time.Second, 1.6),
+		wg:          wg,
 	}
 	if err := rep.init(); err != nil {
 		return nil, err
@@ -117,7 +124,8 @@ func (r *Replication) init() error {
 
 	go func() {
 		for op := range ops {
-			if op.Event == "blob" {
+			switch op.Event {
+			case "blob":
 				hash := op.Data
 				r.log.Info("new blob from replication", "hash", hash)
 
@@ -131,8 +139,20 @@ func (r *Replication) init() error {
 				blob := &blob.Blob{Hash: hash, Data: data}
 				r.log.Debug("fetched blob", "blob", blob)
 
-				// Save it locally
-				if r.blobstore.Put(context.Background(), blob); err != nil {
+				// Save it locally (unless it has been deleted locally)
+				if err := r.blobstore.Put(context.Background(), blob); err != nil && err != blobstore.ErrBlobDeleted {
+					panic(err)
+				}
+			case "delete":
+				hash := op.Data
+				r.log.Info("deleted blob from replication", "hash", hash)
+
+				// Delete it locally too
+				if err := r.blobstore.Delete(context.Background(), hash); err != nil {
+					if err == backend.ErrDeleteNotSupported {
+						r.log.Error("failed to delete blob from replication", "hash", hash, "err", err)
+						continue
+					}
 					panic(err)
 				}
 			}
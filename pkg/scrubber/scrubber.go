@@ -0,0 +1,316 @@
+/*
+
+Package scrubber implements a background integrity checker for the BlobStore.
+
+Every blob is read from the local storage (never from the S3 read-through) and its hash is checked against its
+content (`blob.Check`), corrupted blobs (and blobs that are enumerated but can't be read) are reported.
+
+The scrubber tries to repair them automatically using a known good copy, either from the S3 replication (decrypted
+with `EncryptedBlob.PlainText`) or from the instance configured in `replicate_from`. A blob is only reported as
+repaired once it's read back successfully, BlobsFile can't overwrite a corrupted blob (only a missing one).
+
+*/
+package scrubber // import "a4.io/blobstash/pkg/scrubber"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	bsclient "a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+var ErrAlreadyRunning = errors.New("scrubber already running")
+
+// Issue reasons
+const (
+	Corrupted = "corrupted"
+	Missing   = "missing"
+)
+
+// Issue is a blob that failed the integrity check
+type Issue struct {
+	Hash         string `json:"hash"`
+	Reason       string `json:"reason"`
+	Error        string `json:"error"`
+	Repaired     bool   `json:"repaired"`
+	RepairedFrom string `json:"repaired_from,omitempty"`
+	RepairError  string `json:"repair_error,omitempty"`
+}
+
+// Report holds the result of a scrubber run
+type Report struct {
+	Started    time.Time `json:"started"`
+	Duration   string    `json:"duration"`
+	BlobsCount int       `json:"blobs_count"`
+	Corrupted  int       `json:"corrupted_count"`
+	Missing    int       `json:"missing_count"`
+	Repaired   int       `json:"repaired_count"`
+	Issues     []*Issue  `json:"issues"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// source is a place to fetch a known good copy of a blob
+type source struct {
+	name  string
+	fetch func(hash string) ([]byte, error)
+}
+
+type Scrubber struct {
+	blobStore *blobstore.BlobStore
+	sources   []*source
+
+	reportPath string
+	lastReport *Report
+	running    bool
+	mu         sync.Mutex
+
+	stop chan struct{}
+	log  log.Logger
+}
+
+// New initializes the scrubber, and starts the scheduler if an interval is configured
+func New(logger log.Logger, conf *config.Config, blobStore *blobstore.BlobStore) (*Scrubber, error) {
+	logger.Debug("init")
+	s := &Scrubber{
+		blobStore:  blobStore,
+		reportPath: filepath.Join(conf.VarDir(), "scrubber-report.json"),
+		stop:       make(chan struct{}),
+		log:        logger,
+	}
+
+	// Setup the repair sources
+	if s3back := blobStore.S3Backend(); s3back != nil {
+		s.sources = append(s.sources, &source{name: "s3", fetch: s3back.Fetch})
+	}
+	if conf.ReplicateFrom != nil && conf.ReplicateFrom.URL != "" {
+		peer := bsclient.New(bsclient.DefaultOpts().SetHost(conf.ReplicateFrom.URL, conf.ReplicateFrom.APIKey))
+		s.sources = append(s.sources, &source{name: "replication", fetch: func(hash string) ([]byte, error) {
+			return peer.Get(context.Background(), hash)
+		}})
+	}
+
+	// Load the last report
+	data, err := ioutil.ReadFile(s.reportPath)
+	switch {
+	case err == nil:
+		report := &Report{}
+		if err := json.Unmarshal(data, report); err != nil {
+			return nil, fmt.Errorf("failed to load the last report: %v", err)
+		}
+		s.lastReport = report
+	case os.IsNotExist(err):
+	default:
+		return nil, err
+	}
+
+	if conf.Scrubber != nil && conf.Scrubber.Interval != "" {
+		interval, err := time.ParseDuration(conf.Scrubber.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scrubber interval: %v", err)
+		}
+		go s.scheduler(interval)
+	}
+
+	return s, nil
+}
+
+func (s *Scrubber) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/report", basicAuth(http.HandlerFunc(s.reportHandler())))
+	r.Handle("/_run", basicAuth(http.HandlerFunc(s.runHandler())))
+}
+
+// Close stops the scheduler
+func (s *Scrubber) Close() error {
+	close(s.stop)
+	return nil
+}
+
+func (s *Scrubber) scheduler(interval time.Duration) {
+	s.log.Info("scrubber scheduled", "interval", interval)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			if _, err := s.Run(context.Background()); err != nil {
+				s.log.Error("scrubber failed", "err", err)
+			}
+		}
+	}
+}
+
+// LastReport returns the report of the last run (nil if the scrubber never ran), and true if it's currently running
+func (s *Scrubber) LastReport() (*Report, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastReport, s.running
+}
+
+// Run checks every blob and try to repair the corrupted/missing ones
+func (s *Scrubber) Run(ctx context.Context) (*Report, error) {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return nil, ErrAlreadyRunning
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	report := &Report{Started: start.UTC(), Issues: []*Issue{}}
+	s.log.Info("starting scrubber")
+
+	if err := s.blobStore.Iter(ctx, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+		report.BlobsCount++
+		issue := s.check(ctx, ref.Hash)
+		if issue == nil {
+			return nil
+		}
+		switch issue.Reason {
+		case Corrupted:
+			report.Corrupted++
+		case Missing:
+			report.Missing++
+		}
+		s.log.Error("integrity check failed", "hash", ref.Hash, "reason", issue.Reason, "err", issue.Error)
+		s.repair(ctx, issue)
+		if issue.Repaired {
+			report.Repaired++
+		}
+		report.Issues = append(report.Issues, issue)
+		return nil
+	}); err != nil {
+		// Keep the partial report
+		report.Error = err.Error()
+	}
+
+	report.Duration = time.Since(start).String()
+	s.log.Info("scrubber done", "blobs_count", report.BlobsCount, "corrupted", report.Corrupted, "missing", report.Missing, "repaired", report.Repaired, "duration", report.Duration)
+
+	s.mu.Lock()
+	s.running = false
+	s.lastReport = report
+	s.mu.Unlock()
+
+	js, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(s.reportPath, js, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save the report: %v", err)
+	}
+
+	if report.Error != "" {
+		return report, errors.New(report.Error)
+	}
+	return report, nil
+}
+
+// check returns an issue if the blob can't be read or is corrupted
+func (s *Scrubber) check(ctx context.Context, hash string) *Issue {
+	// Only check the local copy (never the S3 read-through)
+	data, err := s.blobStore.GetLocal(ctx, hash)
+	if err != nil {
+		reason := Corrupted
+		if err == clientutil.ErrBlobNotFound {
+			reason = Missing
+		}
+		return &Issue{Hash: hash, Reason: reason, Error: err.Error()}
+	}
+	if err := (&blob.Blob{Hash: hash, Data: data}).Check(); err != nil {
+		return &Issue{Hash: hash, Reason: Corrupted, Error: err.Error()}
+	}
+	return nil
+}
+
+// repair tries to fetch a valid copy of the blob from each source
+func (s *Scrubber) repair(ctx context.Context, issue *Issue) {
+	if len(s.sources) == 0 {
+		issue.RepairError = "no repair source available"
+		return
+	}
+	var errs []string
+	for _, src := range s.sources {
+		data, err := src.fetch(issue.Hash)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", src.name, err))
+			continue
+		}
+		b := &blob.Blob{Hash: issue.Hash, Data: data}
+		if err := b.Check(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", src.name, err))
+			continue
+		}
+		if err := s.blobStore.Repair(ctx, b); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", src.name, err))
+			continue
+		}
+		// Ensure the repaired copy can actually be read back
+		if recheck := s.check(ctx, issue.Hash); recheck != nil {
+			errs = append(errs, fmt.Sprintf("%s: still %s after the repair: %s", src.name, recheck.Reason, recheck.Error))
+			continue
+		}
+		s.log.Info("blob repaired", "hash", issue.Hash, "source", src.name)
+		issue.Repaired = true
+		issue.RepairedFrom = src.name
+		return
+	}
+	issue.RepairError = fmt.Sprintf("%v", errs)
+}
+
+func (s *Scrubber) reportHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			report, running := s.LastReport()
+			httputil.WriteJSON(w, map[string]interface{}{
+				"running":     running,
+				"last_report": report,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (s *Scrubber) runHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			s.mu.Lock()
+			running := s.running
+			s.mu.Unlock()
+			if running {
+				httputil.WriteJSONError(w, http.StatusConflict, ErrAlreadyRunning.Error())
+				return
+			}
+			// The scrubber reads every blob, the result will be available in the report
+			go func() {
+				if _, err := s.Run(context.Background()); err != nil {
+					s.log.Error("scrubber failed", "err", err)
+				}
+			}()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
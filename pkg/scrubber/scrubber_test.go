@@ -0,0 +1,68 @@
+package scrubber
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore/blobstoretest"
+	"a4.io/blobstash/pkg/client/clientutil"
+)
+
+func TestScrubber(t *testing.T) {
+	env, cleanup := blobstoretest.New(t)
+	defer cleanup()
+	dir, logger, conf, bs := env.Dir, env.Logger, env.Conf, env.BlobStore
+
+	ctx := context.Background()
+	good := blob.New([]byte("good blob"))
+	blobstoretest.Check(t, bs.Put(ctx, good))
+	bad := blob.New([]byte("bad blob"))
+	blobstoretest.Check(t, bs.Put(ctx, bad))
+	lost := blob.New([]byte("lost blob"))
+	blobstoretest.Check(t, bs.Put(ctx, lost))
+
+	// Simulate bit-rot
+	blobstoretest.Check(t, ioutil.WriteFile(filepath.Join(dir, "blobs", bad.Hash[0:2], bad.Hash), []byte("bad blob!"), 0644))
+	blobstoretest.Check(t, ioutil.WriteFile(filepath.Join(dir, "blobs", lost.Hash[0:2], lost.Hash), []byte("lost blob!"), 0644))
+
+	s, err := New(logger, conf, bs)
+	blobstoretest.Check(t, err)
+	defer s.Close()
+	s.sources = []*source{&source{name: "test", fetch: func(hash string) ([]byte, error) {
+		if hash == bad.Hash {
+			return bad.Data, nil
+		}
+		return nil, clientutil.ErrBlobNotFound
+	}}}
+
+	report, err := s.Run(ctx)
+	blobstoretest.Check(t, err)
+	if report.BlobsCount != 3 || report.Corrupted != 2 || report.Repaired != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	for _, issue := range report.Issues {
+		if issue.Hash == bad.Hash && (!issue.Repaired || issue.RepairedFrom != "test") {
+			t.Errorf("blob %s should have been repaired: %+v", bad.Hash, issue)
+		}
+		if issue.Hash == lost.Hash && issue.Repaired {
+			t.Errorf("blob %s should not have been repaired: %+v", lost.Hash, issue)
+		}
+	}
+
+	data, err := bs.Get(ctx, bad.Hash)
+	blobstoretest.Check(t, err)
+	if string(data) != string(bad.Data) {
+		t.Errorf("blob %s was not repaired, got %q", bad.Hash, data)
+	}
+
+	// The report must be persisted
+	s2, err := New(logger, conf, bs)
+	blobstoretest.Check(t, err)
+	defer s2.Close()
+	if last, _ := s2.LastReport(); last == nil || last.Repaired != 1 {
+		t.Errorf("failed to load the last report: %+v", last)
+	}
+}
@@ -16,18 +16,24 @@ import (
 	"syscall"
 
 	"a4.io/blobstash/pkg/apps"
+	"a4.io/blobstash/pkg/archive"
 	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/docstore"
 	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/gc"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/kvstore"
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/middleware"
+	"a4.io/blobstash/pkg/nsdb"
 	"a4.io/blobstash/pkg/oplog"
 	"a4.io/blobstash/pkg/replication"
+	"a4.io/blobstash/pkg/scrubber"
+	"a4.io/blobstash/pkg/stats"
 	synctable "a4.io/blobstash/pkg/sync"
+	"a4.io/blobstash/pkg/webhook"
 
 	"github.com/gorilla/mux"
 	log "github.com/inconshreveable/log15"
@@ -44,6 +50,7 @@ type Server struct {
 	closeFunc func() error
 
 	blobstore *blobstore.BlobStore
+	meta      *meta.Meta
 
 	hostWhitelist map[string]bool
 	shutdown      chan struct{}
@@ -65,20 +72,41 @@ func New(conf *config.Config) (*Server, error) {
 	}
 	authFunc, basicAuth := middleware.NewBasicAuth(conf)
 	hub := hub.New(logger.New("app", "hub"))
+	hub.Register(s.router.PathPrefix("/api/hub").Subrouter(), basicAuth)
 	// Load the blobstore
 	blobstore, err := blobstore.New(logger.New("app", "blobstore"), conf, hub)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize blobstore app: %v", err)
 	}
 	s.blobstore = blobstore
-	// FIXME(tsileo): handle middleware in the `Register` interface
-	blobstore.Register(s.router.PathPrefix("/api/blobstore").Subrouter(), basicAuth)
 
 	// Load the meta
-	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	metaHandler, err := meta.New(logger.New("app", "meta"), conf, blobstore, hub)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize blobstore meta: %v", err)
 	}
+	metaHandler.Register(s.router.PathPrefix("/api/meta").Subrouter(), basicAuth)
+	s.meta = metaHandler
+
+	// Load the namespaces index (must be registered before the stats and the blobstore routes)
+	nsDB, err := nsdb.New(logger.New("app", "nsdb"), conf, blobstore, metaHandler, hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize nsdb: %v", err)
+	}
+	nsDB.Register(s.router, basicAuth)
+
+	// Load the storage stats (must be registered before the blobstore routes)
+	stats, err := stats.New(logger.New("app", "stats"), conf, blobstore, hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize stats app: %v", err)
+	}
+	stats.Register(s.router, basicAuth)
+
+	// FIXME(tsileo): handle middleware in the `Register` interface
+	blobstore.Register(s.router.PathPrefix("/api/blobstore").Subrouter(), basicAuth)
+	if s3back := blobstore.S3Backend(); s3back != nil {
+		s3back.Register(s.router.PathPrefix("/api/s3").Subrouter(), basicAuth)
+	}
 
 	if conf.Replication != nil && conf.Replication.EnableOplog {
 		oplg, err := oplog.New(logger.New("app", "oplog"), conf, hub)
@@ -93,12 +121,8 @@ func New(conf *config.Config) (*Server, error) {
 		return nil, fmt.Errorf("failed to initialize kvstore app: %v", err)
 	}
 	kvstore.Register(s.router.PathPrefix("/api/kvstore").Subrouter(), basicAuth)
-	// nsDB, err := nsdb.New(logger.New("app", "nsdb"), conf, blobstore, metaHandler, hub)
-	// if err != nil {
-	// 	return nil, fmt.Errorf("failed to initialize nsdb: %v", err)
-	// }
 	// Load the synctable
-	synctable := synctable.New(logger.New("app", "sync"), conf, blobstore)
+	synctable := synctable.New(logger.New("app", "sync"), conf, blobstore, nsDB)
 	synctable.Register(s.router.PathPrefix("/api/sync").Subrouter(), basicAuth)
 
 	// Enable replication if set in the config
@@ -126,21 +150,55 @@ func New(conf *config.Config) (*Server, error) {
 	}
 	docstore.Register(s.router.PathPrefix("/api/docstore").Subrouter(), basicAuth)
 
+	gc := gc.New(logger.New("app", "gc"), blobstore, kvstore, hub)
+	gc.Register(s.router.PathPrefix("/api/gc").Subrouter(), basicAuth)
+
+	archive := archive.New(logger.New("app", "archive"), blobstore, kvstore, metaHandler)
+	archive.Register(s.router.PathPrefix("/api/archive").Subrouter(), basicAuth)
+
+	scrubber, err := scrubber.New(logger.New("app", "scrubber"), conf, blobstore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize scrubber app: %v", err)
+	}
+	scrubber.Register(s.router.PathPrefix("/api/scrubber").Subrouter(), basicAuth)
+
+	webhooks, err := webhook.New(logger.New("app", "webhook"), conf, blobstore, hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize webhook app: %v", err)
+	}
+	webhooks.Register(s.router.PathPrefix("/api/webhooks").Subrouter(), basicAuth)
+
 	// Setup the closeFunc
 	s.closeFunc = func() error {
 		logger.Debug("waiting for the waitgroup...")
 		wg.Wait()
 		logger.Debug("waitgroup done")
 
+		if err := scrubber.Close(); err != nil {
+			return err
+		}
+		// Must be closed before the hub, to stop the pending retries
+		if err := webhooks.Close(); err != nil {
+			return err
+		}
+		if err := hub.Close(); err != nil {
+			return err
+		}
 		if err := blobstore.Close(); err != nil {
 			return err
 		}
+		if err := stats.Close(); err != nil {
+			return err
+		}
 		if err := kvstore.Close(); err != nil {
 			return err
 		}
-		// if err := nsDB.Close(); err != nil {
-		// 	return err
-		// }
+		if err := nsDB.Close(); err != nil {
+			return err
+		}
+		if err := metaHandler.Close(); err != nil {
+			return err
+		}
 		if err := filetree.Close(); err != nil {
 			return err
 		}
@@ -171,6 +229,13 @@ func (s *Server) Bootstrap() error {
 		}
 		s.log.Info("Scan done")
 	}
+
+	// Resume the reindex interrupted by a crash (all the meta types are registered at this point)
+	go func() {
+		if err := s.meta.Resume(context.Background()); err != nil {
+			s.log.Error("failed to resume reindex", "err", err)
+		}
+	}()
 	return nil
 }
 
@@ -0,0 +1,478 @@
+/*
+
+Package stats implements the BlobStore storage statistics.
+
+The stats are maintained incrementally using the hub events, every blob is recorded in a disk-backed index along with
+its (uncompressed) size and its category:
+
+- `meta`: meta blobs (with a count per meta type)
+- `kvstore`: blobs referenced by a key-value entry
+- `docstore`: JSON documents
+- `filetree`: filetree nodes, and file chunks (referenced by a file node)
+- `other`: every other blob
+
+A full scan is only needed when the index is created (it runs in the background).
+
+*/
+package stats // import "a4.io/blobstash/pkg/stats"
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cznic/kv"
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/filetree"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Blob categories
+const (
+	Meta     = "meta"
+	KvStore  = "kvstore"
+	DocStore = "docstore"
+	FileTree = "filetree"
+	Other    = "other"
+)
+
+// Upper bounds of the size histogram buckets (the last bucket is unbounded)
+var buckets = []int64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// Set while the index is being built, so an interrupted build is restarted
+var keyBuilding = []byte("_building")
+
+// Stats holds the storage statistics
+type Stats struct {
+	Ready       bool                 `json:"ready"`
+	BlobsCount  int64                `json:"blobs_count"`
+	BlobsSize   int64                `json:"blobs_size"`
+	AvgBlobSize int64                `json:"avg_blob_size"`
+	Histogram   []*Bucket            `json:"size_histogram"`
+	MetaTypes   map[string]int64     `json:"meta_types"`
+	Categories  map[string]*Category `json:"categories"`
+}
+
+// Bucket is a size histogram bucket, contains the blobs smaller or equal than `MaxSize` (0 means unbounded)
+type Bucket struct {
+	MaxSize int64 `json:"max_size"`
+	Count   int64 `json:"count"`
+}
+
+// Category holds the stats for a blob category
+type Category struct {
+	Count int64   `json:"count"`
+	Size  int64   `json:"size"`
+	Share float64 `json:"share"`
+}
+
+// entry is the index value for a blob
+type entry struct {
+	// false if the blob is not saved yet (but its category is already known)
+	present  bool
+	size     int64
+	category string
+}
+
+func (e *entry) metaType() string {
+	if strings.HasPrefix(e.category, Meta+"/") {
+		return e.category[len(Meta)+1:]
+	}
+	return ""
+}
+
+func (e *entry) baseCategory() string {
+	if e.metaType() != "" {
+		return Meta
+	}
+	return e.category
+}
+
+func (e *entry) encode() []byte {
+	out := make([]byte, 9+len(e.category))
+	if e.present {
+		out[0] = 1
+	}
+	binary.BigEndian.PutUint64(out[1:], uint64(e.size))
+	copy(out[9:], e.category)
+	return out
+}
+
+func decodeEntry(data []byte) (*entry, error) {
+	if len(data) < 9 {
+		return nil, fmt.Errorf("invalid entry %q", data)
+	}
+	return &entry{
+		present:  data[0] == 1,
+		size:     int64(binary.BigEndian.Uint64(data[1:9])),
+		category: string(data[9:]),
+	}, nil
+}
+
+// StatsExt maintains the storage statistics
+type StatsExt struct {
+	blobStore *blobstore.BlobStore
+	db        *kv.DB
+
+	ready      bool
+	count      int64
+	size       int64
+	histogram  []int64
+	metaTypes  map[string]int64
+	categories map[string]*Category
+
+	mu  sync.Mutex
+	log log.Logger
+}
+
+// New initializes the stats, the index is built in the background if needed
+func New(logger log.Logger, conf *config.Config, blobStore *blobstore.BlobStore, chub *hub.Hub) (*StatsExt, error) {
+	logger.Debug("init")
+	path := filepath.Join(conf.VarDir(), "stats.index")
+	createOpen := kv.Open
+	build := false
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		createOpen = kv.Create
+		build = true
+	}
+
+	db, err := createOpen(path, &kv.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StatsExt{
+		blobStore: blobStore,
+		db:        db,
+		log:       logger,
+	}
+	s.reset()
+
+	if !build {
+		v, err := db.Get(nil, keyBuilding)
+		if err != nil {
+			return nil, err
+		}
+		// The previous build was interrupted
+		build = v != nil
+	}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("failed to load stats: %v", err)
+	}
+
+	chub.Subscribe(hub.NewBlob, "stats", s.newBlobCallback)
+	chub.Subscribe(hub.ScanBlob, "stats", s.newBlobCallback)
+	chub.Subscribe(hub.DeleteBlob, "stats", s.removeBlobCallback)
+	chub.Subscribe(hub.GarbageCollection, "stats", s.removeBlobCallback)
+
+	if build {
+		go func() {
+			if err := s.build(); err != nil {
+				s.log.Error("failed to build the stats index", "err", err)
+			}
+		}()
+	} else {
+		s.ready = true
+	}
+
+	return s, nil
+}
+
+func (s *StatsExt) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/api/blobstore/stats", basicAuth(http.HandlerFunc(s.statsHandler())))
+}
+
+// Close the underlying db file.
+func (s *StatsExt) Close() error {
+	return s.db.Close()
+}
+
+func (s *StatsExt) reset() {
+	s.count = 0
+	s.size = 0
+	s.histogram = make([]int64, len(buckets)+1)
+	s.metaTypes = map[string]int64{}
+	s.categories = map[string]*Category{}
+	for _, cat := range []string{Meta, KvStore, DocStore, FileTree, Other} {
+		s.categories[cat] = &Category{}
+	}
+}
+
+// load computes the counters from the index
+func (s *StatsExt) load() error {
+	enum, err := s.db.SeekFirst()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if string(k) == string(keyBuilding) {
+			continue
+		}
+		e, err := decodeEntry(v)
+		if err != nil {
+			return err
+		}
+		if e.present {
+			s.inc(e, 1)
+		}
+	}
+}
+
+// build indexes all the blobs
+func (s *StatsExt) build() error {
+	s.log.Info("building the stats index")
+	s.mu.Lock()
+	if err := s.db.Set(keyBuilding, []byte{1}); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+	ctx := context.Background()
+	if err := s.blobStore.Iter(ctx, "", "\xff", 0, func(ref *blob.SizedBlobRef) error {
+		// Every blob is read once, don't evict the hot blobs
+		data, err := s.blobStore.GetNoCache(ctx, ref.Hash)
+		if err != nil {
+			return err
+		}
+		return s.add(ref.Hash, data)
+	}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.Delete(keyBuilding); err != nil {
+		return err
+	}
+	s.ready = true
+	s.log.Info("stats index built", "blobs_count", s.count)
+	return nil
+}
+
+func (s *StatsExt) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
+	return s.add(blob.Hash, blob.Data)
+}
+
+func (s *StatsExt) removeBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
+	return s.remove(blob.Hash)
+}
+
+// inc updates the counters for the given entry (`delta` is either 1 or -1)
+func (s *StatsExt) inc(e *entry, delta int64) {
+	s.count += delta
+	s.size += delta * e.size
+	i := 0
+	for i < len(buckets) && e.size > buckets[i] {
+		i++
+	}
+	s.histogram[i] += delta
+	if mt := e.metaType(); mt != "" {
+		s.metaTypes[mt] += delta
+		if s.metaTypes[mt] == 0 {
+			delete(s.metaTypes, mt)
+		}
+	}
+	cat, ok := s.categories[e.baseCategory()]
+	if !ok {
+		cat = &Category{}
+		s.categories[e.baseCategory()] = cat
+	}
+	cat.Count += delta
+	cat.Size += delta * e.size
+}
+
+func (s *StatsExt) get(hash string) (*entry, error) {
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+	v, err := s.db.Get(nil, bhash)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return decodeEntry(v)
+}
+
+func (s *StatsExt) set(hash string, e *entry) error {
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(bhash, e.encode())
+}
+
+// classify returns the blob category, along with the categories of the blobs referenced by it
+func classify(data []byte) (string, map[string]string) {
+	refs := map[string]string{}
+	if metaType, metaData, isMeta := meta.IsMetaBlob(data); isMeta {
+		if metaType == kvstore.KvType {
+			if kv, err := vkv.UnserializeBlob(metaData); err == nil && kv.HexHash() != "" {
+				switch {
+				case strings.HasPrefix(kv.Key, docstore.PrefixKey):
+					refs[kv.HexHash()] = DocStore
+				case strings.HasPrefix(kv.Key, fmt.Sprintf(filetree.FSKeyFmt, "")):
+					refs[kv.HexHash()] = FileTree
+				default:
+					refs[kv.HexHash()] = KvStore
+				}
+			}
+		}
+		return Meta + "/" + metaType, refs
+	}
+	if n, err := rnode.NewNodeFromBlob("", data); err == nil && (n.Type == "file" || n.Type == "dir") {
+		if n.Type == "file" {
+			for _, ref := range n.Refs {
+				if iref, ok := ref.([]interface{}); ok && len(iref) == 2 {
+					if h, ok := iref[1].(string); ok {
+						refs[h] = FileTree
+					}
+				}
+			}
+		}
+		return FileTree, refs
+	}
+	return Other, refs
+}
+
+// add records a new blob
+func (s *StatsExt) add(hash string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.get(hash)
+	if err != nil {
+		return err
+	}
+	if e != nil && e.present {
+		// Already recorded
+		return nil
+	}
+	category, refs := classify(data)
+	if e != nil && category == Other {
+		// The blob was already referenced
+		category = e.category
+	}
+	e = &entry{present: true, size: int64(len(data)), category: category}
+	if err := s.set(hash, e); err != nil {
+		return err
+	}
+	s.inc(e, 1)
+
+	for ref, category := range refs {
+		if err := s.reclassify(ref, category); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reclassify updates the category of an uncategorized blob (it may not be saved yet)
+func (s *StatsExt) reclassify(hash, category string) error {
+	e, err := s.get(hash)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return s.set(hash, &entry{category: category})
+	}
+	if e.category != Other {
+		return nil
+	}
+	if e.present {
+		s.inc(e, -1)
+	}
+	e.category = category
+	if e.present {
+		s.inc(e, 1)
+	}
+	return s.set(hash, e)
+}
+
+// remove forgets a deleted blob
+func (s *StatsExt) remove(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.get(hash)
+	if err != nil || e == nil {
+		return err
+	}
+	if e.present {
+		s.inc(e, -1)
+	}
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	return s.db.Delete(bhash)
+}
+
+// Stats returns the current stats
+func (s *StatsExt) Stats() *Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := &Stats{
+		Ready:      s.ready,
+		BlobsCount: s.count,
+		BlobsSize:  s.size,
+		MetaTypes:  map[string]int64{},
+		Categories: map[string]*Category{},
+	}
+	if s.count > 0 {
+		stats.AvgBlobSize = s.size / s.count
+	}
+	for i, cnt := range s.histogram {
+		var max int64
+		if i < len(buckets) {
+			max = buckets[i]
+		}
+		stats.Histogram = append(stats.Histogram, &Bucket{MaxSize: max, Count: cnt})
+	}
+	for mt, cnt := range s.metaTypes {
+		stats.MetaTypes[mt] = cnt
+	}
+	for name, cat := range s.categories {
+		c := &Category{Count: cat.Count, Size: cat.Size}
+		if s.size > 0 {
+			c.Share = float64(cat.Size) / float64(s.size)
+		}
+		stats.Categories[name] = c
+	}
+	return stats
+}
+
+func (s *StatsExt) statsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			httputil.WriteJSON(w, s.Stats())
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package stats
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cznic/kv"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore/blobstoretest"
+	"a4.io/blobstash/pkg/config"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func TestStats(t *testing.T) {
+	db, err := kv.Create("stats_test", &kv.Options{})
+	blobstoretest.Check(t, err)
+	defer func() {
+		db.Close()
+		os.Remove("stats_test")
+	}()
+	s := &StatsExt{db: db}
+	s.reset()
+
+	// A file chunk, "other" until a file node references it
+	chunk := blob.New([]byte("chunk data"))
+	blobstoretest.Check(t, s.add(chunk.Hash, chunk.Data))
+	other := blob.New([]byte("other data"))
+	blobstoretest.Check(t, s.add(other.Hash, other.Data))
+
+	n := &rnode.RawNode{Name: "file", Type: "file"}
+	n.AddIndexedRef(len(chunk.Data), chunk.Hash)
+	nhash, ndata := n.Encode()
+	blobstoretest.Check(t, s.add(nhash, ndata))
+
+	// A document referenced by a kv meta blob saved before the document itself
+	doc := blob.New([]byte("document data"))
+	kvMeta := &vkv.KeyValue{Key: "docstore:col:1", Version: 1}
+	blobstoretest.Check(t, kvMeta.SetHexHash(doc.Hash))
+	env, cleanup := blobstoretest.New(t)
+	defer cleanup()
+	mblob, err := env.Meta.Build(kvMeta)
+	blobstoretest.Check(t, err)
+	blobstoretest.Check(t, s.add(mblob.Hash, mblob.Data))
+	blobstoretest.Check(t, s.add(doc.Hash, doc.Data))
+
+	// Adding a blob twice is a no-op
+	blobstoretest.Check(t, s.add(doc.Hash, doc.Data))
+
+	stats := s.Stats()
+	if stats.BlobsCount != 5 {
+		t.Errorf("expected 5 blobs, got %d", stats.BlobsCount)
+	}
+	expectedSize := int64(len(chunk.Data) + len(other.Data) + len(ndata) + len(mblob.Data) + len(doc.Data))
+	if stats.BlobsSize != expectedSize {
+		t.Errorf("expected size %d, got %d", expectedSize, stats.BlobsSize)
+	}
+	for cat, cnt := range map[string]int64{FileTree: 2, Other: 1, DocStore: 1, Meta: 1, KvStore: 0} {
+		if stats.Categories[cat].Count != cnt {
+			t.Errorf("expected %d %s blobs, got %d", cnt, cat, stats.Categories[cat].Count)
+		}
+	}
+	if stats.MetaTypes[vkv.KvType] != 1 {
+		t.Errorf("expected 1 kv meta blob, got %d", stats.MetaTypes[vkv.KvType])
+	}
+	if stats.Histogram[0].Count != 5 {
+		t.Errorf("expected 5 blobs in the first bucket, got %d", stats.Histogram[0].Count)
+	}
+
+	blobstoretest.Check(t, s.remove(other.Hash))
+	stats = s.Stats()
+	if stats.BlobsCount != 4 || stats.Categories[Other].Count != 0 {
+		t.Errorf("blob should have been removed from the stats: %+v", stats)
+	}
+
+	// The counters must be restored from the index
+	s2 := &StatsExt{db: db}
+	s2.reset()
+	blobstoretest.Check(t, s2.load())
+	if s2.Stats().BlobsCount != 4 {
+		t.Errorf("expected 4 blobs after load, got %d", s2.Stats().BlobsCount)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	env, cleanup := blobstoretest.New(t, func(conf *config.Config) {
+		conf.BlobStore.CacheSize = 1
+	})
+	defer cleanup()
+	for _, data := range []string{"blob 1", "blob 2", "blob 3"} {
+		blobstoretest.Check(t, env.BlobStore.Put(context.Background(), blob.New([]byte(data))))
+	}
+	db, err := kv.Create(filepath.Join(env.Conf.DataDir, "stats_build"), &kv.Options{})
+	blobstoretest.Check(t, err)
+	defer db.Close()
+	s := &StatsExt{blobStore: env.BlobStore, db: db, log: env.Logger}
+	s.reset()
+
+	// The blobs are read without going through the hot blobs cache
+	before := env.BlobStore.CacheStats()
+	blobstoretest.Check(t, s.build())
+	after := env.BlobStore.CacheStats()
+	if after.Hits != before.Hits || after.Misses != before.Misses {
+		t.Errorf("the cache should not be used, got %+v before and %+v after", before, after)
+	}
+	if stats := s.Stats(); stats.BlobsCount != 3 || !s.ready {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
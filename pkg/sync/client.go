@@ -3,6 +3,7 @@ package sync
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
@@ -11,6 +12,7 @@ import (
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
 
 	log "github.com/inconshreveable/log15"
 )
@@ -23,6 +25,9 @@ type SyncClient struct {
 
 	blobstore *blobstore.BlobStore
 
+	// Only sync the blobs of this namespace if set
+	ns string
+
 	st *Sync
 	// FIXME(tsileo): close the state
 	state *StateTree
@@ -30,10 +35,11 @@ type SyncClient struct {
 	log log.Logger
 }
 
-func NewSyncClient(logger log.Logger, st *Sync, state *StateTree, blobstore *blobstore.BlobStore, url, apiKey string) *SyncClient {
+func NewSyncClient(logger log.Logger, st *Sync, state *StateTree, blobstore *blobstore.BlobStore, url, apiKey, ns string) *SyncClient {
 	clientOpts := &clientutil.Opts{
 		APIKey:            apiKey,
 		Host:              url,
+		Namespace:         ns,
 		EnableHTTP2:       true,
 		SnappyCompression: false, // FIXME(tsileo): Activate this once snappy response reader is imported
 	}
@@ -44,6 +50,7 @@ func NewSyncClient(logger log.Logger, st *Sync, state *StateTree, blobstore *blo
 		st:        st,
 		state:     state,
 		blobstore: blobstore,
+		ns:        ns,
 	}
 }
 
@@ -63,11 +70,14 @@ func (stc *SyncClient) RemoteLeaf(prefix string) (*LeafState, error) {
 	return ls, nil
 }
 
+var errBlobDeleted = errors.New("blob deleted")
+
 type SyncStats struct {
 	Downloaded     int    `json:"blobs_downloaded"`
 	DownloadedSize int    `json:"downloaded_size"`
 	Uploaded       int    `json:"blobs_uploaded"`
 	UploadedSize   int    `json:"uploaded_size"`
+	Deleted        int    `json:"blobs_deleted_skipped"`
 	Duration       string `json:"sync_duration"`
 	AlreadySynced  bool   `json:"already_in_sync"`
 }
@@ -95,6 +105,9 @@ func (stc *SyncClient) remotePutBlob(hash string, blob []byte) error {
 	switch {
 	case resp.StatusCode == 200:
 		return nil
+	case resp.StatusCode == 410:
+		// The blob has been deleted on the remote instance
+		return errBlobDeleted
 	default:
 		return fmt.Errorf("failed to put blob %v: %v", hash, string(body))
 	}
@@ -128,7 +141,11 @@ func (stc *SyncClient) putBlob(hash string, data []byte) error {
 	if err := blob.Check(); err != nil {
 		return err
 	}
-	return stc.blobstore.Put(context.Background(), blob)
+	ctx := context.Background()
+	if stc.ns != "" {
+		ctx = ctxutil.WithNamespace(ctx, stc.ns)
+	}
+	return stc.blobstore.Put(ctx, blob)
 }
 
 func (stc *SyncClient) getBlob(hash string) ([]byte, error) {
@@ -212,7 +229,7 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 	}
 
 	for _, leaf := range leavesToSend {
-		ls, err := stc.st.LeafState(leaf)
+		ls, err := stc.st.NamespaceLeafState(stc.ns, leaf)
 		if err != nil {
 			return nil, err
 		}
@@ -223,7 +240,7 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 	}
 	for _, leaf := range leavesConflict {
 		// Fetch the local leaf state
-		localLeaf, err := stc.st.LeafState(leaf)
+		localLeaf, err := stc.st.NamespaceLeafState(stc.ns, leaf)
 		if err != nil {
 			return nil, err
 		}
@@ -263,12 +280,26 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 		stats.DownloadedSize += len(blob)
 
 		if err := stc.remotePutBlob(h, blob); err != nil {
+			if err == errBlobDeleted {
+				stats.Deleted++
+				continue
+			}
 			return nil, err
 		}
 	}
 
 	// Pull missing blobs from remote BlobStash instances
 	for _, h := range dlHashes {
+		// Don't resurrect blobs deleted locally
+		deleted, err := stc.blobstore.Deleted(h)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			stats.Deleted++
+			continue
+		}
+
 		blob, err := stc.remoteGetBlob(h)
 		if err != nil {
 			return nil, err
@@ -6,7 +6,8 @@ The algorithm is inspired by Dynamo or Cassandra uses of Merkle trees (as an ant
 
 Each node maintains its own Merkle tree, when doing a sync, the hashes of the tree are checked against each other starting from the root hash to the leaves.
 
-This first implementation only keep 256 (16**2) buckets (the first 2 hex of the hashes).
+This first implementation only keep 256 (16**2) buckets per hash algorithm (the first 2 hex of the digest, along with
+the multihash prefix of the non-default algorithms).
 
 Blake2B (the same hashing algorithm used by the Blob Store) is used to compute the tree.
 
@@ -20,9 +21,12 @@ import (
 	"net/http"
 	"sync"
 
+	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/nsdb"
 
 	"github.com/dchest/blake2b"
 	"github.com/gorilla/mux"
@@ -47,15 +51,17 @@ func NewHash() (h hash.Hash) {
 
 type Sync struct {
 	blobstore *blobstore.BlobStore
+	nsdb      *nsdb.DB
 	conf      *config.Config
 
 	log log2.Logger
 }
 
-func New(logger log2.Logger, conf *config.Config, blobstore *blobstore.BlobStore) *Sync {
+func New(logger log2.Logger, conf *config.Config, blobstore *blobstore.BlobStore, nsDB *nsdb.DB) *Sync {
 	logger.Debug("init")
 	return &Sync{
 		blobstore: blobstore,
+		nsdb:      nsDB,
 		conf:      conf,
 		log:       logger,
 	}
@@ -67,17 +73,29 @@ func (st *Sync) Register(r *mux.Router, basicAuth func(http.Handler) http.Handle
 	r.Handle("/_trigger", basicAuth(http.HandlerFunc(st.triggerHandler())))
 }
 
-func (st *Sync) Client(url, apiKey string) *SyncClient {
-	rawState := st.generateTree()
-	return NewSyncClient(st.log.New("submodule", "synctable-client"), st, rawState, st.blobstore, url, apiKey)
+func (st *Sync) Client(url, apiKey string) (*SyncClient, error) {
+	rawState, err := st.generateTree("")
+	if err != nil {
+		return nil, err
+	}
+	return NewSyncClient(st.log.New("submodule", "synctable-client"), st, rawState, st.blobstore, url, apiKey, ""), nil
 }
 
 func (st *Sync) Sync(url, apiKey string) (*SyncStats, error) {
+	return st.SyncNamespace(url, apiKey, "")
+}
+
+// SyncNamespace only syncs the blobs of the given namespace (all the blobs if empty), the blobs will be added to the
+// namespace on both sides
+func (st *Sync) SyncNamespace(url, apiKey, ns string) (*SyncStats, error) {
 	log := st.log.New("trigger_id", logext.RandId(6))
-	log.Info("Starting sync...", "url", url)
-	rawState := st.generateTree()
+	log.Info("Starting sync...", "url", url, "ns", ns)
+	rawState, err := st.generateTree(ns)
+	if err != nil {
+		return nil, err
+	}
 	defer rawState.Close()
-	client := NewSyncClient(st.log.New("submodule", "synctable-client"), st, rawState, st.blobstore, url, apiKey)
+	client := NewSyncClient(st.log.New("submodule", "synctable-client"), st, rawState, st.blobstore, url, apiKey, ns)
 	return client.Sync()
 }
 
@@ -86,7 +104,7 @@ func (st *Sync) triggerHandler() func(http.ResponseWriter, *http.Request) {
 		q := r.URL.Query()
 		url := q.Get("url")
 		apiKey := q.Get("api_key")
-		stats, err := st.Sync(url, apiKey)
+		stats, err := st.SyncNamespace(url, apiKey, r.Header.Get("BlobStash-Namespace"))
 		if err != nil {
 			panic(err)
 		}
@@ -94,22 +112,33 @@ func (st *Sync) triggerHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func (st *Sync) generateTree() *StateTree {
-	state := NewStateTree()
-	blobs, err := st.blobstore.Enumerate(context.Background(), "", "\xff", 0)
-	if err != nil {
-		panic(err)
+// iter iterates over the blobs of the namespace, or over all the blobs if the namespace is empty
+func (st *Sync) iter(ns, start, end string, fn func(*blob.SizedBlobRef) error) error {
+	if ns != "" {
+		return st.nsdb.Iter(ns, start, end, 0, fn)
 	}
-	for _, blob := range blobs {
+	return st.blobstore.Iter(context.Background(), start, end, 0, fn)
+}
+
+func (st *Sync) generateTree(ns string) (*StateTree, error) {
+	state := NewStateTree()
+	if err := st.iter(ns, "", "\xff", func(ref *blob.SizedBlobRef) error {
 		// st.log.Debug("_state loop", "ns", ns, "hash", h)
-		state.Add(blob.Hash)
+		state.Add(ref.Hash)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	return state
+	return state, nil
 }
 
 func (st *Sync) stateHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		state := st.generateTree()
+		state, err := st.generateTree(r.Header.Get("BlobStash-Namespace"))
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
 		defer state.Close()
 		httputil.WriteJSON(w, state.State())
 	}
@@ -126,14 +155,22 @@ func (st *State) String() string {
 }
 
 func (st *Sync) LeafState(prefix string) (*LeafState, error) {
-	blobs, err := st.blobstore.Enumerate(context.Background(), prefix, prefix+"\xff", 0)
-	if err != nil {
-		panic(err)
-	}
+	return st.NamespaceLeafState("", prefix)
+}
+
+// NamespaceLeafState returns the leaf state for the blobs of the given namespace
+func (st *Sync) NamespaceLeafState(ns, prefix string) (*LeafState, error) {
 	var hashes []string
-	for _, blob := range blobs {
+	if err := st.iter(ns, prefix, prefix+"\xff", func(ref *blob.SizedBlobRef) error {
 		// st.log.Debug("_state loop", "ns", ns, "hash", h)
-		hashes = append(hashes, blob.Hash)
+		// Skip the hashes of other algorithms sharing the same prefix
+		if leafPrefix(ref.Hash) != prefix {
+			return nil
+		}
+		hashes = append(hashes, ref.Hash)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
 	return &LeafState{
@@ -147,7 +184,7 @@ func (st *Sync) stateLeafHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		prefix := vars["prefix"]
-		leafState, err := st.LeafState(prefix)
+		leafState, err := st.NamespaceLeafState(r.Header.Get("BlobStash-Namespace"), prefix)
 		if err != nil {
 			panic(err)
 		}
@@ -161,6 +198,11 @@ type LeafState struct {
 	Hashes []string `json:"hashes"`
 }
 
+// leafPrefix returns the leaf of the hash: the first 2 hex of the digest (prefixed by the multihash header if any)
+func leafPrefix(h string) string {
+	return h[:len(h)-len(hashutil.Digest(h))+2]
+}
+
 type StateTree struct {
 	root   hash.Hash
 	level1 map[string]hash.Hash
@@ -220,11 +262,12 @@ func (st *StateTree) Add(h string) {
 	st.Lock()
 	defer st.Unlock()
 	var chash hash.Hash
-	if exhash, ok := st.level1[h[0:2]]; ok {
+	leaf := leafPrefix(h)
+	if exhash, ok := st.level1[leaf]; ok {
 		chash = exhash
 	} else {
 		chash = blake2b.New256()
-		st.level1[h[0:2]] = chash
+		st.level1[leaf] = chash
 	}
 	chash.Write([]byte(h))
 	st.root.Write([]byte(h))
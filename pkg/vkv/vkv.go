@@ -13,7 +13,9 @@ import (
 	"a4.io/blobstash/pkg/rangedb"
 )
 
-const schemaVersion = 1
+// CurrentSchemaVersion is the schema version of the serialized `KeyValue`, the blobs saved before the schema version
+// was added have a version of 0
+const CurrentSchemaVersion = 1
 
 const (
 	Sep              = ':'
@@ -43,10 +45,21 @@ func (kv *KeyValue) Type() string {
 
 // Implements the `MetaData` interface
 func (kv *KeyValue) Dump() ([]byte, error) {
-	kv.SchemaVersion = schemaVersion
+	kv.SchemaVersion = CurrentSchemaVersion
 	return msgpack.Marshal(kv)
 }
 
+// DecodeSchemaVersion returns the schema version of a serialized `KeyValue`
+func DecodeSchemaVersion(data []byte) (int, error) {
+	v := &struct {
+		SchemaVersion int `msgpack:"_v"`
+	}{}
+	if err := msgpack.Unmarshal(data, v); err != nil {
+		return 0, err
+	}
+	return v.SchemaVersion, nil
+}
+
 func (kv *KeyValue) SetHexHash(h string) error {
 	hash, err := hex.DecodeString(h)
 	if err != nil {
@@ -145,7 +158,7 @@ func (db *DB) get(key string) (*KeyValue, error) {
 func (db *DB) Put(kv *KeyValue) error {
 	// db.mu.Lock()
 	// defer db.mu.Unlock()
-	kv.SchemaVersion = schemaVersion
+	kv.SchemaVersion = CurrentSchemaVersion
 
 	if kv.Version < 1 {
 		kv.Version = int(time.Now().UTC().UnixNano())
@@ -206,3 +206,14 @@ func TestDBIter(t *testing.T) {
 		t.Errorf("bad reverse sort order")
 	}
 }
+
+func TestDecodeSchemaVersion(t *testing.T) {
+	kv := &KeyValue{Key: "k1", Data: []byte("hello"), Version: 1}
+	data, err := kv.Dump()
+	check(err)
+	version, err := DecodeSchemaVersion(data)
+	check(err)
+	if version != CurrentSchemaVersion {
+		t.Errorf("expected schema version %d, got %d", CurrentSchemaVersion, version)
+	}
+}
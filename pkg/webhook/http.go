@@ -0,0 +1,79 @@
+package webhook // import "a4.io/blobstash/pkg/webhook"
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/httputil"
+)
+
+func (w *Webhooks) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(w.webhooksHandler())))
+	r.Handle("/deliveries", basicAuth(http.HandlerFunc(w.deliveriesHandler())))
+	r.Handle("/{name}/_ping", basicAuth(http.HandlerFunc(w.pingHandler())))
+}
+
+func (w *Webhooks) webhooksHandler() func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			httputil.WriteJSON(rw, map[string]interface{}{
+				"data": w.Webhooks(),
+			})
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// deliveriesHandler returns the delivery log, most recent first (`?webhook=<name>` to filter by webhook, `?failed=1`
+// to only return the failed attempts)
+func (w *Webhooks) deliveriesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			q := httputil.NewQuery(r.URL.Query())
+			limit, err := q.GetInt("limit", 50, 1000)
+			if err != nil {
+				httputil.WriteJSONError(rw, http.StatusBadRequest, err.Error())
+				return
+			}
+			deliveries, err := w.Deliveries(q.Get("webhook"), q.Get("failed") == "1", limit)
+			if err != nil {
+				if nerr, ok := err.(*notFoundError); ok {
+					httputil.WriteJSONError(rw, nerr.Status(), nerr.Error())
+					return
+				}
+				httputil.Error(rw, err)
+				return
+			}
+			httputil.WriteJSON(rw, map[string]interface{}{
+				"data": deliveries,
+			})
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// pingHandler sends a "ping" event to the webhook, and returns the delivery
+func (w *Webhooks) pingHandler() func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			d, err := w.Ping(mux.Vars(r)["name"])
+			if err != nil {
+				if nerr, ok := err.(*notFoundError); ok {
+					httputil.WriteJSONError(rw, nerr.Status(), nerr.Error())
+					return
+				}
+				httputil.Error(rw, err)
+				return
+			}
+			httputil.WriteJSON(rw, d)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,602 @@
+/*
+
+Package webhook implements the outbound webhooks, a signed JSON payload is POSTed to the configured URLs on the
+selected events:
+
+- `new_blob`/`delete_blob`: a blob has been saved/deleted
+- `kv`: a key has been updated (optionally only for the keys starting with a prefix)
+- `docstore`: a document has been inserted, updated or deleted (optionally only for some collections)
+
+Each webhook has its own durable queue (see `hub.SubscribeAsync`), so the events are delivered in order, at least once,
+even across restarts. A failed delivery is retried with a backoff, until `max_attempts` is reached, and every attempt
+is saved in the delivery log.
+
+If the webhook has a secret, the `BlobStash-Signature` header contains `sha256=<hex HMAC-SHA256>` of
+`<BlobStash-Timestamp header>.<body>` (see `Sign`).
+
+*/
+package webhook // import "a4.io/blobstash/pkg/webhook"
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cznic/kv"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/replication"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Events
+const (
+	EventNewBlob    = "new_blob"
+	EventDeleteBlob = "delete_blob"
+	EventKv         = "kv"
+	EventDocstore   = "docstore"
+	EventPing       = "ping" // only sent manually, to test a webhook
+)
+
+var validEvents = map[string]bool{
+	EventNewBlob:    true,
+	EventDeleteBlob: true,
+	EventKv:         true,
+	EventDocstore:   true,
+}
+
+const DefaultMaxAttempts = 5
+
+// Delay between two delivery attempts
+var (
+	retryDelay    = 1 * time.Second
+	maxRetryDelay = 1 * time.Minute
+)
+
+const (
+	// Timeout of a single delivery attempt
+	requestTimeout = 10 * time.Second
+
+	// Deliveries older than this are removed from the log
+	logRetention = 7 * 24 * time.Hour
+)
+
+// The name is used in the queue path
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var errStopped = errors.New("webhooks stopped")
+
+// notFoundError implements `httputil.PublicErrorer`, returned for an unknown webhook
+type notFoundError struct {
+	name string
+}
+
+func (e *notFoundError) Error() string { return fmt.Sprintf("unknown webhook \"%s\"", e.name) }
+func (e *notFoundError) Status() int   { return http.StatusNotFound }
+
+// Payload is the JSON body POSTed to the webhook URL
+type Payload struct {
+	ID        string    `json:"id"` // the same across the retries
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Hash      string    `json:"hash,omitempty"` // the blob, the value ref for "kv", or the document blob for "docstore"
+	Namespace string    `json:"namespace,omitempty"`
+
+	// Only for the "kv" events
+	Key     string `json:"key,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+
+	// Only for the "docstore" events
+	Collection string `json:"collection,omitempty"`
+	DocID      string `json:"doc_id,omitempty"`
+	Deleted    bool   `json:"deleted,omitempty"`
+}
+
+// Delivery is a delivery attempt, as saved in the log
+type Delivery struct {
+	Webhook    string    `json:"webhook"`
+	PayloadID  string    `json:"payload_id"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	Duration   string    `json:"duration"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+	GaveUp     bool      `json:"gave_up,omitempty"` // the last attempt failed, the event is dropped
+}
+
+type webhook struct {
+	conf   *config.Webhook
+	events map[string]bool
+}
+
+// wants returns true if the webhook must be notified of the given kv/docstore update
+func (h *webhook) wants(event string, kv *vkv.KeyValue) bool {
+	switch event {
+	case EventKv:
+		return h.events[EventKv] && strings.HasPrefix(kv.Key, h.conf.KeyPrefix)
+	case EventDocstore:
+		if !h.events[EventDocstore] {
+			return false
+		}
+		col, _, ok := docKey(kv.Key)
+		if !ok {
+			return false
+		}
+		if len(h.conf.Collections) == 0 {
+			return true
+		}
+		for _, c := range h.conf.Collections {
+			if c == col {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// docKey returns the collection and the document ID of a docstore key (`docstore.KeyFmt`), and false if the key does
+// not match the format
+func docKey(key string) (string, string, bool) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) != 3 || parts[0]+":" != docstore.PrefixKey || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+type Webhooks struct {
+	log       log.Logger
+	blobStore *blobstore.BlobStore
+	hooks     map[string]*webhook
+	client    *http.Client
+
+	// The delivery log
+	db *kv.DB
+
+	wg     sync.WaitGroup // in-flight deliveries and the prune loop
+	stop   chan struct{}
+	closed bool
+	mu     sync.Mutex
+}
+
+func New(logger log.Logger, conf *config.Config, blobStore *blobstore.BlobStore, chub *hub.Hub) (*Webhooks, error) {
+	logger.Debug("init")
+	hooks := map[string]*webhook{}
+	for _, hookConf := range conf.Webhooks {
+		if !validName.MatchString(hookConf.Name) {
+			return nil, fmt.Errorf("invalid webhook name \"%s\"", hookConf.Name)
+		}
+		if _, ok := hooks[hookConf.Name]; ok {
+			return nil, fmt.Errorf("duplicate webhook \"%s\"", hookConf.Name)
+		}
+		if hookConf.URL == "" {
+			return nil, fmt.Errorf("missing URL for webhook \"%s\"", hookConf.Name)
+		}
+		if len(hookConf.Events) == 0 {
+			return nil, fmt.Errorf("missing events for webhook \"%s\"", hookConf.Name)
+		}
+		if hookConf.MaxAttempts < 1 {
+			hookConf.MaxAttempts = DefaultMaxAttempts
+		}
+		hook := &webhook{conf: hookConf, events: map[string]bool{}}
+		for _, event := range hookConf.Events {
+			if !validEvents[event] {
+				return nil, fmt.Errorf("invalid event \"%s\" for webhook \"%s\"", event, hookConf.Name)
+			}
+			hook.events[event] = true
+		}
+		hooks[hookConf.Name] = hook
+	}
+
+	path := filepath.Join(conf.VarDir(), "webhooks.log")
+	createOpen := kv.Open
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		createOpen = kv.Create
+	}
+	db, err := createOpen(path, &kv.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := &Webhooks{
+		log:       logger,
+		blobStore: blobStore,
+		hooks:     hooks,
+		client:    &http.Client{Timeout: requestTimeout},
+		db:        db,
+		stop:      make(chan struct{}),
+	}
+	for name, hook := range hooks {
+		callbacks := map[hub.EventType]func(context.Context, *blob.Blob, interface{}) error{}
+		if hook.events[EventNewBlob] || hook.events[EventKv] || hook.events[EventDocstore] {
+			callbacks[hub.NewBlob] = webhooks.newBlobCallback(hook)
+		}
+		if hook.events[EventDeleteBlob] {
+			callbacks[hub.DeleteBlob] = webhooks.deleteBlobCallback(hook)
+		}
+		if err := chub.SubscribeAsync("webhook:"+name, filepath.Join(conf.VarDir(), "webhook-"+name+".queue"), callbacks); err != nil {
+			return nil, err
+		}
+	}
+	webhooks.wg.Add(1)
+	go webhooks.pruneLoop()
+	return webhooks, nil
+}
+
+// Close stops the deliveries (the pending events will be delivered after a restart), must be called before closing
+// the hub
+func (w *Webhooks) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.stop)
+	w.mu.Unlock()
+	w.wg.Wait()
+	return w.db.Close()
+}
+
+// Sign returns the signature of the payload (the value of the `BlobStash-Signature` header)
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhooks) newBlobCallback(hook *webhook) func(context.Context, *blob.Blob, interface{}) error {
+	return func(ctx context.Context, b *blob.Blob, _ interface{}) error {
+		ns, _ := ctxutil.Namespace(ctx)
+		if hook.events[EventNewBlob] {
+			if err := w.deliver(hook, &Payload{ID: EventNewBlob + ":" + b.Hash, Event: EventNewBlob, Hash: b.Hash, Namespace: ns}); err != nil {
+				return err
+			}
+		}
+		if !hook.events[EventKv] && !hook.events[EventDocstore] {
+			return nil
+		}
+
+		// Async events only contain the hash, fetch the blob to check if it's a kv update
+		data, err := w.blobStore.Get(ctx, b.Hash)
+		if err != nil {
+			if err == clientutil.ErrBlobNotFound {
+				// The blob has already been deleted
+				return nil
+			}
+			return err
+		}
+		metaType, metaData, isMeta := meta.IsMetaBlob(data)
+		if !isMeta || metaType != vkv.KvType {
+			return nil
+		}
+		kv, err := vkv.UnserializeBlob(metaData)
+		if err != nil {
+			return fmt.Errorf("failed to unserialize meta blob %s: %v", b.Hash, err)
+		}
+		if hook.wants(EventKv, kv) {
+			if err := w.deliver(hook, &Payload{
+				ID:        EventKv + ":" + b.Hash,
+				Event:     EventKv,
+				Hash:      kv.HexHash(),
+				Namespace: ns,
+				Key:       kv.Key,
+				Version:   kv.Version,
+				Data:      kv.Data,
+			}); err != nil {
+				return err
+			}
+		}
+		if hook.wants(EventDocstore, kv) {
+			col, docID, _ := docKey(kv.Key)
+			if err := w.deliver(hook, &Payload{
+				ID:         EventDocstore + ":" + b.Hash,
+				Event:      EventDocstore,
+				Hash:       kv.HexHash(),
+				Namespace:  ns,
+				Collection: col,
+				DocID:      docID,
+				Deleted:    len(kv.Data) > 0 && kv.Data[0] == docstore.FlagDeleted,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (w *Webhooks) deleteBlobCallback(hook *webhook) func(context.Context, *blob.Blob, interface{}) error {
+	return func(ctx context.Context, b *blob.Blob, _ interface{}) error {
+		ns, _ := ctxutil.Namespace(ctx)
+		return w.deliver(hook, &Payload{ID: EventDeleteBlob + ":" + b.Hash, Event: EventDeleteBlob, Hash: b.Hash, Namespace: ns})
+	}
+}
+
+// deliver sends the payload, and retries until it succeeds or `max_attempts` is reached, returns an error only if
+// the webhooks are stopped (so the event is kept in the queue)
+func (w *Webhooks) deliver(hook *webhook, p *Payload) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return errStopped
+	}
+	w.wg.Add(1)
+	w.mu.Unlock()
+	defer w.wg.Done()
+
+	p.Time = time.Now().UTC()
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	backoff := replication.NewBackoff(retryDelay, maxRetryDelay, 2)
+	for attempt := 1; ; attempt++ {
+		d := w.post(hook, p, body, attempt)
+		if !d.Success && attempt >= hook.conf.MaxAttempts {
+			d.GaveUp = true
+		}
+		if err := w.saveDelivery(d); err != nil {
+			w.log.Error("failed to save delivery", "webhook", hook.conf.Name, "err", err)
+		}
+		if d.Success {
+			return nil
+		}
+		if d.GaveUp {
+			w.log.Error("webhook delivery failed, giving up", "webhook", hook.conf.Name, "id", p.ID, "attempts", attempt, "err", d.Error)
+			return nil
+		}
+		delay := backoff.Delay()
+		w.log.Info("webhook delivery failed", "webhook", hook.conf.Name, "id", p.ID, "attempt", attempt, "err", d.Error, "retry_in", delay)
+		select {
+		case <-w.stop:
+			return errStopped
+		case <-time.After(delay):
+		}
+	}
+}
+
+// post makes a single delivery attempt
+func (w *Webhooks) post(hook *webhook, p *Payload, body []byte, attempt int) *Delivery {
+	start := time.Now()
+	d := &Delivery{
+		Webhook:   hook.conf.Name,
+		PayloadID: p.ID,
+		Event:     p.Event,
+		Attempt:   attempt,
+		Time:      start.UTC(),
+	}
+	err := func() error {
+		req, err := http.NewRequest("POST", hook.conf.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(start.Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "BlobStash-Webhook")
+		req.Header.Set("BlobStash-Event", p.Event)
+		req.Header.Set("BlobStash-Delivery", p.ID)
+		req.Header.Set("BlobStash-Timestamp", timestamp)
+		if hook.conf.Secret != "" {
+			req.Header.Set("BlobStash-Signature", Sign(hook.conf.Secret, timestamp, body))
+		}
+		resp, err := w.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		// Drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		d.StatusCode = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}()
+	d.Duration = time.Since(start).String()
+	if err != nil {
+		d.Error = err.Error()
+	} else {
+		d.Success = true
+	}
+	return d
+}
+
+// Ping sends a "ping" event to the webhook (a single attempt), to test it
+func (w *Webhooks) Ping(name string) (*Delivery, error) {
+	hook, ok := w.hooks[name]
+	if !ok {
+		return nil, &notFoundError{name}
+	}
+	now := time.Now().UTC()
+	p := &Payload{ID: fmt.Sprintf("%s:%d", EventPing, now.UnixNano()), Event: EventPing, Time: now}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	d := w.post(hook, p, body, 1)
+	return d, w.saveDelivery(d)
+}
+
+// Log keys, the deliveries are stored as `<webhook>:<time>` => <JSON delivery>
+func encodeKey(name string, t time.Time) []byte {
+	return []byte(fmt.Sprintf("%s:%020d", name, t.UnixNano()))
+}
+
+func (w *Webhooks) saveDelivery(d *Delivery) error {
+	js, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return w.db.Set(encodeKey(d.Webhook, d.Time), js)
+}
+
+// Deliveries returns the most recent deliveries first (of all the webhooks if `name` is empty), `failed` only returns
+// the failed attempts
+func (w *Webhooks) Deliveries(name string, failed bool, limit int) ([]*Delivery, error) {
+	names := []string{name}
+	if name == "" {
+		names = names[:0]
+		for n := range w.hooks {
+			names = append(names, n)
+		}
+	} else if _, ok := w.hooks[name]; !ok {
+		return nil, &notFoundError{name}
+	}
+
+	out := []*Delivery{}
+	for _, n := range names {
+		deliveries, err := w.deliveries(n, failed, limit)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, deliveries...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// deliveries returns the most recent deliveries of the given webhook
+func (w *Webhooks) deliveries(name string, failed bool, limit int) ([]*Delivery, error) {
+	prefix := []byte(name + ":")
+	// Iterate in reverse order, starting from the first key after the prefix (`;` is the next char after `:`)
+	enum, _, err := w.db.Seek([]byte(name + ";"))
+	if err != nil {
+		return nil, err
+	}
+	out := []*Delivery{}
+	first := true
+	for len(out) < limit {
+		k, v, err := enum.Prev()
+		if err == io.EOF && first {
+			// The enumerator is empty when seeking after the last key
+			enum, err = w.db.SeekLast()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			first = false
+			continue
+		}
+		first = false
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(k, prefix) {
+			if bytes.Compare(k, prefix) > 0 {
+				// The seek returns the first key after the range
+				continue
+			}
+			break
+		}
+		d := &Delivery{}
+		if err := json.Unmarshal(v, d); err != nil {
+			return nil, err
+		}
+		if failed && d.Success {
+			continue
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// pruneLoop removes the old deliveries from the log
+func (w *Webhooks) pruneLoop() {
+	defer w.wg.Done()
+	t := time.NewTicker(1 * time.Hour)
+	defer t.Stop()
+	for {
+		if err := w.prune(time.Now().Add(-logRetention)); err != nil {
+			w.log.Error("failed to prune the delivery log", "err", err)
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// prune removes the deliveries older than `before`
+func (w *Webhooks) prune(before time.Time) error {
+	for name := range w.hooks {
+		prefix := []byte(name + ":")
+		enum, _, err := w.db.Seek(prefix)
+		if err != nil {
+			return err
+		}
+		end := encodeKey(name, before)
+		var keys [][]byte
+		for {
+			k, _, err := enum.Next()
+			if err == io.EOF || (err == nil && (!bytes.HasPrefix(k, prefix) || bytes.Compare(k, end) >= 0)) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := w.db.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Webhooks returns the configured webhooks (without the secrets)
+func (w *Webhooks) Webhooks() []map[string]interface{} {
+	out := []map[string]interface{}{}
+	for _, hook := range w.hooks {
+		out = append(out, map[string]interface{}{
+			"name":         hook.conf.Name,
+			"url":          hook.conf.URL,
+			"events":       hook.conf.Events,
+			"key_prefix":   hook.conf.KeyPrefix,
+			"collections":  hook.conf.Collections,
+			"max_attempts": hook.conf.MaxAttempts,
+			"signed":       hook.conf.Secret != "",
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+	return out
+}
@@ -0,0 +1,181 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore/blobstoretest"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/kvstore"
+)
+
+func TestWebhooks(t *testing.T) {
+	retryDelay = 10 * time.Millisecond
+
+	// The first request fails, so it's retried
+	var mu sync.Mutex
+	var payloads []*Payload
+	var requests int
+	received := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/404" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if sig := Sign("secret", r.Header.Get("BlobStash-Timestamp"), body); r.Header.Get("BlobStash-Signature") != sig {
+			t.Errorf("bad signature %q, expected %q", r.Header.Get("BlobStash-Signature"), sig)
+		}
+		p := &Payload{}
+		if err := json.Unmarshal(body, p); err != nil {
+			t.Error(err)
+			return
+		}
+		payloads = append(payloads, p)
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	env, cleanup := blobstoretest.New(t, func(conf *config.Config) {
+		conf.Webhooks = []*config.Webhook{
+			&config.Webhook{Name: "ci", URL: srv.URL, Secret: "secret", Events: []string{EventKv}, KeyPrefix: "ci:"},
+			&config.Webhook{Name: "down", URL: srv.URL + "/404", Events: []string{EventDeleteBlob}, MaxAttempts: 1},
+		}
+	})
+	defer cleanup()
+	bs := env.BlobStore
+	kvs, err := kvstore.New(env.Logger, env.Conf, bs, env.Meta)
+	blobstoretest.Check(t, err)
+	defer kvs.Close()
+	webhooks, err := New(env.Logger, env.Conf, bs, env.Hub)
+	blobstoretest.Check(t, err)
+	defer webhooks.Close()
+
+	ctx := context.Background()
+	_, err = kvs.Put(ctx, "other", "", []byte("nope"), -1)
+	blobstoretest.Check(t, err)
+	_, err = kvs.Put(ctx, "ci:build", "", []byte("ok"), -1)
+	blobstoretest.Check(t, err)
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the webhook has not been called")
+	}
+	mu.Lock()
+	if len(payloads) != 1 || payloads[0].Event != EventKv || payloads[0].Key != "ci:build" || string(payloads[0].Data) != "ok" {
+		t.Errorf("unexpected payloads %+v", payloads)
+	}
+	mu.Unlock()
+
+	// The 404 is not retried (`max_attempts` is 1)
+	b := blob.New([]byte("deleted"))
+	blobstoretest.Check(t, bs.Put(ctx, b))
+	blobstoretest.Check(t, bs.Delete(ctx, b.Hash))
+	var deliveries []*Delivery
+	for i := 0; i < 100; i++ {
+		deliveries, err = webhooks.Deliveries("", false, 10)
+		blobstoretest.Check(t, err)
+		if len(deliveries) == 3 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 deliveries, got %d", len(deliveries))
+	}
+	down := deliveries[0]
+	if down.Webhook != "down" || down.Success || !down.GaveUp || down.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected delivery %+v", down)
+	}
+
+	deliveries, err = webhooks.Deliveries("ci", false, 10)
+	blobstoretest.Check(t, err)
+	if len(deliveries) != 2 || !deliveries[0].Success || deliveries[0].Attempt != 2 || deliveries[1].Success {
+		t.Errorf("unexpected deliveries %+v", deliveries)
+	}
+	deliveries, err = webhooks.Deliveries("ci", true, 10)
+	blobstoretest.Check(t, err)
+	if len(deliveries) != 1 || deliveries[0].StatusCode != http.StatusInternalServerError {
+		t.Errorf("unexpected failed deliveries %+v", deliveries)
+	}
+	if _, err := webhooks.Deliveries("nope", false, 10); err == nil {
+		t.Errorf("an unknown webhook should fail")
+	}
+
+	// Prune the whole log
+	blobstoretest.Check(t, webhooks.prune(time.Now().Add(time.Second)))
+	deliveries, err = webhooks.Deliveries("", false, 10)
+	blobstoretest.Check(t, err)
+	if len(deliveries) != 0 {
+		t.Errorf("the log should be empty, got %d deliveries", len(deliveries))
+	}
+}
+
+func TestWebhooksDocstore(t *testing.T) {
+	received := make(chan *Payload, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &Payload{}
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			t.Error(err)
+			return
+		}
+		received <- p
+	}))
+	defer srv.Close()
+
+	env, cleanup := blobstoretest.New(t, func(conf *config.Config) {
+		conf.Webhooks = []*config.Webhook{
+			&config.Webhook{Name: "docs", URL: srv.URL, Events: []string{EventDocstore}},
+		}
+	})
+	defer cleanup()
+	kvs, err := kvstore.New(env.Logger, env.Conf, env.BlobStore, env.Meta)
+	blobstoretest.Check(t, err)
+	defer kvs.Close()
+	webhooks, err := New(env.Logger, env.Conf, env.BlobStore, env.Hub)
+	blobstoretest.Check(t, err)
+	defer webhooks.Close()
+
+	// The keys that don't match `docstore.KeyFmt` are skipped
+	ctx := context.Background()
+	for _, key := range []string{"docstore:", "docstore:foo", "docstore:foo:", "docstore::doc"} {
+		_, err = kvs.Put(ctx, key, "", []byte{docstore.FlagNoop}, -1)
+		blobstoretest.Check(t, err)
+	}
+	_, err = kvs.Put(ctx, fmt.Sprintf(docstore.KeyFmt, "col", "doc1"), "", []byte{docstore.FlagNoop}, -1)
+	blobstoretest.Check(t, err)
+
+	select {
+	case p := <-received:
+		if p.Event != EventDocstore || p.Collection != "col" || p.DocID != "doc1" || p.Deleted {
+			t.Errorf("unexpected payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the webhook has not been called")
+	}
+	select {
+	case p := <-received:
+		t.Errorf("unexpected payload %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}